@@ -0,0 +1,430 @@
+package marsbot
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+	"text/tabwriter"
+	"time"
+
+	"github.com/DataDog/zstd"
+	"github.com/caarlos0/env/v11"
+	"github.com/mattn/go-sqlite3"
+)
+
+const backupUsage = `usage:
+  marsbotgo backup list [-target NAME]
+  marsbotgo backup restore [-force] [-at TIME] [-target NAME] <key|latest>
+
+NAME is "s3" or "local", list shows every configured target and restore reads the first one by default.
+restore replays the deltas shipped after the backup up to TIME (default: all of them),
+"latest" then picks the newest backup taken at or before TIME.
+TIME is "2006-01-02 15:04:05" in local time or RFC 3339.
+-force replaces an existing database, but never one that a running bot has open.`
+
+// errLiveDatabase is returned by restoreBackup when MARS_DB_PATH exists and -force was not given.
+var errLiveDatabase = errors.New("database already exists, stop the bot and pass -force to overwrite it")
+
+// errDatabaseInUse is returned by restoreBackup when another process has MARS_DB_PATH open, -force does not help.
+var errDatabaseInUse = errors.New("database is in use, stop the bot before restoring")
+
+// RunBackupCommand runs "marsbotgo backup ..." with the arguments after "backup" and returns the exit code.
+// Only BackupConfig is read from the environment.
+func RunBackupCommand(args []string) int {
+	if len(args) == 0 {
+		fmt.Fprintln(os.Stderr, backupUsage)
+		return 2
+	}
+	if err := env.Parse(&config.BackupConfig); err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		return 2
+	}
+	targets, err := configuredBackupTargets()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		return 2
+	}
+	// an interrupted restore still removes its temporary file
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	switch args[0] {
+	case "list":
+		fs := flag.NewFlagSet("list", flag.ContinueOnError)
+		targetFlag := fs.String("target", "", "list only this target")
+		if err := fs.Parse(args[1:]); err != nil {
+			return 2
+		}
+		if *targetFlag != "" {
+			t, err := findBackupTarget(targets, *targetFlag)
+			if err != nil {
+				fmt.Fprintln(os.Stderr, err.Error())
+				return 2
+			}
+			targets = []BackupTarget{t}
+		}
+		err = runBackupList(ctx, os.Stdout, targets)
+	case "restore":
+		fs := flag.NewFlagSet("restore", flag.ContinueOnError)
+		force := fs.Bool("force", false, "overwrite an existing database")
+		atFlag := fs.String("at", "", "restore the state at this time")
+		targetFlag := fs.String("target", "", "restore from this target instead of the first configured one")
+		if err := fs.Parse(args[1:]); err != nil {
+			return 2
+		}
+		var target BackupTarget
+		if target, err = findBackupTarget(targets, *targetFlag); err != nil {
+			fmt.Fprintln(os.Stderr, err.Error())
+			return 2
+		}
+		if fs.NArg() != 1 {
+			fmt.Fprintln(os.Stderr, backupUsage)
+			return 2
+		}
+		var at time.Time
+		if *atFlag != "" {
+			if at, err = parseRestoreTime(*atFlag); err != nil {
+				fmt.Fprintln(os.Stderr, err.Error())
+				return 2
+			}
+		}
+		err = runBackupRestore(ctx, target, fs.Arg(0), at, *force)
+	default:
+		fmt.Fprintln(os.Stderr, backupUsage)
+		return 2
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		return 1
+	}
+	return 0
+}
+
+type backupObject struct {
+	Key          string
+	Size         int64
+	LastModified time.Time
+	// Deltas are the changed pages shipped on top of a full backup, oldest first.
+	Deltas []backupObject
+}
+
+// listBackups returns the full backups on target with their deltas, oldest first.
+func listBackups(ctx context.Context, target BackupTarget) ([]backupObject, error) {
+	objects, err := target.List(ctx, backupKeyPrefix)
+	if err != nil {
+		return nil, fmt.Errorf("list backups on %s: %w", target.Name(), err)
+	}
+	var backups []backupObject
+	deltas := make(map[string][]backupObject)
+	for _, b := range objects {
+		if strings.HasSuffix(b.Key, backupKeySuffix) {
+			backups = append(backups, b)
+		} else if base, _, _, ok := parseDeltaKey(b.Key); ok {
+			deltas[base] = append(deltas[base], b)
+		}
+	}
+	sort.Slice(backups, func(i, j int) bool { return backups[i].Key < backups[j].Key })
+	for i := range backups {
+		chain := deltas[backups[i].Key]
+		// the sequence number is zero padded, so keys sort in shipping order
+		sort.Slice(chain, func(i, j int) bool { return chain[i].Key < chain[j].Key })
+		backups[i].Deltas = chain
+	}
+	return backups, nil
+}
+
+// pickBackup resolves "latest" or an exact key against backups, which must be sorted oldest first.
+// With a non-zero at, "latest" is the newest backup taken at or before at.
+func pickBackup(backups []backupObject, name string, at time.Time) (backupObject, error) {
+	if len(backups) == 0 {
+		return backupObject{}, errors.New("no backups found")
+	}
+	if name == "latest" {
+		for i := len(backups) - 1; i >= 0; i-- {
+			if at.IsZero() || !backupTime(backups[i]).After(at) {
+				return backups[i], nil
+			}
+		}
+		return backupObject{}, fmt.Errorf("no backup taken before %s", at.Format(time.DateTime))
+	}
+	for _, b := range backups {
+		if b.Key != name {
+			continue
+		}
+		if !at.IsZero() && backupTime(b).After(at) {
+			return backupObject{}, fmt.Errorf("backup %q was taken after %s", name, at.Format(time.DateTime))
+		}
+		return b, nil
+	}
+	return backupObject{}, fmt.Errorf("backup %q not found", name)
+}
+
+// replayDeltas returns the deltas of b to apply to reach the state at at, or all of them for a zero at.
+// A missing delta ends the chain, the pages after it cannot be trusted.
+func replayDeltas(b backupObject, at time.Time) (deltas []backupObject, gap bool) {
+	for i, d := range b.Deltas {
+		_, seq, taken, ok := parseDeltaKey(d.Key)
+		if !ok {
+			continue
+		}
+		if !at.IsZero() && taken.After(at) {
+			break
+		}
+		if seq != i+1 {
+			return deltas, true
+		}
+		deltas = append(deltas, d)
+	}
+	return deltas, false
+}
+
+func parseRestoreTime(s string) (time.Time, error) {
+	if t, err := time.ParseInLocation(time.DateTime, s, time.Local); err == nil {
+		return t, nil
+	}
+	t, err := time.Parse(time.RFC3339, s)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid time %q, use \"2006-01-02 15:04:05\" or RFC 3339", s)
+	}
+	return t, nil
+}
+
+// runBackupList prints the backups of every target, a target that cannot be listed is reported and skipped.
+func runBackupList(ctx context.Context, w io.Writer, targets []BackupTarget) error {
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "TARGET\tKEY\tSIZE\tUPLOADED\tDELTAS\tLAST DELTA")
+	var errs []error
+	for _, t := range targets {
+		backups, err := listBackups(ctx, t)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		for _, b := range backups {
+			lastDelta := "-"
+			if n := len(b.Deltas); n > 0 {
+				if _, _, at, ok := parseDeltaKey(b.Deltas[n-1].Key); ok {
+					lastDelta = at.Format(time.DateTime)
+				}
+			}
+			fmt.Fprintf(tw, "%s\t%s\t%d\t%s\t%d\t%s\n", t.Name(), b.Key, b.Size,
+				b.LastModified.Local().Format(time.DateTime), len(b.Deltas), lastDelta)
+		}
+	}
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+	return errors.Join(errs...)
+}
+
+func runBackupRestore(ctx context.Context, target BackupTarget, name string, at time.Time, force bool) error {
+	if err := registerBundledSQLiteDriver(); err != nil {
+		return err
+	}
+	if err := checkRestoreTarget(ctx, config.DbPath, force); err != nil {
+		return err
+	}
+	backups, err := listBackups(ctx, target)
+	if err != nil {
+		return err
+	}
+	backup, err := pickBackup(backups, name, at)
+	if err != nil {
+		return err
+	}
+	deltas, gap := replayDeltas(backup, at)
+	if gap {
+		fmt.Fprintf(os.Stderr, "warning: delta %d of %s is missing, later deltas are skipped\n", len(deltas)+1, backup.Key)
+	}
+	obj, err := target.Get(ctx, backup.Key)
+	if err != nil {
+		return fmt.Errorf("download %s: %w", backup.Key, err)
+	}
+	defer obj.Close()
+	var readers []io.Reader
+	for _, d := range deltas {
+		dobj, err := target.Get(ctx, d.Key)
+		if err != nil {
+			return fmt.Errorf("download %s: %w", d.Key, err)
+		}
+		defer dobj.Close()
+		readers = append(readers, dobj)
+	}
+	if err := restoreBackup(ctx, obj, readers, config.DbPath, force); err != nil {
+		return err
+	}
+	state := backupTime(backup)
+	if len(deltas) > 0 {
+		_, _, state, _ = parseDeltaKey(deltas[len(deltas)-1].Key)
+	}
+	fmt.Printf("restored %s and %d deltas to %s, the database is as of %s\n",
+		backup.Key, len(deltas), config.DbPath, state.Format(time.DateTime))
+	return nil
+}
+
+// checkRestoreTarget refuses to replace an existing database unless force is set,
+// and refuses to replace one that is in use even then.
+func checkRestoreTarget(ctx context.Context, path string, force bool) error {
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	inUse, err := databaseInUse(ctx, path)
+	if err != nil {
+		return fmt.Errorf("check whether %s is in use: %w", path, err)
+	}
+	if inUse {
+		return errDatabaseInUse
+	}
+	if !force {
+		return errLiveDatabase
+	}
+	return nil
+}
+
+// databaseInUse reports whether another connection, such as a running bot, has the database at path open.
+// Every connection to a WAL database holds a shared lock on the file for as long as it is open, so an exclusive
+// lock taken without the wal-index only succeeds when nobody else uses the database. A file that is not
+// a database cannot be in use by the bot.
+func databaseInUse(ctx context.Context, path string) (bool, error) {
+	probe, err := sql.Open(sqliteDriverName, path)
+	if err != nil {
+		return false, err
+	}
+	defer probe.Close()
+	conn, err := probe.Conn(ctx)
+	if err != nil {
+		return lockProbeResult(err)
+	}
+	defer conn.Close()
+	for _, stmt := range []string{
+		"PRAGMA busy_timeout = 0",
+		"PRAGMA locking_mode = EXCLUSIVE",
+		"BEGIN EXCLUSIVE",
+		"SELECT count(*) FROM sqlite_master",
+		"ROLLBACK",
+	} {
+		if _, err := conn.ExecContext(ctx, stmt); err != nil {
+			return lockProbeResult(err)
+		}
+	}
+	return false, nil
+}
+
+func lockProbeResult(err error) (bool, error) {
+	var sqliteErr sqlite3.Error
+	if errors.As(err, &sqliteErr) {
+		switch sqliteErr.Code {
+		case sqlite3.ErrBusy, sqlite3.ErrLocked:
+			return true, nil
+		case sqlite3.ErrNotADB:
+			return false, nil
+		}
+	}
+	return false, err
+}
+
+// restoreBackup decrypts and decompresses a backup next to path, applies the zstd compressed deltas in order,
+// checks the result with PRAGMA integrity_check and renames it over path,
+// so path holds either the old or the restored database at any time.
+func restoreBackup(ctx context.Context, r io.Reader, deltas []io.Reader, path string, force bool) error {
+	if err := checkRestoreTarget(ctx, path, force); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".restore-*")
+	if err != nil {
+		return err
+	}
+	tmpPath := tmp.Name()
+	defer os.Remove(tmpPath)
+
+	plain, err := openBackupStream(r)
+	if err != nil {
+		_ = tmp.Close()
+		return err
+	}
+	decoder := zstd.NewReader(plain)
+	_, err = io.Copy(tmp, decoder)
+	if cerr := decoder.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		_ = tmp.Close()
+		return fmt.Errorf("decompress backup: %w", err)
+	}
+	for i, d := range deltas {
+		plain, err := openBackupStream(d)
+		if err != nil {
+			_ = tmp.Close()
+			return fmt.Errorf("delta %d: %w", i+1, err)
+		}
+		decoder := zstd.NewReader(plain)
+		err = applyDelta(tmp, decoder)
+		if cerr := decoder.Close(); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			_ = tmp.Close()
+			return fmt.Errorf("apply delta %d: %w", i+1, err)
+		}
+	}
+	err = tmp.Sync()
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	if err := checkDatabaseIntegrity(ctx, tmpPath); err != nil {
+		return err
+	}
+	if err := os.Rename(tmpPath, path); err != nil {
+		return fmt.Errorf("replace database: %w", err)
+	}
+	// a WAL left behind by the old database must not be replayed into the restored one
+	for _, suffix := range []string{"-wal", "-shm"} {
+		if err := os.Remove(path + suffix); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+func checkDatabaseIntegrity(ctx context.Context, path string) error {
+	check, err := sql.Open(sqliteDriverName, path)
+	if err != nil {
+		return err
+	}
+	defer check.Close()
+	rows, err := check.QueryContext(ctx, "PRAGMA integrity_check")
+	if err != nil {
+		return fmt.Errorf("integrity check: %w", err)
+	}
+	defer rows.Close()
+	var problems []string
+	for rows.Next() {
+		var line string
+		if err := rows.Scan(&line); err != nil {
+			return fmt.Errorf("integrity check: %w", err)
+		}
+		if line != "ok" {
+			problems = append(problems, line)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("integrity check: %w", err)
+	}
+	if len(problems) > 0 {
+		return fmt.Errorf("integrity check failed: %s", strings.Join(problems, "; "))
+	}
+	return nil
+}
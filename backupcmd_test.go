@@ -0,0 +1,263 @@
+package marsbot
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/DataDog/zstd"
+
+	"marsbot/minicv"
+)
+
+func TestPickBackup(t *testing.T) {
+	backups := []backupObject{
+		{Key: "backup_mars_at_2024-01-01-00_00_00.db.zst"},
+		{Key: "backup_mars_at_2024-02-01-00_00_00.db.zst"},
+	}
+	if b, err := pickBackup(backups, "latest", time.Time{}); err != nil || b.Key != backups[1].Key {
+		t.Fatalf("latest = %v, %v", b, err)
+	}
+	if b, err := pickBackup(backups, backups[0].Key, time.Time{}); err != nil || b.Key != backups[0].Key {
+		t.Fatalf("by key = %v, %v", b, err)
+	}
+	if _, err := pickBackup(backups, "missing", time.Time{}); err == nil {
+		t.Fatalf("expected missing backup error")
+	}
+	if _, err := pickBackup(nil, "latest", time.Time{}); err == nil {
+		t.Fatalf("expected empty list error")
+	}
+	at := time.Date(2024, 1, 15, 0, 0, 0, 0, time.Local)
+	if b, err := pickBackup(backups, "latest", at); err != nil || b.Key != backups[0].Key {
+		t.Fatalf("latest before %v = %v, %v", at, b, err)
+	}
+	if _, err := pickBackup(backups, backups[1].Key, at); err == nil {
+		t.Fatalf("expected a backup taken after -at to be rejected")
+	}
+}
+
+func TestRestoreBackup(t *testing.T) {
+	useTestDB(t)
+	ctx := context.Background()
+	hash := picHash{Algo: minicv.AlgoDHash, Size: 8, Hash: []byte{1, 2, 3, 4, 5, 6, 7, 8}}
+	if _, err := recordMars(ctx, -1, 1, hash); err != nil {
+		t.Fatalf("record: %v", err)
+	}
+	dir := t.TempDir()
+	backupPath := filepath.Join(dir, "backup.db")
+	if err := backupWithSQLiteAPI(ctx, backupPath); err != nil {
+		t.Fatalf("backup: %v", err)
+	}
+	raw, err := os.ReadFile(backupPath)
+	if err != nil {
+		t.Fatalf("read backup: %v", err)
+	}
+	packed, err := zstd.Compress(nil, raw)
+	if err != nil {
+		t.Fatalf("compress: %v", err)
+	}
+
+	target := filepath.Join(dir, "mars.db")
+	if err := os.WriteFile(target, []byte("old"), 0o644); err != nil {
+		t.Fatalf("write target: %v", err)
+	}
+	if err := os.WriteFile(target+"-wal", []byte("stale"), 0o644); err != nil {
+		t.Fatalf("write wal: %v", err)
+	}
+	if err := restoreBackup(ctx, bytes.NewReader(packed), nil, target, false); !errors.Is(err, errLiveDatabase) {
+		t.Fatalf("restore without force = %v", err)
+	}
+
+	corrupt, _ := zstd.Compress(nil, bytes.Repeat([]byte("not a database"), 512))
+	if err := restoreBackup(ctx, bytes.NewReader(corrupt), nil, target, true); err == nil {
+		t.Fatalf("expected corrupt backup to be rejected")
+	}
+	if got, _ := os.ReadFile(target); string(got) != "old" {
+		t.Fatalf("failed restore touched the database: %q", got)
+	}
+
+	if err := restoreBackup(ctx, bytes.NewReader(packed), nil, target, true); err != nil {
+		t.Fatalf("restore: %v", err)
+	}
+	if _, err := os.Stat(target + "-wal"); !os.IsNotExist(err) {
+		t.Fatalf("stale wal kept: %v", err)
+	}
+	if err := checkDatabaseIntegrity(ctx, target); err != nil {
+		t.Fatalf("restored database: %v", err)
+	}
+	leftovers, _ := filepath.Glob(target + ".restore-*")
+	if len(leftovers) != 0 {
+		t.Fatalf("temporary files left: %v", leftovers)
+	}
+}
+
+func TestReplayDeltas(t *testing.T) {
+	base := "backup_mars_at_2024-01-01-00_00_00.db.zst"
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.Local)
+	b := backupObject{Key: base}
+	for seq := 1; seq <= 4; seq++ {
+		if seq == 3 {
+			continue
+		}
+		key := deltaKey(base, seq, start.Add(time.Duration(seq)*time.Hour))
+		if gotBase, gotSeq, _, ok := parseDeltaKey(key); !ok || gotBase != base || gotSeq != seq {
+			t.Fatalf("parseDeltaKey(%q) = %q, %d, %v", key, gotBase, gotSeq, ok)
+		}
+		b.Deltas = append(b.Deltas, backupObject{Key: key})
+	}
+	if deltas, gap := replayDeltas(b, start.Add(90*time.Minute)); len(deltas) != 1 || gap {
+		t.Fatalf("up to 01:30 = %v, %v", deltas, gap)
+	}
+	if deltas, gap := replayDeltas(b, time.Time{}); len(deltas) != 2 || !gap {
+		t.Fatalf("all = %v, %v", deltas, gap)
+	}
+}
+
+func TestRestoreBackupDeltas(t *testing.T) {
+	useTestDB(t)
+	ctx := context.Background()
+	dir := t.TempDir()
+	record := func(from, to int) {
+		for i := from; i < to; i++ {
+			hash := picHash{Algo: minicv.AlgoDHash, Size: 8, Hash: []byte{byte(i), byte(i >> 8), 3, 4, 5, 6, 7, 8}}
+			if _, err := recordMars(ctx, -1, int64(i+1), hash); err != nil {
+				t.Fatalf("record: %v", err)
+			}
+		}
+	}
+	snapshot := func(name string) string {
+		path := filepath.Join(dir, name)
+		if err := backupWithSQLiteAPI(ctx, path); err != nil {
+			t.Fatalf("backup: %v", err)
+		}
+		return path
+	}
+	compress := func(data []byte) []byte {
+		packed, err := zstd.Compress(nil, data)
+		if err != nil {
+			t.Fatalf("compress: %v", err)
+		}
+		return packed
+	}
+
+	record(0, 10)
+	fullPath := snapshot("full.db")
+	pages, err := readPageIndex(fullPath)
+	if err != nil {
+		t.Fatalf("index: %v", err)
+	}
+	var deltas [][]byte
+	for _, n := range [][2]int{{10, 500}, {500, 1500}} {
+		record(n[0], n[1])
+		var buf bytes.Buffer
+		next, changed, err := writeDelta(&buf, snapshot("copy.db"), pages, time.Now())
+		if err != nil || changed == 0 || changed == len(next.hashes) {
+			t.Fatalf("delta: %d of %d pages, %v", changed, len(next.hashes), err)
+		}
+		pages = next
+		deltas = append(deltas, compress(buf.Bytes()))
+	}
+	full, err := os.ReadFile(fullPath)
+	if err != nil {
+		t.Fatalf("read full: %v", err)
+	}
+
+	for applied := 0; applied <= len(deltas); applied++ {
+		target := filepath.Join(dir, "mars.db")
+		var readers []io.Reader
+		for _, d := range deltas[:applied] {
+			readers = append(readers, bytes.NewReader(d))
+		}
+		if err := restoreBackup(ctx, bytes.NewReader(compress(full)), readers, target, true); err != nil {
+			t.Fatalf("restore with %d deltas: %v", applied, err)
+		}
+		restored, err := sql.Open(sqliteDriverName, target)
+		if err != nil {
+			t.Fatalf("open restored: %v", err)
+		}
+		var count int
+		err = restored.QueryRowContext(ctx, "SELECT COUNT(*) FROM mars_info").Scan(&count)
+		_ = restored.Close()
+		if want := []int{10, 500, 1500}[applied]; err != nil || count != want {
+			t.Fatalf("with %d deltas: %d rows, want %d, %v", applied, count, want, err)
+		}
+	}
+}
+
+func TestRestoreRefusesDatabaseInUse(t *testing.T) {
+	ctx := context.Background()
+	target := filepath.Join(t.TempDir(), "mars.db")
+	live, err := sql.Open(sqliteDriverName, target)
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	defer live.Close()
+	for _, stmt := range []string{"PRAGMA journal_mode=WAL", "CREATE TABLE t (x INTEGER)", "INSERT INTO t VALUES (1)"} {
+		if _, err := live.ExecContext(ctx, stmt); err != nil {
+			t.Fatalf("%s: %v", stmt, err)
+		}
+	}
+
+	// the connection is idle, only its shared lock shows that the database is open
+	if err := restoreBackup(ctx, bytes.NewReader(nil), nil, target, true); !errors.Is(err, errDatabaseInUse) {
+		t.Fatalf("restore over an open database = %v", err)
+	}
+	var x int
+	if err := live.QueryRowContext(ctx, "SELECT x FROM t").Scan(&x); err != nil || x != 1 {
+		t.Fatalf("live database after refused restore = %d, %v", x, err)
+	}
+
+	_ = live.Close()
+	if inUse, err := databaseInUse(ctx, target); err != nil || inUse {
+		t.Fatalf("closed database in use = %v, %v", inUse, err)
+	}
+	if err := checkRestoreTarget(ctx, target, false); !errors.Is(err, errLiveDatabase) {
+		t.Fatalf("closed database without force = %v", err)
+	}
+}
+
+func TestShipDeltaStartsChain(t *testing.T) {
+	useTestDB(t)
+	ctx := context.Background()
+	dir := filepath.Join(t.TempDir(), "backups")
+	config.BackupConfig = BackupConfig{BackupLocalDir: dir, BackupDeltaMinutes: 10}
+	deltaMu.Lock()
+	prevChain := deltaState
+	deltaState = nil
+	deltaMu.Unlock()
+	prevBackup := lastBackup.Load()
+	t.Cleanup(func() {
+		deltaMu.Lock()
+		deltaState = prevChain
+		deltaMu.Unlock()
+		lastBackup.Store(prevBackup)
+	})
+	files := func(pattern string) int {
+		matches, _ := filepath.Glob(filepath.Join(dir, pattern))
+		return len(matches)
+	}
+
+	// without a chain, e.g. after a restart whose first backup failed, the delta tick makes the base
+	if err := shipDeltaOrBackup(ctx); err != nil {
+		t.Fatalf("first tick: %v", err)
+	}
+	if files(backupKeyPrefix+"*"+backupKeySuffix) != 1 || files("*"+deltaKeyInfix+"*") != 0 {
+		t.Fatalf("first tick did not make exactly one full backup")
+	}
+	hash := picHash{Algo: minicv.AlgoDHash, Size: 8, Hash: []byte{1, 2, 3, 4, 5, 6, 7, 8}}
+	if _, err := recordMars(ctx, -1, 1, hash); err != nil {
+		t.Fatalf("record: %v", err)
+	}
+	if err := shipDeltaOrBackup(ctx); err != nil {
+		t.Fatalf("second tick: %v", err)
+	}
+	if files("*"+deltaKeyInfix+"*"+deltaKeySuffix) != 1 {
+		t.Fatalf("second tick did not ship a delta")
+	}
+}
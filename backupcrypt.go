@@ -0,0 +1,263 @@
+package marsbot
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+)
+
+// Backups and deltas are encrypted after compression when BACKUP_KEY_FILE is set. The object is
+//
+//	magic "MARSENC1" | key fingerprint [8] | chunk size uint32 | nonce prefix [7]
+//
+// followed by chunks of (length uint32 with the top bit marking the last chunk, AES-256-GCM ciphertext).
+// Each chunk is sealed with the nonce prefix, its big endian index and the last-chunk flag, and the header as
+// additional data, so chunks cannot be reordered, dropped or appended to without failing authentication.
+const (
+	encMagic       = "MARSENC1"
+	encChunkSize   = 64 << 10
+	encPrefixSize  = 7
+	encHeaderSize  = len(encMagic) + 8 + 4 + encPrefixSize
+	encLastChunk   = 1 << 31
+	encChunkHeader = 4
+	encTagSize     = 16
+)
+
+// loadBackupKey reads a 32 byte key stored raw, hex or base64 encoded.
+func loadBackupKey(path string) ([]byte, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("read backup key: %w", err)
+	}
+	if len(data) == 32 {
+		return data, nil
+	}
+	text := string(bytes.TrimSpace(data))
+	if key, err := hex.DecodeString(text); err == nil && len(key) == 32 {
+		return key, nil
+	}
+	if key, err := base64.StdEncoding.DecodeString(text); err == nil && len(key) == 32 {
+		return key, nil
+	}
+	return nil, fmt.Errorf("backup key %s must hold 32 bytes, raw, hex or base64 encoded", path)
+}
+
+// configuredBackupKey returns the key of BACKUP_KEY_FILE, or nil when backups are not encrypted.
+func configuredBackupKey() ([]byte, error) {
+	if config.BackupKeyFile == "" {
+		return nil, nil
+	}
+	return loadBackupKey(config.BackupKeyFile)
+}
+
+func keyFingerprint(key []byte) [8]byte {
+	sum := sha256.Sum256(key)
+	var fp [8]byte
+	copy(fp[:], sum[:])
+	return fp
+}
+
+// encryptedSize is the length of the encryption of n bytes.
+func encryptedSize(n int64) int64 {
+	chunks := max(1, (n+encChunkSize-1)/encChunkSize)
+	return int64(encHeaderSize) + chunks*int64(encChunkHeader+encTagSize) + n
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func chunkNonce(prefix []byte, index uint32, last bool) []byte {
+	nonce := make([]byte, 12)
+	copy(nonce, prefix)
+	binary.BigEndian.PutUint32(nonce[encPrefixSize:], index)
+	if last {
+		nonce[11] = 1
+	}
+	return nonce
+}
+
+type encryptReader struct {
+	src    *bufio.Reader
+	aead   cipher.AEAD
+	header []byte
+	index  uint32
+	plain  []byte
+	out    bytes.Buffer
+	done   bool
+}
+
+// newEncryptReader returns a reader of the encryption of src under key.
+func newEncryptReader(src io.Reader, key []byte) (io.Reader, error) {
+	aead, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	header := make([]byte, 0, encHeaderSize)
+	header = append(header, encMagic...)
+	fp := keyFingerprint(key)
+	header = append(header, fp[:]...)
+	header = binary.BigEndian.AppendUint32(header, encChunkSize)
+	prefix := make([]byte, encPrefixSize)
+	if _, err := rand.Read(prefix); err != nil {
+		return nil, err
+	}
+	header = append(header, prefix...)
+	e := &encryptReader{src: bufio.NewReaderSize(src, encChunkSize), aead: aead, header: header, plain: make([]byte, encChunkSize)}
+	e.out.Write(header)
+	return e, nil
+}
+
+func (e *encryptReader) Read(p []byte) (int, error) {
+	for e.out.Len() == 0 {
+		if e.done {
+			return 0, io.EOF
+		}
+		if err := e.seal(); err != nil {
+			return 0, err
+		}
+	}
+	return e.out.Read(p)
+}
+
+func (e *encryptReader) seal() error {
+	n, err := io.ReadFull(e.src, e.plain)
+	if err != nil && !errors.Is(err, io.EOF) && !errors.Is(err, io.ErrUnexpectedEOF) {
+		return err
+	}
+	last := n < len(e.plain)
+	if !last {
+		if _, err := e.src.Peek(1); errors.Is(err, io.EOF) {
+			last = true
+		} else if err != nil {
+			return err
+		}
+	}
+	length := uint32(n)
+	if last {
+		length |= encLastChunk
+		e.done = true
+	}
+	var lenBuf [encChunkHeader]byte
+	binary.BigEndian.PutUint32(lenBuf[:], length)
+	e.out.Write(lenBuf[:])
+	e.out.Write(e.aead.Seal(nil, chunkNonce(e.header[encHeaderSize-encPrefixSize:], e.index, last), e.plain[:n], e.header))
+	e.index++
+	return nil
+}
+
+type decryptReader struct {
+	src    io.Reader
+	aead   cipher.AEAD
+	header []byte
+	chunk  uint32
+	index  uint32
+	sealed []byte
+	out    []byte
+	done   bool
+}
+
+// newDecryptReader reverses newEncryptReader. It fails with the fingerprint of the key that is needed
+// when key is a different one.
+func newDecryptReader(src io.Reader, key []byte) (io.Reader, error) {
+	header := make([]byte, encHeaderSize)
+	if _, err := io.ReadFull(src, header); err != nil {
+		return nil, fmt.Errorf("read encryption header: %w", err)
+	}
+	if string(header[:len(encMagic)]) != encMagic {
+		return nil, errors.New("not an encrypted backup")
+	}
+	fp := keyFingerprint(key)
+	if want := header[len(encMagic) : len(encMagic)+8]; !bytes.Equal(want, fp[:]) {
+		return nil, fmt.Errorf("backup was encrypted with key %x, BACKUP_KEY_FILE holds key %x", want, fp)
+	}
+	chunk := binary.BigEndian.Uint32(header[len(encMagic)+8:])
+	if chunk == 0 || chunk >= encLastChunk {
+		return nil, fmt.Errorf("invalid chunk size %d", chunk)
+	}
+	aead, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	return &decryptReader{src: src, aead: aead, header: header, chunk: chunk}, nil
+}
+
+func (d *decryptReader) Read(p []byte) (int, error) {
+	for len(d.out) == 0 {
+		if d.done {
+			return 0, io.EOF
+		}
+		if err := d.open(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, d.out)
+	d.out = d.out[n:]
+	return n, nil
+}
+
+func (d *decryptReader) open() error {
+	var lenBuf [encChunkHeader]byte
+	if _, err := io.ReadFull(d.src, lenBuf[:]); err != nil {
+		return fmt.Errorf("encrypted backup is truncated: %w", err)
+	}
+	length := binary.BigEndian.Uint32(lenBuf[:])
+	last := length&encLastChunk != 0
+	length &^= encLastChunk
+	if length > d.chunk {
+		return fmt.Errorf("chunk %d is too long", d.index)
+	}
+	if need := int(length) + d.aead.Overhead(); cap(d.sealed) < need {
+		d.sealed = make([]byte, need)
+	} else {
+		d.sealed = d.sealed[:need]
+	}
+	if _, err := io.ReadFull(d.src, d.sealed); err != nil {
+		return fmt.Errorf("encrypted backup is truncated: %w", err)
+	}
+	plain, err := d.aead.Open(d.sealed[:0], chunkNonce(d.header[encHeaderSize-encPrefixSize:], d.index, last), d.sealed, d.header)
+	if err != nil {
+		return fmt.Errorf("chunk %d failed authentication", d.index)
+	}
+	d.index++
+	d.out = plain
+	if last {
+		d.done = true
+		if n, _ := d.src.Read(make([]byte, 1)); n > 0 {
+			return errors.New("data after the last chunk of an encrypted backup")
+		}
+	}
+	return nil
+}
+
+// openBackupStream decrypts r if it is an encrypted backup or delta, with the key of BACKUP_KEY_FILE,
+// and passes plain ones through.
+func openBackupStream(r io.Reader) (io.Reader, error) {
+	br := bufio.NewReader(r)
+	magic, err := br.Peek(len(encMagic))
+	if err != nil || string(magic) != encMagic {
+		return br, nil
+	}
+	key, err := configuredBackupKey()
+	if err != nil {
+		return nil, err
+	}
+	if key == nil {
+		return nil, errors.New("backup is encrypted, set BACKUP_KEY_FILE to restore it")
+	}
+	return newDecryptReader(br, key)
+}
@@ -0,0 +1,135 @@
+package marsbot
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/hex"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func encryptAll(t *testing.T, plain, key []byte) []byte {
+	t.Helper()
+	r, err := newEncryptReader(bytes.NewReader(plain), key)
+	if err != nil {
+		t.Fatalf("encrypt: %v", err)
+	}
+	sealed, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatalf("encrypt: %v", err)
+	}
+	return sealed
+}
+
+func decryptAll(sealed, key []byte) ([]byte, error) {
+	r, err := newDecryptReader(bytes.NewReader(sealed), key)
+	if err != nil {
+		return nil, err
+	}
+	return io.ReadAll(r)
+}
+
+func TestBackupEncryptionRoundTrip(t *testing.T) {
+	key := bytes.Repeat([]byte{7}, 32)
+	for _, n := range []int{0, 1, encChunkSize - 1, encChunkSize, encChunkSize + 1, 3 * encChunkSize} {
+		plain := make([]byte, n)
+		for i := range plain {
+			plain[i] = byte(i * 31)
+		}
+		sealed := encryptAll(t, plain, key)
+		if int64(len(sealed)) != encryptedSize(int64(n)) {
+			t.Fatalf("size %d: encrypted to %d bytes, encryptedSize says %d", n, len(sealed), encryptedSize(int64(n)))
+		}
+		got, err := decryptAll(sealed, key)
+		if err != nil || !bytes.Equal(got, plain) {
+			t.Fatalf("size %d: round trip failed: %v", n, err)
+		}
+	}
+}
+
+func TestBackupEncryptionRejectsTampering(t *testing.T) {
+	key := bytes.Repeat([]byte{7}, 32)
+	plain := append(bytes.Repeat([]byte("mars"), encChunkSize), "!"...)
+	sealed := encryptAll(t, plain, key)
+
+	if _, err := decryptAll(sealed, bytes.Repeat([]byte{8}, 32)); err == nil || !strings.Contains(err.Error(), "encrypted with key") {
+		t.Fatalf("wrong key = %v", err)
+	}
+	flipped := append([]byte(nil), sealed...)
+	flipped[len(flipped)/2] ^= 1
+	if _, err := decryptAll(flipped, key); err == nil {
+		t.Fatalf("flipped bit accepted")
+	}
+	// dropping the final chunk leaves a stream that ends without the last-chunk flag
+	lastChunk := encChunkHeader + encTagSize + len(plain)%encChunkSize
+	if _, err := decryptAll(sealed[:len(sealed)-lastChunk], key); err == nil {
+		t.Fatalf("truncated stream accepted")
+	}
+	if _, err := decryptAll(append(append([]byte(nil), sealed...), 0), key); err == nil {
+		t.Fatalf("trailing data accepted")
+	}
+}
+
+func TestLoadBackupKey(t *testing.T) {
+	key := make([]byte, 32)
+	for i := range key {
+		key[i] = byte(i)
+	}
+	dir := t.TempDir()
+	for name, content := range map[string][]byte{
+		"raw": key,
+		"hex": []byte(hex.EncodeToString(key) + "\n"),
+		"b64": []byte(base64.StdEncoding.EncodeToString(key)),
+	} {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, content, 0o600); err != nil {
+			t.Fatal(err)
+		}
+		got, err := loadBackupKey(path)
+		if err != nil || !bytes.Equal(got, key) {
+			t.Fatalf("%s key = %x, %v", name, got, err)
+		}
+	}
+	short := filepath.Join(dir, "short")
+	if err := os.WriteFile(short, []byte("abcd"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := loadBackupKey(short); err == nil {
+		t.Fatalf("short key accepted")
+	}
+}
+
+func TestOpenBackupStream(t *testing.T) {
+	prev := config
+	t.Cleanup(func() { config = prev })
+	key := bytes.Repeat([]byte{9}, 32)
+	keyFile := filepath.Join(t.TempDir(), "backup.key")
+	if err := os.WriteFile(keyFile, key, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	sealed := encryptAll(t, []byte("zstd frame"), key)
+
+	config.BackupKeyFile = ""
+	if _, err := openBackupStream(bytes.NewReader(sealed)); err == nil {
+		t.Fatalf("encrypted backup opened without a key")
+	}
+	r, err := openBackupStream(bytes.NewReader([]byte("plain")))
+	if err != nil {
+		t.Fatalf("plain: %v", err)
+	}
+	if got, _ := io.ReadAll(r); string(got) != "plain" {
+		t.Fatalf("plain stream = %q", got)
+	}
+
+	config.BackupKeyFile = keyFile
+	r, err = openBackupStream(bytes.NewReader(sealed))
+	if err != nil {
+		t.Fatalf("encrypted: %v", err)
+	}
+	if got, err := io.ReadAll(r); err != nil || string(got) != "zstd frame" {
+		t.Fatalf("encrypted stream = %q, %v", got, err)
+	}
+}
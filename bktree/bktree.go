@@ -0,0 +1,102 @@
+// Package bktree implements a Burkhard-Keller tree over equal-length byte strings
+// using the Hamming distance, for radius queries on perceptual hashes.
+package bktree
+
+import (
+	"math/bits"
+	"sort"
+)
+
+// Match is a stored hash within the queried radius.
+type Match struct {
+	Hash     []byte
+	Distance int
+}
+
+type node struct {
+	hash     []byte
+	children map[int]*node
+}
+
+// Tree is not safe for concurrent use.
+type Tree struct {
+	root *node
+	size int
+}
+
+func New() *Tree {
+	return &Tree{}
+}
+
+// Len returns the number of distinct hashes in the tree.
+func (t *Tree) Len() int {
+	return t.size
+}
+
+// Add inserts hash and reports whether it was not already present.
+// Hashes of a different length than the ones already stored are rejected.
+func (t *Tree) Add(hash []byte) bool {
+	if t.root == nil {
+		t.root = &node{hash: clone(hash)}
+		t.size = 1
+		return true
+	}
+	if len(hash) != len(t.root.hash) {
+		return false
+	}
+	cur := t.root
+	for {
+		d := Distance(cur.hash, hash)
+		if d == 0 {
+			return false
+		}
+		next, ok := cur.children[d]
+		if !ok {
+			if cur.children == nil {
+				cur.children = make(map[int]*node)
+			}
+			cur.children[d] = &node{hash: clone(hash)}
+			t.size++
+			return true
+		}
+		cur = next
+	}
+}
+
+// Search returns every stored hash whose distance to hash is at most radius, nearest first.
+func (t *Tree) Search(hash []byte, radius int) []Match {
+	if t.root == nil || len(hash) != len(t.root.hash) || radius < 0 {
+		return nil
+	}
+	var matches []Match
+	stack := []*node{t.root}
+	for len(stack) > 0 {
+		cur := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		d := Distance(cur.hash, hash)
+		if d <= radius {
+			matches = append(matches, Match{Hash: cur.hash, Distance: d})
+		}
+		// triangle inequality: only children at distance d-radius..d+radius can hold matches
+		for cd, child := range cur.children {
+			if cd >= d-radius && cd <= d+radius {
+				stack = append(stack, child)
+			}
+		}
+	}
+	sort.Slice(matches, func(i, j int) bool { return matches[i].Distance < matches[j].Distance })
+	return matches
+}
+
+// Distance is the number of differing bits between two equal-length byte strings.
+func Distance(a, b []byte) int {
+	d := 0
+	for i := range a {
+		d += bits.OnesCount8(a[i] ^ b[i])
+	}
+	return d
+}
+
+func clone(b []byte) []byte {
+	return append([]byte(nil), b...)
+}
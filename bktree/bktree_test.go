@@ -0,0 +1,62 @@
+package bktree
+
+import (
+	"math/rand"
+	"testing"
+)
+
+func TestSearchMatchesBruteForce(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	tree := New()
+	var stored [][]byte
+	base := make([]byte, 8)
+	rng.Read(base)
+	for i := 0; i < 2000; i++ {
+		h := append([]byte(nil), base...)
+		// keep hashes clustered so that small radii return something
+		for flips := rng.Intn(20); flips > 0; flips-- {
+			bit := rng.Intn(64)
+			h[bit/8] ^= 1 << (bit % 8)
+		}
+		if tree.Add(h) {
+			stored = append(stored, h)
+		}
+	}
+	if tree.Len() != len(stored) {
+		t.Fatalf("Len() = %d, want %d", tree.Len(), len(stored))
+	}
+	for _, radius := range []int{0, 3, 6, 12} {
+		query := stored[rng.Intn(len(stored))]
+		want := 0
+		for _, h := range stored {
+			if Distance(h, query) <= radius {
+				want++
+			}
+		}
+		got := tree.Search(query, radius)
+		if len(got) != want {
+			t.Fatalf("radius %d: got %d matches, want %d", radius, len(got), want)
+		}
+		for i, m := range got {
+			if m.Distance > radius || (i > 0 && got[i-1].Distance > m.Distance) {
+				t.Fatalf("radius %d: bad match order or distance at %d: %+v", radius, i, m)
+			}
+		}
+	}
+}
+
+func TestAddRejectsDuplicatesAndOtherLengths(t *testing.T) {
+	tree := New()
+	if !tree.Add([]byte{1, 2}) {
+		t.Fatal("first add should succeed")
+	}
+	if tree.Add([]byte{1, 2}) {
+		t.Fatal("duplicate add should be rejected")
+	}
+	if tree.Add([]byte{1, 2, 3}) {
+		t.Fatal("hash of another length should be rejected")
+	}
+	if got := tree.Search([]byte{1, 2, 3}, 64); got != nil {
+		t.Fatalf("search with another length = %v", got)
+	}
+}
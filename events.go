@@ -0,0 +1,384 @@
+package marsbot
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/PaulSonOfLars/gotgbot/v2"
+	"github.com/PaulSonOfLars/gotgbot/v2/ext"
+	"go.uber.org/zap"
+)
+
+// Events are POSTed as JSON to every endpoint of EVENT_WEBHOOKS that wants their type:
+//
+//	{"id": "...", "type": "mars_detected", "created_at": "2006-01-02T15:04:05Z", "data": {...}}
+//
+// Each request carries X-Marsbot-Event, X-Marsbot-Delivery, which stays the same across retries of one delivery,
+// X-Marsbot-Timestamp in unix seconds and, with EVENT_WEBHOOK_SECRET set,
+// X-Marsbot-Signature: sha256=hex(HMAC-SHA256(secret, timestamp + "." + body)).
+const (
+	eventMarsDetected     = "mars_detected"
+	eventWhitelistChanged = "whitelist_changed"
+	eventBotJoined        = "bot_joined"
+	eventBotLeft          = "bot_left"
+	eventExportDone       = "export_done"
+
+	eventQueueSize      = 256
+	eventWorkers        = 4
+	eventMaxBackoff     = time.Minute
+	eventRequestTimeout = 10 * time.Second
+)
+
+var eventTypes = []string{eventMarsDetected, eventWhitelistChanged, eventBotJoined, eventBotLeft, eventExportDone}
+
+// eventRetryBase is the wait before the first retry, it doubles with every further attempt.
+var eventRetryBase = time.Second
+
+type eventEndpoint struct {
+	URL string
+	// Events the endpoint receives, all of them when empty.
+	Events []string
+	// Legacy marks MARS_REPORT_STAT_URL, which keeps getting the flat {"group_id", "mars_count"} body
+	// of mars_detected it always got instead of the envelope.
+	Legacy bool
+}
+
+func (e eventEndpoint) wants(eventType string) bool {
+	return len(e.Events) == 0 || slices.Contains(e.Events, eventType)
+}
+
+type eventEnvelope struct {
+	ID        string    `json:"id"`
+	Type      string    `json:"type"`
+	CreatedAt time.Time `json:"created_at"`
+	Data      any       `json:"data"`
+}
+
+type eventDelivery struct {
+	endpoint eventEndpoint
+	id       string
+	typ      string
+	body     []byte
+}
+
+type marsDetectedEvent struct {
+	GroupID   int64  `json:"group_id"`
+	MessageID int64  `json:"message_id"`
+	Media     string `json:"media"`
+	Hash      string `json:"hash"`
+	// MarsCount is how often the media was seen before this message.
+	MarsCount int64 `json:"mars_count"`
+	LastMsgID int64 `json:"last_msg_id"`
+	// Distance is the number of differing bits of a fuzzy match, 0 for an exact one.
+	Distance int `json:"distance"`
+}
+
+type whitelistChangedEvent struct {
+	GroupID int64 `json:"group_id"`
+	// Target is "media" for a picture or thumbnail and "user" for a user whose media is ignored.
+	Target      string `json:"target"`
+	Media       string `json:"media,omitempty"`
+	Hash        string `json:"hash,omitempty"`
+	UserID      int64  `json:"user_id,omitempty"`
+	InWhitelist bool   `json:"in_whitelist"`
+	ByUserID    int64  `json:"by_user_id,omitempty"`
+}
+
+type chatMemberEvent struct {
+	GroupID  int64  `json:"group_id"`
+	ChatType string `json:"chat_type"`
+	Title    string `json:"title"`
+	Status   string `json:"status"`
+	ByUserID int64  `json:"by_user_id,omitempty"`
+}
+
+type exportDoneEvent struct {
+	GroupID  int64  `json:"group_id"`
+	Format   string `json:"format"`
+	ToDM     bool   `json:"to_dm"`
+	Size     int64  `json:"size"`
+	ByUserID int64  `json:"by_user_id,omitempty"`
+}
+
+var (
+	eventClient    *http.Client
+	eventEndpoints []eventEndpoint
+	eventQueue     chan eventDelivery
+	// eventMu guards eventQueue against sends after stopEvents closed it.
+	eventMu     sync.RWMutex
+	eventClosed bool
+	eventWG     sync.WaitGroup
+)
+
+// parseEventEndpoints reads EVENT_WEBHOOKS entries, a URL optionally followed by whitespace and a comma
+// separated list of event types.
+func parseEventEndpoints(entries []string) ([]eventEndpoint, error) {
+	var endpoints []eventEndpoint
+	for _, entry := range entries {
+		fields := strings.Fields(entry)
+		if len(fields) == 0 {
+			continue
+		}
+		if len(fields) > 2 {
+			return nil, fmt.Errorf("event webhook %q: expected a URL and an optional list of events", entry)
+		}
+		u, err := url.Parse(fields[0])
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return nil, fmt.Errorf("event webhook %q is not an http(s) URL", fields[0])
+		}
+		endpoint := eventEndpoint{URL: fields[0]}
+		if len(fields) == 2 {
+			for _, t := range strings.Split(fields[1], ",") {
+				if !slices.Contains(eventTypes, t) {
+					return nil, fmt.Errorf("event webhook %s: unknown event %q, use %s", fields[0], t,
+						strings.Join(eventTypes, ", "))
+				}
+				endpoint.Events = append(endpoint.Events, t)
+			}
+		}
+		endpoints = append(endpoints, endpoint)
+	}
+	return endpoints, nil
+}
+
+// startEvents sets up the endpoints of EVENT_WEBHOOKS and the deprecated MARS_REPORT_STAT_URL,
+// which is delivered like the others but with its old body, and starts the delivery workers.
+func startEvents() error {
+	endpoints, err := parseEventEndpoints(config.EventWebhooks)
+	if err != nil {
+		return err
+	}
+	if config.ReportStatUrl != "" {
+		endpoints = append(endpoints, eventEndpoint{URL: config.ReportStatUrl, Events: []string{eventMarsDetected}, Legacy: true})
+		logger.Warn("MARS_REPORT_STAT_URL is deprecated, subscribe the endpoint to mars_detected in EVENT_WEBHOOKS instead")
+	}
+	if len(endpoints) == 0 {
+		return nil
+	}
+	if config.EventWebhookSecret == "" {
+		logger.Warn("EVENT_WEBHOOK_SECRET is not set, event deliveries are not signed")
+	}
+	eventClient = &http.Client{Timeout: eventRequestTimeout}
+	eventEndpoints = endpoints
+	eventQueue = make(chan eventDelivery, eventQueueSize)
+	for i := 0; i < eventWorkers; i++ {
+		eventWG.Add(1)
+		go func() {
+			defer eventWG.Done()
+			for d := range eventQueue {
+				deliverEvent(rootCtx, d)
+			}
+		}()
+	}
+	logger.Info("event webhooks enabled", zap.Int("endpoints", len(endpoints)))
+	return nil
+}
+
+// stopEvents delivers the queued events and waits for the workers, which give up retrying once rootCtx is cancelled.
+func stopEvents() {
+	eventMu.Lock()
+	if eventQueue == nil || eventClosed {
+		eventMu.Unlock()
+		return
+	}
+	eventClosed = true
+	close(eventQueue)
+	eventMu.Unlock()
+	eventWG.Wait()
+}
+
+func randomID() string {
+	var b [16]byte
+	_, _ = rand.Read(b[:])
+	return hex.EncodeToString(b[:])
+}
+
+// emitEvent queues eventType with data for every endpoint that wants it. It never blocks, an event that does not
+// fit into the queue is dropped.
+func emitEvent(eventType string, data any) {
+	eventMu.RLock()
+	defer eventMu.RUnlock()
+	if eventQueue == nil || eventClosed {
+		return
+	}
+	body, err := json.Marshal(eventEnvelope{ID: randomID(), Type: eventType, CreatedAt: time.Now().UTC(), Data: data})
+	if err != nil {
+		logger.Warn("encode event", zap.String("type", eventType), zap.Error(err))
+		return
+	}
+	for _, endpoint := range eventEndpoints {
+		if !endpoint.wants(eventType) {
+			continue
+		}
+		payload := body
+		if endpoint.Legacy {
+			if payload = legacyStatBody(data); payload == nil {
+				continue
+			}
+		}
+		select {
+		case eventQueue <- eventDelivery{endpoint: endpoint, id: randomID(), typ: eventType, body: payload}:
+		default:
+			eventDeliveries.inc(eventType, "dropped")
+			logger.Warn("event queue full, dropping event", zap.String("type", eventType), zap.String("url", endpoint.URL))
+		}
+	}
+}
+
+// legacyStatBody is the body reportStat used to send, only mars_detected has one.
+func legacyStatBody(data any) []byte {
+	m, ok := data.(marsDetectedEvent)
+	if !ok {
+		return nil
+	}
+	body, _ := json.Marshal(map[string]int64{"group_id": m.GroupID, "mars_count": m.MarsCount})
+	return body
+}
+
+func signEvent(secret string, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// deliverEvent posts d until the endpoint accepts it, retrying transport errors, 429 and 5xx with exponential
+// backoff up to EVENT_WEBHOOK_MAX_ATTEMPTS times.
+func deliverEvent(ctx context.Context, d eventDelivery) {
+	backoff := eventRetryBase
+	attempts := max(1, config.EventMaxAttempts)
+	var lastErr error
+	for attempt := 1; attempt <= attempts; attempt++ {
+		retry, err := postEvent(ctx, d)
+		if err == nil {
+			eventDeliveries.inc(d.typ, "ok")
+			return
+		}
+		lastErr = err
+		if !retry || attempt == attempts {
+			break
+		}
+		select {
+		case <-ctx.Done():
+			attempts = attempt
+		case <-time.After(backoff):
+		}
+		backoff = min(2*backoff, eventMaxBackoff)
+	}
+	eventDeliveries.inc(d.typ, "failed")
+	if logger != nil {
+		logger.Warn("deliver event", zap.String("type", d.typ), zap.String("url", d.endpoint.URL),
+			zap.String("delivery", d.id), zap.Int("attempts", attempts), zap.Error(lastErr))
+	}
+}
+
+// postEvent makes one delivery attempt and reports whether a failure is worth retrying.
+func postEvent(ctx context.Context, d eventDelivery) (retry bool, err error) {
+	if ctx.Err() != nil {
+		return false, ctx.Err()
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, d.endpoint.URL, bytes.NewReader(d.body))
+	if err != nil {
+		return false, err
+	}
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "marsbot")
+	req.Header.Set("X-Marsbot-Event", d.typ)
+	req.Header.Set("X-Marsbot-Delivery", d.id)
+	req.Header.Set("X-Marsbot-Timestamp", timestamp)
+	if config.EventWebhookSecret != "" {
+		req.Header.Set("X-Marsbot-Signature", signEvent(config.EventWebhookSecret, timestamp, d.body))
+	}
+	resp, err := eventClient.Do(req)
+	if err != nil {
+		return true, err
+	}
+	_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, 4<<10))
+	_ = resp.Body.Close()
+	switch {
+	case resp.StatusCode < 300:
+		return false, nil
+	case resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500:
+		return true, fmt.Errorf("endpoint answered %s", resp.Status)
+	default:
+		return false, fmt.Errorf("endpoint answered %s", resp.Status)
+	}
+}
+
+func emitMarsDetected(msg *gotgbot.Message, res marsResult) {
+	emitEvent(eventMarsDetected, marsDetectedEvent{
+		GroupID:   msg.Chat.Id,
+		MessageID: msg.MessageId,
+		Media:     mediaLabel(res.Hash.Media),
+		Hash:      hex.EncodeToString(res.Hash.Hash),
+		MarsCount: res.PrevCount,
+		LastMsgID: res.PrevLastMsgID,
+		Distance:  res.Distance,
+	})
+}
+
+func emitMediaWhitelist(ctx *ext.Context, hash picHash, inWhitelist bool) {
+	emitEvent(eventWhitelistChanged, whitelistChangedEvent{
+		GroupID:     ctx.EffectiveChat.Id,
+		Target:      "media",
+		Media:       mediaLabel(hash.Media),
+		Hash:        hex.EncodeToString(hash.Hash),
+		InWhitelist: inWhitelist,
+		ByUserID:    actorID(ctx),
+	})
+}
+
+func emitUserWhitelist(ctx *ext.Context, userID int64, inWhitelist bool) {
+	emitEvent(eventWhitelistChanged, whitelistChangedEvent{
+		GroupID:     ctx.EffectiveChat.Id,
+		Target:      "user",
+		UserID:      userID,
+		InWhitelist: inWhitelist,
+		ByUserID:    actorID(ctx),
+	})
+}
+
+func actorID(ctx *ext.Context) int64 {
+	if ctx.EffectiveUser == nil {
+		return 0
+	}
+	return ctx.EffectiveUser.Id
+}
+
+// emitChatMemberChange reports the bot being added to or removed from a chat, promotions and the like are ignored.
+func emitChatMemberChange(update *gotgbot.ChatMemberUpdated) {
+	gone := func(status string) bool { return status == "left" || status == "kicked" }
+	oldStatus, newStatus := update.OldChatMember.GetStatus(), update.NewChatMember.GetStatus()
+	var eventType string
+	switch {
+	case gone(oldStatus) && !gone(newStatus):
+		eventType = eventBotJoined
+	case !gone(oldStatus) && gone(newStatus):
+		eventType = eventBotLeft
+	default:
+		return
+	}
+	emitEvent(eventType, chatMemberEvent{
+		GroupID:  update.Chat.Id,
+		ChatType: update.Chat.Type,
+		Title:    update.Chat.Title,
+		Status:   newStatus,
+		ByUserID: update.From.Id,
+	})
+}
@@ -0,0 +1,147 @@
+package marsbot
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+func TestParseEventEndpoints(t *testing.T) {
+	endpoints, err := parseEventEndpoints([]string{
+		"https://a.example/hook",
+		" http://b.example/hook mars_detected,bot_left ",
+		"",
+	})
+	if err != nil {
+		t.Fatalf("parse: %v", err)
+	}
+	if len(endpoints) != 2 || endpoints[0].URL != "https://a.example/hook" || len(endpoints[0].Events) != 0 {
+		t.Fatalf("endpoints = %+v", endpoints)
+	}
+	if !slices.Equal(endpoints[1].Events, []string{eventMarsDetected, eventBotLeft}) {
+		t.Fatalf("filter = %v", endpoints[1].Events)
+	}
+	if !endpoints[0].wants(eventExportDone) || endpoints[1].wants(eventExportDone) || !endpoints[1].wants(eventBotLeft) {
+		t.Fatalf("wants does not follow the filter")
+	}
+	for _, bad := range []string{"ftp://a.example/hook", "https://a.example/hook mars", "https:///hook", "https://a a b"} {
+		if _, err := parseEventEndpoints([]string{bad}); err == nil {
+			t.Errorf("%q parsed", bad)
+		}
+	}
+}
+
+type webhookRequest struct {
+	header http.Header
+	body   []byte
+}
+
+// webhookServer answers with statuses in turn, repeating the last one.
+func webhookServer(t *testing.T, statuses ...int) (*httptest.Server, func() []webhookRequest) {
+	var mu sync.Mutex
+	var got []webhookRequest
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		mu.Lock()
+		got = append(got, webhookRequest{header: r.Header.Clone(), body: body})
+		status := statuses[min(len(got), len(statuses))-1]
+		mu.Unlock()
+		w.WriteHeader(status)
+	}))
+	t.Cleanup(srv.Close)
+	return srv, func() []webhookRequest {
+		mu.Lock()
+		defer mu.Unlock()
+		return slices.Clone(got)
+	}
+}
+
+func useTestEvents(t *testing.T) {
+	prevConfig, prevLogger, prevClient, prevBase := config, logger, eventClient, eventRetryBase
+	logger, eventClient, eventRetryBase = zap.NewNop(), &http.Client{Timeout: time.Second}, time.Millisecond
+	config.EventWebhookSecret = "s3cret"
+	config.EventMaxAttempts = 3
+	t.Cleanup(func() {
+		config, logger, eventClient, eventRetryBase = prevConfig, prevLogger, prevClient, prevBase
+	})
+}
+
+func TestDeliverEventRetries(t *testing.T) {
+	useTestEvents(t)
+	srv, requests := webhookServer(t, http.StatusInternalServerError, http.StatusTooManyRequests, http.StatusOK)
+	before := eventDeliveries.value(eventMarsDetected, "ok")
+
+	d := eventDelivery{endpoint: eventEndpoint{URL: srv.URL}, id: randomID(), typ: eventMarsDetected, body: []byte(`{"id":"1"}`)}
+	deliverEvent(context.Background(), d)
+	got := requests()
+	if len(got) != 3 {
+		t.Fatalf("attempts = %d, want 3", len(got))
+	}
+	for _, r := range got {
+		if r.header.Get("X-Marsbot-Delivery") != d.id || r.header.Get("X-Marsbot-Event") != eventMarsDetected {
+			t.Fatalf("headers = %v", r.header)
+		}
+		ts := r.header.Get("X-Marsbot-Timestamp")
+		if r.header.Get("X-Marsbot-Signature") != signEvent("s3cret", ts, r.body) {
+			t.Fatalf("signature %q does not verify", r.header.Get("X-Marsbot-Signature"))
+		}
+	}
+	if eventDeliveries.value(eventMarsDetected, "ok") != before+1 {
+		t.Fatalf("successful delivery was not counted")
+	}
+}
+
+func TestDeliverEventGivesUp(t *testing.T) {
+	useTestEvents(t)
+	srv, requests := webhookServer(t, http.StatusBadRequest)
+	deliverEvent(context.Background(), eventDelivery{endpoint: eventEndpoint{URL: srv.URL}, id: randomID(), typ: eventBotJoined, body: []byte(`{}`)})
+	if n := len(requests()); n != 1 {
+		t.Fatalf("a 400 was retried %d times", n-1)
+	}
+
+	srv, requests = webhookServer(t, http.StatusBadGateway)
+	deliverEvent(context.Background(), eventDelivery{endpoint: eventEndpoint{URL: srv.URL}, id: randomID(), typ: eventBotJoined, body: []byte(`{}`)})
+	if n := len(requests()); n != config.EventMaxAttempts {
+		t.Fatalf("attempts = %d, want %d", n, config.EventMaxAttempts)
+	}
+
+	config.EventWebhookSecret = ""
+	srv, requests = webhookServer(t, http.StatusNoContent)
+	deliverEvent(context.Background(), eventDelivery{endpoint: eventEndpoint{URL: srv.URL}, id: randomID(), typ: eventBotJoined, body: []byte(`{}`)})
+	if got := requests(); len(got) != 1 || got[0].header.Get("X-Marsbot-Signature") != "" {
+		t.Fatalf("unsigned delivery = %+v", got)
+	}
+}
+
+func TestEmitEventLegacyBody(t *testing.T) {
+	useTestEvents(t)
+	prevEndpoints, prevQueue := eventEndpoints, eventQueue
+	eventEndpoints = []eventEndpoint{
+		{URL: "https://new.example/hook"},
+		{URL: "https://old.example/stat", Events: []string{eventMarsDetected}, Legacy: true},
+	}
+	eventQueue = make(chan eventDelivery, 4)
+	t.Cleanup(func() { eventEndpoints, eventQueue = prevEndpoints, prevQueue })
+
+	emitEvent(eventMarsDetected, marsDetectedEvent{GroupID: -100, MessageID: 5, MarsCount: 3})
+	emitEvent(eventBotJoined, chatMemberEvent{GroupID: -100})
+	close(eventQueue)
+	bodies := map[string][]string{}
+	for d := range eventQueue {
+		bodies[d.endpoint.URL] = append(bodies[d.endpoint.URL], string(d.body))
+	}
+	if got := bodies["https://old.example/stat"]; len(got) != 1 || got[0] != `{"group_id":-100,"mars_count":3}` {
+		t.Fatalf("legacy endpoint got %q", got)
+	}
+	if got := bodies["https://new.example/hook"]; len(got) != 2 || !strings.Contains(got[0], `"data":{"group_id":-100`) {
+		t.Fatalf("endpoint got %q", got)
+	}
+}
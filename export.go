@@ -0,0 +1,392 @@
+package marsbot
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/csv"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/DataDog/zstd"
+	"github.com/PaulSonOfLars/gotgbot/v2"
+
+	"marsbot/minicv"
+	"marsbot/q"
+)
+
+type exportFormat string
+
+const (
+	exportCSV    exportFormat = "csv"
+	exportJSON   exportFormat = "json"
+	exportSQLite exportFormat = "sqlite"
+)
+
+func parseExportFormat(s string) (exportFormat, error) {
+	switch f := exportFormat(strings.ToLower(s)); f {
+	case exportCSV, exportJSON, exportSQLite:
+		return f, nil
+	}
+	return "", fmt.Errorf("unknown export format %q", s)
+}
+
+// parseExportArgs reads the arguments of /ensure_marsbot_export: an optional format, csv by default,
+// and an optional "dm" to deliver the file in private.
+func parseExportArgs(args []string) (exportFormat, bool, error) {
+	format, toDM := exportCSV, false
+	if len(args) > 0 {
+		args = args[1:] // the command itself
+	}
+	if len(args) > 2 {
+		return "", false, fmt.Errorf("too many arguments")
+	}
+	for i, arg := range args {
+		if strings.EqualFold(arg, "dm") && i == len(args)-1 {
+			toDM = true
+			continue
+		}
+		f, err := parseExportFormat(arg)
+		if err != nil || i != 0 {
+			return "", false, fmt.Errorf("unexpected argument %q", arg)
+		}
+		format = f
+	}
+	return format, toDM, nil
+}
+
+// The names of the files inside a csv export archive.
+const (
+	exportManifestFile  = "manifest.json"
+	exportMarsInfoFile  = "mars_info.csv"
+	exportWhitelistFile = "group_user_in_whitelist.csv"
+	exportSettingsFile  = "group_settings.csv"
+	exportRegionsFile   = "mars_region_hash.csv"
+)
+
+// exportManifest describes an export. SchemaVersion is the migration the exporting database was at.
+type exportManifest struct {
+	Format        exportFormat   `json:"format"`
+	SchemaVersion int64          `json:"schema_version"`
+	ExportedAt    time.Time      `json:"exported_at"`
+	GroupID       int64          `json:"group_id"`
+	Tables        map[string]int `json:"tables"`
+}
+
+// groupSnapshot is every row that belongs to one group, read in a single transaction.
+type groupSnapshot struct {
+	Manifest exportManifest
+	MarsInfo []q.MarsInfo
+	Users    []int64
+	Settings []q.ListGroupSettingsRow
+	Regions  []q.ListRegionHashesByGroupRow
+}
+
+func loadGroupSnapshot(ctx context.Context, groupID int64, format exportFormat) (groupSnapshot, error) {
+	tx, err := db.BeginTx(ctx, &sql.TxOptions{ReadOnly: true})
+	if err != nil {
+		return groupSnapshot{}, err
+	}
+	defer func() {
+		_ = tx.Rollback()
+	}()
+	qtx := queries.WithTx(tx)
+	snap := groupSnapshot{Manifest: exportManifest{Format: format, ExportedAt: time.Now().UTC(), GroupID: groupID}}
+	if snap.Manifest.SchemaVersion, err = schemaVersion(ctx, tx); err != nil {
+		return groupSnapshot{}, err
+	}
+	if snap.MarsInfo, err = qtx.ListMarsInfoByGroup(ctx, groupID); err != nil {
+		return groupSnapshot{}, err
+	}
+	if snap.Users, err = qtx.ListWhitelistUsersByGroup(ctx, groupID); err != nil {
+		return groupSnapshot{}, err
+	}
+	if snap.Settings, err = qtx.ListGroupSettings(ctx, groupID); err != nil {
+		return groupSnapshot{}, err
+	}
+	if snap.Regions, err = qtx.ListRegionHashesByGroup(ctx, groupID); err != nil {
+		return groupSnapshot{}, err
+	}
+	snap.Manifest.Tables = map[string]int{
+		"mars_info":               len(snap.MarsInfo),
+		"group_user_in_whitelist": len(snap.Users),
+		"group_settings":          len(snap.Settings),
+		"mars_region_hash":        len(snap.Regions),
+	}
+	return snap, nil
+}
+
+// exportChatData writes the group's data in the given format to a zstd compressed temporary file and returns its path.
+// chat is only used to build message links.
+func exportChatData(ctx context.Context, chat *gotgbot.Chat, format exportFormat) (string, error) {
+	snap, err := loadGroupSnapshot(ctx, chat.Id, format)
+	if err != nil {
+		return "", err
+	}
+	base := filepath.Join(os.TempDir(), fmt.Sprintf("mars-export_%d", chat.Id))
+	if format == exportSQLite {
+		return writeExportSQLite(ctx, base+".db", snap)
+	}
+	ext := ".json.zst"
+	if format == exportCSV {
+		ext = ".tar.zst"
+	}
+	filename := base + ext
+	file, err := os.Create(filename)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+	encoder := zstd.NewWriterLevel(file, 15)
+	if format == exportCSV {
+		err = writeExportCSV(encoder, chat, snap)
+	} else {
+		err = writeExportJSON(encoder, chat, snap)
+	}
+	if err != nil {
+		_ = encoder.Close()
+		_ = os.Remove(filename)
+		return "", err
+	}
+	if err := encoder.Close(); err != nil {
+		_ = os.Remove(filename)
+		return "", err
+	}
+	return filename, nil
+}
+
+var marsInfoHeader = []string{"group_id", "pic_dhash", "count", "last_msg_id", "in_whitelist", "hash_algo", "hash_size", "media_type", "msg_link"}
+
+func marsInfoRecord(chat *gotgbot.Chat, row q.MarsInfo) []string {
+	return []string{
+		fmt.Sprint(row.GroupID),
+		hex.EncodeToString(row.PicDhash),
+		fmt.Sprint(row.Count),
+		fmt.Sprint(row.LastMsgID),
+		fmt.Sprint(row.InWhitelist),
+		minicv.Algo(row.HashAlgo).String(),
+		fmt.Sprint(row.HashSize),
+		mediaType(row.MediaType).noun(),
+		messageLink(chat, row.LastMsgID),
+	}
+}
+
+// writeExportCSV writes a tar archive of the manifest and one csv file per table.
+// mars_info.csv alone is the same file older versions exported, so it can still be imported on its own.
+func writeExportCSV(w io.Writer, chat *gotgbot.Chat, snap groupSnapshot) error {
+	manifest, err := json.MarshalIndent(snap.Manifest, "", "  ")
+	if err != nil {
+		return err
+	}
+	tables := []struct {
+		name    string
+		header  []string
+		records [][]string
+	}{
+		{name: exportMarsInfoFile, header: marsInfoHeader},
+		{name: exportWhitelistFile, header: []string{"group_id", "user_id"}},
+		{name: exportSettingsFile, header: []string{"group_id", "key", "value"}},
+		{name: exportRegionsFile, header: []string{"group_id", "media_type", "hash_algo", "pic_dhash", "region", "region_hash"}},
+	}
+	for _, row := range snap.MarsInfo {
+		tables[0].records = append(tables[0].records, marsInfoRecord(chat, row))
+	}
+	for _, user := range snap.Users {
+		tables[1].records = append(tables[1].records, []string{fmt.Sprint(chat.Id), fmt.Sprint(user)})
+	}
+	for _, s := range snap.Settings {
+		tables[2].records = append(tables[2].records, []string{fmt.Sprint(chat.Id), s.Key, fmt.Sprint(s.Value)})
+	}
+	for _, r := range snap.Regions {
+		tables[3].records = append(tables[3].records, []string{
+			fmt.Sprint(chat.Id),
+			mediaType(r.MediaType).noun(),
+			minicv.Algo(r.HashAlgo).String(),
+			hex.EncodeToString(r.PicDhash),
+			fmt.Sprint(r.Region),
+			hex.EncodeToString(r.RegionHash),
+		})
+	}
+
+	tw := tar.NewWriter(w)
+	modTime := snap.Manifest.ExportedAt
+	writeFile := func(name string, body []byte) error {
+		if err := tw.WriteHeader(&tar.Header{Name: name, Mode: 0o644, Size: int64(len(body)), ModTime: modTime}); err != nil {
+			return err
+		}
+		_, err := tw.Write(body)
+		return err
+	}
+	if err := writeFile(exportManifestFile, manifest); err != nil {
+		return err
+	}
+	for _, table := range tables {
+		var buf bytes.Buffer
+		writer := csv.NewWriter(&buf)
+		if err := writer.Write(table.header); err != nil {
+			return err
+		}
+		if err := writer.WriteAll(table.records); err != nil {
+			return err
+		}
+		if err := writeFile(table.name, buf.Bytes()); err != nil {
+			return err
+		}
+	}
+	return tw.Close()
+}
+
+type exportMarsInfo struct {
+	PicDhash    string `json:"pic_dhash"`
+	Count       int64  `json:"count"`
+	LastMsgID   int64  `json:"last_msg_id"`
+	InWhitelist int64  `json:"in_whitelist"`
+	HashAlgo    string `json:"hash_algo"`
+	HashSize    int64  `json:"hash_size"`
+	MediaType   string `json:"media_type"`
+	MsgLink     string `json:"msg_link,omitempty"`
+}
+
+type exportRegionHash struct {
+	MediaType  string `json:"media_type"`
+	HashAlgo   string `json:"hash_algo"`
+	PicDhash   string `json:"pic_dhash"`
+	Region     int64  `json:"region"`
+	RegionHash string `json:"region_hash"`
+}
+
+// jsonExport is the document written by the json format. Hashes are hex encoded as in the csv export.
+type jsonExport struct {
+	Manifest       exportManifest           `json:"manifest"`
+	MarsInfo       []exportMarsInfo         `json:"mars_info"`
+	WhitelistUsers []int64                  `json:"group_user_in_whitelist"`
+	Settings       []q.ListGroupSettingsRow `json:"group_settings"`
+	RegionHashes   []exportRegionHash       `json:"mars_region_hash"`
+}
+
+func writeExportJSON(w io.Writer, chat *gotgbot.Chat, snap groupSnapshot) error {
+	doc := jsonExport{
+		Manifest:       snap.Manifest,
+		MarsInfo:       make([]exportMarsInfo, 0, len(snap.MarsInfo)),
+		WhitelistUsers: append([]int64{}, snap.Users...),
+		Settings:       append([]q.ListGroupSettingsRow{}, snap.Settings...),
+		RegionHashes:   make([]exportRegionHash, 0, len(snap.Regions)),
+	}
+	for _, row := range snap.MarsInfo {
+		doc.MarsInfo = append(doc.MarsInfo, exportMarsInfo{
+			PicDhash:    hex.EncodeToString(row.PicDhash),
+			Count:       row.Count,
+			LastMsgID:   row.LastMsgID,
+			InWhitelist: row.InWhitelist,
+			HashAlgo:    minicv.Algo(row.HashAlgo).String(),
+			HashSize:    row.HashSize,
+			MediaType:   mediaType(row.MediaType).noun(),
+			MsgLink:     messageLink(chat, row.LastMsgID),
+		})
+	}
+	for _, r := range snap.Regions {
+		doc.RegionHashes = append(doc.RegionHashes, exportRegionHash{
+			MediaType:  mediaType(r.MediaType).noun(),
+			HashAlgo:   minicv.Algo(r.HashAlgo).String(),
+			PicDhash:   hex.EncodeToString(r.PicDhash),
+			Region:     r.Region,
+			RegionHash: hex.EncodeToString(r.RegionHash),
+		})
+	}
+	return json.NewEncoder(w).Encode(doc)
+}
+
+// writeExportSQLite builds a database with the bot's own schema that holds only this group, so it can be used
+// directly as MARS_DB_PATH of a new deployment. The manifest goes to an extra export_manifest table.
+func writeExportSQLite(ctx context.Context, path string, snap groupSnapshot) (string, error) {
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return "", err
+	}
+	defer os.Remove(path)
+	if err := fillExportSQLite(ctx, path, snap); err != nil {
+		return "", err
+	}
+	return zstdFile(path)
+}
+
+func fillExportSQLite(ctx context.Context, path string, snap groupSnapshot) error {
+	out, err := sql.Open(sqliteDriverName, path)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+	out.SetMaxOpenConns(1)
+	if err := migrateDB(ctx, out); err != nil {
+		return err
+	}
+	tx, err := out.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = tx.Rollback()
+	}()
+	qtx := q.New(tx)
+	groupID := snap.Manifest.GroupID
+	for _, row := range snap.MarsInfo {
+		if err := qtx.UpsertMarsInfo(ctx, q.UpsertMarsInfoParams{
+			GroupID:     groupID,
+			MediaType:   row.MediaType,
+			HashAlgo:    row.HashAlgo,
+			HashSize:    row.HashSize,
+			PicDhash:    row.PicDhash,
+			Count:       row.Count,
+			LastMsgID:   row.LastMsgID,
+			InWhitelist: row.InWhitelist,
+		}); err != nil {
+			return err
+		}
+	}
+	for _, user := range snap.Users {
+		if err := qtx.AddUserToWhitelist(ctx, groupID, user); err != nil {
+			return err
+		}
+	}
+	for _, s := range snap.Settings {
+		if err := qtx.UpsertGroupSetting(ctx, groupID, s.Key, s.Value); err != nil {
+			return err
+		}
+	}
+	for _, r := range snap.Regions {
+		if err := qtx.UpsertRegionHash(ctx, q.UpsertRegionHashParams{
+			GroupID:    groupID,
+			MediaType:  r.MediaType,
+			HashAlgo:   r.HashAlgo,
+			PicDhash:   r.PicDhash,
+			Region:     r.Region,
+			RegionHash: r.RegionHash,
+		}); err != nil {
+			return err
+		}
+	}
+	if err := qtx.RefreshGroupStat(ctx, groupID); err != nil {
+		return err
+	}
+	manifest, err := json.Marshal(snap.Manifest)
+	if err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, `CREATE TABLE export_manifest
+(
+    id       INTEGER PRIMARY KEY CHECK (id = 1),
+    manifest TEXT NOT NULL
+)`); err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, "INSERT INTO export_manifest (id, manifest) VALUES (1, ?)", string(manifest)); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
@@ -0,0 +1,143 @@
+package marsbot
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/DataDog/zstd"
+	"github.com/PaulSonOfLars/gotgbot/v2"
+
+	"marsbot/minicv"
+	"marsbot/q"
+)
+
+func TestParseExportArgs(t *testing.T) {
+	cases := []struct {
+		text   string
+		format exportFormat
+		dm     bool
+		ok     bool
+	}{
+		{"/ensure_marsbot_export", exportCSV, false, true},
+		{"/ensure_marsbot_export json", exportJSON, false, true},
+		{"/ensure_marsbot_export SQLite dm", exportSQLite, true, true},
+		{"/ensure_marsbot_export dm", exportCSV, true, true},
+		{"/ensure_marsbot_export xml", "", false, false},
+		{"/ensure_marsbot_export dm json", "", false, false},
+		{"/ensure_marsbot_export json dm extra", "", false, false},
+	}
+	for _, c := range cases {
+		format, dm, err := parseExportArgs(strings.Fields(c.text))
+		if (err == nil) != c.ok || format != c.format || dm != c.dm {
+			t.Errorf("%q = %q, %v, %v", c.text, format, dm, err)
+		}
+	}
+}
+
+func seedExportGroup(t *testing.T, groupID int64) {
+	t.Helper()
+	ctx := context.Background()
+	hash := picHash{Algo: minicv.AlgoDHash, Size: 8, Hash: []byte{1, 2, 3, 4, 5, 6, 7, 8},
+		Regions: [][]byte{{9, 9, 9, 9, 9, 9, 9, 9}}}
+	for msgID := int64(1); msgID <= 2; msgID++ {
+		if _, err := recordMars(ctx, groupID, msgID, hash); err != nil {
+			t.Fatalf("record: %v", err)
+		}
+	}
+	if err := queries.AddUserToWhitelist(ctx, groupID, 42); err != nil {
+		t.Fatalf("whitelist user: %v", err)
+	}
+	if err := queries.UpsertGroupSetting(ctx, groupID, "style", 1); err != nil {
+		t.Fatalf("setting: %v", err)
+	}
+}
+
+func TestExportFormats(t *testing.T) {
+	useTestDB(t)
+	ctx := context.Background()
+	const groupID = -1001234567890
+	seedExportGroup(t, groupID)
+	chat := &gotgbot.Chat{Id: groupID}
+
+	for _, format := range []exportFormat{exportCSV, exportJSON} {
+		path, err := exportChatData(ctx, chat, format)
+		if err != nil {
+			t.Fatalf("%s export: %v", format, err)
+		}
+		data, err := os.ReadFile(path)
+		_ = os.Remove(path)
+		if err != nil {
+			t.Fatalf("%s read: %v", format, err)
+		}
+		plan, err := parseImportFile(data, groupID)
+		if err != nil {
+			t.Fatalf("%s parse: %v", format, err)
+		}
+		if len(plan.Rows) != 1 || plan.Rows[0].Count != 2 || plan.Rows[0].LastMsgID != 2 {
+			t.Fatalf("%s rows = %+v", format, plan.Rows)
+		}
+		if len(plan.Users) != 1 || plan.Users[0] != 42 {
+			t.Fatalf("%s users = %v", format, plan.Users)
+		}
+		if format == exportJSON {
+			unpacked, err := zstd.Decompress(nil, data)
+			if err != nil {
+				t.Fatalf("decompress json: %v", err)
+			}
+			var doc jsonExport
+			if err := json.Unmarshal(unpacked, &doc); err != nil {
+				t.Fatalf("decode json: %v", err)
+			}
+			if doc.Manifest.SchemaVersion == 0 || doc.Manifest.ExportedAt.IsZero() || len(doc.Settings) != 1 ||
+				len(doc.RegionHashes) != 1 || doc.MarsInfo[0].MsgLink != "https://t.me/c/1234567890/2" {
+				t.Fatalf("json export = %+v", doc)
+			}
+		}
+	}
+
+	path, err := exportChatData(ctx, chat, exportSQLite)
+	if err != nil {
+		t.Fatalf("sqlite export: %v", err)
+	}
+	defer os.Remove(path)
+	packed, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("read sqlite export: %v", err)
+	}
+	if _, err := parseImportFile(packed, groupID); err == nil {
+		t.Fatalf("sqlite export should not be importable")
+	}
+	unpacked, err := zstd.Decompress(nil, packed)
+	if err != nil {
+		t.Fatalf("decompress sqlite: %v", err)
+	}
+	dbPath := t.TempDir() + "/export.db"
+	if err := os.WriteFile(dbPath, unpacked, 0o644); err != nil {
+		t.Fatalf("write sqlite: %v", err)
+	}
+	exported, err := sql.Open(sqliteDriverName, dbPath)
+	if err != nil {
+		t.Fatalf("open sqlite: %v", err)
+	}
+	defer exported.Close()
+	eq := q.New(exported)
+	rows, err := eq.ListMarsInfoByGroup(ctx, groupID)
+	if err != nil || len(rows) != 1 || rows[0].Count != 2 {
+		t.Fatalf("sqlite mars_info = %+v, %v", rows, err)
+	}
+	if in, err := eq.IsUserInWhitelist(ctx, groupID, 42); err != nil || in != 1 {
+		t.Fatalf("sqlite whitelist = %d, %v", in, err)
+	}
+	if count, err := eq.GetGroupMarsCount(ctx, groupID); err != nil || count != 1 {
+		t.Fatalf("sqlite group stat = %d, %v", count, err)
+	}
+	var manifest string
+	if err := exported.QueryRowContext(ctx, "SELECT manifest FROM export_manifest").Scan(&manifest); err != nil ||
+		!strings.Contains(manifest, `"format":"sqlite"`) {
+		t.Fatalf("sqlite manifest = %q, %v", manifest, err)
+	}
+}
@@ -9,6 +9,7 @@ require (
 	github.com/mattn/go-sqlite3 v1.14.33
 	github.com/minio/minio-go/v7 v7.0.98
 	go.uber.org/zap v1.27.1
+	golang.org/x/image v0.25.0
 )
 
 require (
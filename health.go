@@ -0,0 +1,164 @@
+package marsbot
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/PaulSonOfLars/gotgbot/v2"
+	"go.uber.org/zap"
+)
+
+const dbPingTimeout = 2 * time.Second
+
+var (
+	processStart = time.Now()
+	// lastGetUpdates and lastBackup hold the unix nanoseconds of the last successful getUpdates call and full backup.
+	lastGetUpdates atomic.Int64
+	lastBackup     atomic.Int64
+)
+
+// trackingBotClient notes every successful getUpdates, so /readyz can tell a stuck poller from a quiet chat.
+type trackingBotClient struct {
+	gotgbot.BotClient
+}
+
+func (c trackingBotClient) RequestWithContext(ctx context.Context, token string, method string, params map[string]string,
+	data map[string]gotgbot.FileReader, opts *gotgbot.RequestOpts) (json.RawMessage, error) {
+	res, err := c.BotClient.RequestWithContext(ctx, token, method, params, data, opts)
+	if err == nil && method == "getUpdates" {
+		lastGetUpdates.Store(time.Now().UnixNano())
+	}
+	return res, err
+}
+
+type checkResult struct {
+	Status string `json:"status"`
+	Detail string `json:"detail,omitempty"`
+	// Age is how long ago the watched event last happened, for the checks that watch one.
+	Age string `json:"age,omitempty"`
+}
+
+type healthReport struct {
+	Status string                 `json:"status"`
+	Uptime string                 `json:"uptime"`
+	Checks map[string]checkResult `json:"checks,omitempty"`
+}
+
+const (
+	checkOK      = "ok"
+	checkFail    = "fail"
+	checkSkipped = "skipped"
+)
+
+// sinceEvent is the age of the event stored in last, counted from process start while it has not happened yet.
+func sinceEvent(last *atomic.Int64, now time.Time) time.Duration {
+	at := processStart
+	if ns := last.Load(); ns != 0 {
+		at = time.Unix(0, ns)
+	}
+	return now.Sub(at).Round(time.Second)
+}
+
+func checkAge(age, maxAge time.Duration, what string) checkResult {
+	if age > maxAge {
+		return checkResult{Status: checkFail, Age: age.String(), Detail: fmt.Sprintf("no %s for more than %s", what, maxAge)}
+	}
+	return checkResult{Status: checkOK, Age: age.String()}
+}
+
+func checkDB(ctx context.Context) checkResult {
+	if db == nil {
+		return checkResult{Status: checkFail, Detail: "database not opened"}
+	}
+	ctx, cancel := context.WithTimeout(ctx, dbPingTimeout)
+	defer cancel()
+	if err := db.PingContext(ctx); err != nil {
+		return checkResult{Status: checkFail, Detail: err.Error()}
+	}
+	return checkResult{Status: checkOK}
+}
+
+func checkUpdates(now time.Time) checkResult {
+	if config.UpdateMode != updateModePolling {
+		return checkResult{Status: checkSkipped, Detail: "updates arrive by webhook"}
+	}
+	return checkAge(sinceEvent(&lastGetUpdates, now), config.ReadyUpdatesMaxAge, "successful getUpdates")
+}
+
+func checkBackup(now time.Time) checkResult {
+	if config.NoBackup {
+		return checkResult{Status: checkSkipped, Detail: "NO_BACKUP is set"}
+	}
+	maxAge := config.ReadyBackupMaxAge
+	if maxAge <= 0 {
+		maxAge = 2 * time.Duration(config.S3BackupMinutes) * time.Minute
+	}
+	return checkAge(sinceEvent(&lastBackup, now), maxAge, "backup")
+}
+
+// readiness runs every check, the report fails if any of them does.
+func readiness(ctx context.Context, now time.Time) healthReport {
+	report := healthReport{
+		Status: checkOK,
+		Uptime: now.Sub(processStart).Round(time.Second).String(),
+		Checks: map[string]checkResult{
+			"db":      checkDB(ctx),
+			"updates": checkUpdates(now),
+			"backup":  checkBackup(now),
+		},
+	}
+	for _, c := range report.Checks {
+		if c.Status == checkFail {
+			report.Status = checkFail
+		}
+	}
+	return report
+}
+
+func writeHealth(w http.ResponseWriter, report healthReport) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	if report.Status != checkOK {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	_ = json.NewEncoder(w).Encode(report)
+}
+
+// handleHealthz only reports that the process serves requests.
+func handleHealthz(w http.ResponseWriter, _ *http.Request) {
+	writeHealth(w, healthReport{Status: checkOK, Uptime: time.Since(processStart).Round(time.Second).String()})
+}
+
+func handleReadyz(w http.ResponseWriter, r *http.Request) {
+	writeHealth(w, readiness(r.Context(), time.Now()))
+}
+
+func registerProbeHandlers(mux *http.ServeMux) {
+	mux.HandleFunc("/healthz", handleHealthz)
+	mux.HandleFunc("/readyz", handleReadyz)
+	mux.HandleFunc("/metrics", handleMetrics)
+}
+
+// startHealthServer serves the probes and metrics on their own address, so pprof can stay on localhost.
+func startHealthServer(addr string) {
+	if addr == "" {
+		return
+	}
+	mux := http.NewServeMux()
+	registerProbeHandlers(mux)
+	srv := &http.Server{
+		Addr:              addr,
+		Handler:           mux,
+		ReadHeaderTimeout: 5 * time.Second,
+	}
+	go func() {
+		if err := srv.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			logger.Warn("health server stopped", zap.Error(err))
+		}
+	}()
+}
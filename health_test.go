@@ -0,0 +1,87 @@
+package marsbot
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/PaulSonOfLars/gotgbot/v2"
+)
+
+type okBotClient struct{ gotgbot.BotClient }
+
+func (okBotClient) RequestWithContext(context.Context, string, string, map[string]string,
+	map[string]gotgbot.FileReader, *gotgbot.RequestOpts) (json.RawMessage, error) {
+	return json.RawMessage("[]"), nil
+}
+
+func TestReadiness(t *testing.T) {
+	useTestDB(t)
+	prevUpdates, prevBackup := lastGetUpdates.Load(), lastBackup.Load()
+	t.Cleanup(func() {
+		lastGetUpdates.Store(prevUpdates)
+		lastBackup.Store(prevBackup)
+	})
+	config.UpdateMode = updateModePolling
+	config.ReadyUpdatesMaxAge = time.Minute
+	config.NoBackup = false
+	config.S3BackupMinutes = 60
+	config.ReadyBackupMaxAge = 0
+
+	client := trackingBotClient{okBotClient{}}
+	if _, err := client.RequestWithContext(context.Background(), "", "getUpdates", nil, nil, nil); err != nil {
+		t.Fatalf("request: %v", err)
+	}
+	now := time.Now()
+	lastBackup.Store(now.Add(-90 * time.Minute).UnixNano())
+	report := readiness(context.Background(), now)
+	if report.Status != checkOK {
+		t.Fatalf("ready = %+v", report)
+	}
+	for _, name := range []string{"db", "updates", "backup"} {
+		if report.Checks[name].Status != checkOK {
+			t.Errorf("%s = %+v", name, report.Checks[name])
+		}
+	}
+
+	report = readiness(context.Background(), now.Add(2*time.Minute))
+	if report.Status != checkFail || report.Checks["updates"].Status != checkFail {
+		t.Fatalf("stale getUpdates = %+v", report)
+	}
+	lastGetUpdates.Store(now.Add(time.Hour).UnixNano())
+	if report = readiness(context.Background(), now.Add(time.Hour)); report.Checks["backup"].Status != checkFail {
+		t.Fatalf("backup older than twice the interval = %+v", report.Checks["backup"])
+	}
+	config.NoBackup = true
+	config.UpdateMode = updateModeWebhook
+	report = readiness(context.Background(), now.Add(time.Hour))
+	if report.Status != checkOK || report.Checks["backup"].Status != checkSkipped || report.Checks["updates"].Status != checkSkipped {
+		t.Fatalf("skipped checks = %+v", report)
+	}
+
+	_ = db.Close()
+	rec := httptest.NewRecorder()
+	handleReadyz(rec, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+	var body healthReport
+	if err := json.NewDecoder(rec.Body).Decode(&body); err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	if rec.Code != http.StatusServiceUnavailable || body.Checks["db"].Status != checkFail {
+		t.Fatalf("closed db = %d %+v", rec.Code, body)
+	}
+}
+
+func TestHealthz(t *testing.T) {
+	rec := httptest.NewRecorder()
+	handleHealthz(rec, httptest.NewRequest(http.MethodGet, "/healthz", nil))
+	var body healthReport
+	if err := json.NewDecoder(rec.Body).Decode(&body); err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	if rec.Code != http.StatusOK || body.Status != checkOK {
+		t.Fatalf("healthz = %d %+v", rec.Code, body)
+	}
+}
@@ -1,44 +1,61 @@
 package marsbot
 
 import (
+	"encoding/base64"
+	"errors"
 	"fmt"
 	"math/bits"
+	"strconv"
+	"strings"
 
 	"github.com/PaulSonOfLars/gotgbot/v2"
+
+	"marsbot/minicv"
 )
 
-func buildLabel(chat *gotgbot.Chat, msgID int64) (string, string) {
+// messageLink returns the t.me link of a message, or "" if the chat has no linkable messages.
+func messageLink(chat *gotgbot.Chat, msgID int64) string {
 	if chat == nil || msgID == 0 {
-		return "", ""
+		return ""
 	}
-	var link string
 	switch {
 	case chat.Username != "":
-		link = fmt.Sprintf("https://t.me/%s/%d", chat.Username, msgID)
+		return fmt.Sprintf("https://t.me/%s/%d", chat.Username, msgID)
 	case chat.Id < 0:
 		cid := -chat.Id - 1000000000000
-		link = fmt.Sprintf("https://t.me/c/%d/%d", cid, msgID)
+		return fmt.Sprintf("https://t.me/c/%d/%d", cid, msgID)
 	}
+	return ""
+}
+
+func buildLabel(chat *gotgbot.Chat, msgID int64) (string, string) {
+	link := messageLink(chat, msgID)
 	if link == "" {
 		return "", ""
 	}
 	return fmt.Sprintf(`<a href="%s">`, link), "</a>"
 }
 
-func buildMarsReply(chat *gotgbot.Chat, count int64, lastMsgID int64) string {
+func buildMarsReply(chat *gotgbot.Chat, style int64, media mediaType, count int64, lastMsgID int64) string {
 	labelStart, labelEnd := buildLabel(chat, lastMsgID)
+	if style == replyStyleTerse {
+		return fmt.Sprintf("%s此前已%s出现%d次%s。", media.this(), labelStart, count, labelEnd)
+	}
 	switch {
 	case count < 3:
-		return fmt.Sprintf("这张图片已经%s火星%d次%s了！", labelStart, count, labelEnd)
+		return fmt.Sprintf("%s已经%s火星%d次%s了！", media.this(), labelStart, count, labelEnd)
 	case count == 3:
-		return fmt.Sprintf("这张图已经%s火星了%d次%s了，现在本车送你 ”火星之王“ 称号！", labelStart, count, labelEnd)
+		return fmt.Sprintf("%s已经%s火星了%d次%s了，现在本车送你 ”火星之王“ 称号！", media.short(), labelStart, count, labelEnd)
 	default:
-		return fmt.Sprintf("火星之王，收了你的神通吧，这张图都让您%s火星%d次%s了！", labelStart, count, labelEnd)
+		return fmt.Sprintf("火星之王，收了你的神通吧，%s都让您%s火星%d次%s了！", media.short(), labelStart, count, labelEnd)
 	}
 }
 
-func buildGroupedReply(chat *gotgbot.Chat, count int64, lastMsgID int64) string {
+func buildGroupedReply(chat *gotgbot.Chat, style int64, count int64, lastMsgID int64) string {
 	labelStart, labelEnd := buildLabel(chat, lastMsgID)
+	if style == replyStyleTerse {
+		return fmt.Sprintf("这组图片此前已%s出现%d次%s。", labelStart, count, labelEnd)
+	}
 	switch {
 	case count < 3:
 		return fmt.Sprintf("这一组图片火星了%s火星%d次%s了！", labelStart, count, labelEnd)
@@ -49,17 +66,40 @@ func buildGroupedReply(chat *gotgbot.Chat, count int64, lastMsgID int64) string
 	}
 }
 
-func getReferPhoto(msg *gotgbot.Message) *gotgbot.PhotoSize {
+func buildSimilarReply(chat *gotgbot.Chat, media mediaType, lastMsgID int64) string {
+	labelStart, labelEnd := buildLabel(chat, lastMsgID)
+	return fmt.Sprintf("%s和%s之前的一%s%s%s很像，不过火星车不太确定是不是同一%s。",
+		media.this(), labelStart, media.measure(), media.noun(), labelEnd, media.measure())
+}
+
+// matchNote is appended to a reply whose match was only found in a rotated, mirrored or cropped copy of the image.
+func matchNote(res marsResult) string {
+	switch o := res.Orientation; {
+	case res.Regions > 0:
+		return "\n虽然被裁剪过，但火星车还是认出来了。"
+	case o == minicv.OrientIdentity:
+		return ""
+	case o.Mirrored():
+		return "\n虽然被翻转过，但火星车还是认出来了。"
+	default:
+		return "\n虽然被旋转过，但火星车还是认出来了。"
+	}
+}
+
+// getReferMedia returns the hashable picture of msg, or of the message it replies to.
+func getReferMedia(msg *gotgbot.Message) *mediaFile {
 	if msg == nil {
 		return nil
 	}
-	if len(msg.Photo) > 0 {
-		return &msg.Photo[len(msg.Photo)-1]
-	}
-	if msg.ReplyToMessage != nil && len(msg.ReplyToMessage.Photo) > 0 {
-		return &msg.ReplyToMessage.Photo[len(msg.ReplyToMessage.Photo)-1]
+	if file := messageMedia(msg); file != nil {
+		return file
 	}
-	return nil
+	return messageMedia(msg.ReplyToMessage)
+}
+
+func hashCallbackData(prefix string, hash picHash) string {
+	// Telegram caps callback data at 64 bytes, which a 256-bit hash in hex would not fit.
+	return fmt.Sprintf("%s:%d:%d:%s", prefix, hash.Algo, hash.Media, base64.RawURLEncoding.EncodeToString(hash.Hash))
 }
 
 func replyTo(messageID int64) *gotgbot.ReplyParameters {
@@ -69,6 +109,11 @@ func replyTo(messageID int64) *gotgbot.ReplyParameters {
 	return &gotgbot.ReplyParameters{MessageId: messageID}
 }
 
+// scaleDistance converts a distance given for 64-bit hashes to hashes with a size x size grid.
+func scaleDistance(dist int64, size int) int64 {
+	return dist * int64(size*size) / 64
+}
+
 func hammingDistance(a, b []byte) (int64, error) {
 	if len(a) != len(b) {
 		return 0, fmt.Errorf("%s: %d vs %d", hammingDistanceError, len(a), len(b))
@@ -79,3 +124,38 @@ func hammingDistance(a, b []byte) (int64, error) {
 	}
 	return dist, nil
 }
+
+var errUnresolvedUsername = errors.New("火星车无法通过 @用户名 查找用户，请回复该用户的消息，或使用数字ID。")
+
+// resolveWhitelistTarget picks the user a /whitelist_user style command refers to:
+// the author of the replied-to message, a text mention, or a numeric ID argument.
+// Bots only see plain @username mentions as text, so those are rejected with errUnresolvedUsername.
+func resolveWhitelistTarget(msg *gotgbot.Message) (int64, string, error) {
+	// Inside a forum topic every message without an explicit reply answers the topic's first message.
+	topicRoot := msg.IsTopicMessage && msg.ReplyToMessage != nil && msg.ReplyToMessage.MessageId == msg.MessageThreadId
+	if msg.ReplyToMessage != nil && !topicRoot {
+		sender := msg.ReplyToMessage.GetSender()
+		if sender == nil || sender.User == nil {
+			return 0, "", errors.New("无法识别被回复消息的发送者。")
+		}
+		return sender.User.Id, sender.Name(), nil
+	}
+	for _, ent := range msg.GetEntities() {
+		if ent.Type == "text_mention" && ent.User != nil {
+			name := strings.TrimSpace(ent.User.FirstName + " " + ent.User.LastName)
+			return ent.User.Id, name, nil
+		}
+	}
+	args := strings.Fields(msg.GetText())
+	if len(args) < 2 {
+		return 0, "", errors.New("请回复目标用户的消息，或在命令后附上用户的数字ID。")
+	}
+	if strings.HasPrefix(args[1], "@") {
+		return 0, "", errUnresolvedUsername
+	}
+	id, err := strconv.ParseInt(args[1], 10, 64)
+	if err != nil || id <= 0 {
+		return 0, "", fmt.Errorf("%q 不是有效的用户ID。", args[1])
+	}
+	return id, args[1], nil
+}
@@ -0,0 +1,52 @@
+package marsbot
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/PaulSonOfLars/gotgbot/v2"
+)
+
+func TestResolveWhitelistTarget(t *testing.T) {
+	artist := &gotgbot.User{Id: 42, FirstName: "Artist"}
+	topicStarter := &gotgbot.User{Id: 7, FirstName: "Starter"}
+	cases := []struct {
+		name    string
+		msg     *gotgbot.Message
+		wantID  int64
+		wantErr bool
+	}{
+		{"reply", &gotgbot.Message{Text: "/whitelist_user", ReplyToMessage: &gotgbot.Message{From: artist}}, 42, false},
+		{"text mention", &gotgbot.Message{
+			Text:     "/whitelist_user Artist",
+			Entities: []gotgbot.MessageEntity{{Type: "bot_command", Length: 15}, {Type: "text_mention", Offset: 16, Length: 6, User: artist}},
+		}, 42, false},
+		{"numeric id", &gotgbot.Message{Text: "/whitelist_user 12345"}, 12345, false},
+		{"numeric id in topic", &gotgbot.Message{
+			Text: "/whitelist_user 12345", IsTopicMessage: true, MessageThreadId: 7,
+			ReplyToMessage: &gotgbot.Message{MessageId: 7, From: topicStarter},
+		}, 12345, false},
+		{"text mention in topic", &gotgbot.Message{
+			Text: "/whitelist_user Artist", IsTopicMessage: true, MessageThreadId: 7,
+			ReplyToMessage: &gotgbot.Message{MessageId: 7, From: topicStarter},
+			Entities:       []gotgbot.MessageEntity{{Type: "bot_command", Length: 15}, {Type: "text_mention", Offset: 16, Length: 6, User: artist}},
+		}, 42, false},
+		{"reply in topic", &gotgbot.Message{
+			Text: "/whitelist_user", IsTopicMessage: true, MessageThreadId: 7,
+			ReplyToMessage: &gotgbot.Message{MessageId: 9, From: artist},
+		}, 42, false},
+		{"no target", &gotgbot.Message{Text: "/whitelist_user"}, 0, true},
+		{"bad id", &gotgbot.Message{Text: "/whitelist_user abc"}, 0, true},
+	}
+	for _, c := range cases {
+		id, _, err := resolveWhitelistTarget(c.msg)
+		if (err != nil) != c.wantErr || id != c.wantID {
+			t.Errorf("%s: got %d, %v", c.name, id, err)
+		}
+	}
+
+	_, _, err := resolveWhitelistTarget(&gotgbot.Message{Text: "/whitelist_user @artist"})
+	if !errors.Is(err, errUnresolvedUsername) {
+		t.Errorf("username mention: got %v, want errUnresolvedUsername", err)
+	}
+}
@@ -0,0 +1,747 @@
+package marsbot
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/csv"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"path"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/DataDog/zstd"
+	"github.com/PaulSonOfLars/gotgbot/v2"
+	"github.com/PaulSonOfLars/gotgbot/v2/ext"
+	"go.uber.org/zap"
+
+	"marsbot/minicv"
+	"marsbot/q"
+)
+
+const (
+	importMaxSize = 20 << 20
+	// importMaxUnpacked bounds what a compressed export may expand to.
+	importMaxUnpacked  = 256 << 20
+	importTTL          = 10 * time.Minute
+	importErrorSamples = 5
+)
+
+// importRow is one validated line of an export, ready to be written to the importing group.
+type importRow struct {
+	Media       mediaType
+	Algo        minicv.Algo
+	Size        int
+	Hash        []byte
+	Count       int64
+	LastMsgID   int64
+	InWhitelist int64
+}
+
+func (r importRow) key() string {
+	return fmt.Sprintf("%d:%d:%x", r.Media, r.Algo, r.Hash)
+}
+
+// importRegion is a stored sub-region hash of an imported image, see minicv.Regions.
+type importRegion struct {
+	Media      mediaType
+	Algo       minicv.Algo
+	Hash       []byte
+	Region     int64
+	RegionHash []byte
+}
+
+func (r importRegion) key() string {
+	return fmt.Sprintf("%d:%d:%x", r.Media, r.Algo, r.Hash)
+}
+
+// importSetting is a group setting override, already clamped to the range /settings allows.
+type importSetting struct {
+	Key   string
+	Value int64
+}
+
+// importPlan is the parsed content of an export.
+type importPlan struct {
+	Rows    []importRow
+	Skipped int
+	// Duplicates counts rows folded into an earlier row of the same file with the same image.
+	Duplicates int
+	// Errors holds the reasons of the first skipped rows, for the preview message.
+	Errors []string
+	// Users are the whitelisted users of the exporting group, only archives and json exports carry them.
+	Users []int64
+	// Regions and Settings come from the same exports as Users. Regions of images that are not in Rows are dropped.
+	Regions  []importRegion
+	Settings []importSetting
+
+	index map[string]int
+}
+
+func (p *importPlan) skip(where string, reason string) {
+	p.Skipped++
+	if len(p.Errors) < importErrorSamples {
+		p.Errors = append(p.Errors, where+": "+reason)
+	}
+}
+
+// add appends row, or folds it into an earlier row of the same image.
+func (p *importPlan) add(row importRow) {
+	if p.index == nil {
+		p.index = make(map[string]int)
+	}
+	if i, ok := p.index[row.key()]; ok {
+		prev := &p.Rows[i]
+		prev.Count += row.Count
+		prev.LastMsgID = max(prev.LastMsgID, row.LastMsgID)
+		prev.InWhitelist = max(prev.InWhitelist, row.InWhitelist)
+		p.Duplicates++
+		return
+	}
+	p.index[row.key()] = len(p.Rows)
+	p.Rows = append(p.Rows, row)
+}
+
+var (
+	zstdMagic   = []byte{0x28, 0xb5, 0x2f, 0xfd}
+	sqliteMagic = []byte("SQLite format 3\x00")
+)
+
+// parseImportFile accepts every format of /ensure_marsbot_export except sqlite, compressed or not,
+// as well as the plain csv files of older versions.
+func parseImportFile(data []byte, groupID int64) (importPlan, error) {
+	if bytes.HasPrefix(data, zstdMagic) {
+		decoder := zstd.NewReader(bytes.NewReader(data))
+		unpacked, err := io.ReadAll(io.LimitReader(decoder, importMaxUnpacked+1))
+		if cerr := decoder.Close(); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			return importPlan{}, fmt.Errorf("解压失败: %w", err)
+		}
+		if len(unpacked) > importMaxUnpacked {
+			return importPlan{}, errors.New("解压后的文件过大")
+		}
+		data = unpacked
+	}
+	switch {
+	case bytes.HasPrefix(data, sqliteMagic):
+		return importPlan{}, errors.New("sqlite格式的导出文件用于部署新的火星车，请使用csv或json格式导入")
+	case len(data) > 262 && string(data[257:262]) == "ustar":
+		return parseImportArchive(bytes.NewReader(data), groupID)
+	case bytes.HasPrefix(bytes.TrimSpace(data), []byte("{")):
+		return parseImportJSON(data, groupID)
+	default:
+		return parseImportCSV(bytes.NewReader(data), groupID)
+	}
+}
+
+// parseImportArchive reads the tar archive of a csv export.
+func parseImportArchive(r io.Reader, groupID int64) (importPlan, error) {
+	tr := tar.NewReader(r)
+	var plan importPlan
+	var users []int64
+	var regions []importRegion
+	var settings []importSetting
+	found := false
+	for {
+		hdr, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return importPlan{}, fmt.Errorf("读取压缩包失败: %w", err)
+		}
+		switch path.Base(hdr.Name) {
+		case exportMarsInfoFile:
+			if plan, err = parseImportCSV(tr, groupID); err != nil {
+				return importPlan{}, fmt.Errorf("%s: %w", exportMarsInfoFile, err)
+			}
+			found = true
+		case exportWhitelistFile:
+			if users, err = parseImportUsers(tr); err != nil {
+				return importPlan{}, fmt.Errorf("%s: %w", exportWhitelistFile, err)
+			}
+		case exportRegionsFile:
+			if regions, err = parseImportRegions(tr); err != nil {
+				return importPlan{}, fmt.Errorf("%s: %w", exportRegionsFile, err)
+			}
+		case exportSettingsFile:
+			if settings, err = parseImportSettings(tr); err != nil {
+				return importPlan{}, fmt.Errorf("%s: %w", exportSettingsFile, err)
+			}
+		}
+	}
+	if !found {
+		return importPlan{}, fmt.Errorf("压缩包中没有 %s", exportMarsInfoFile)
+	}
+	plan.Users = users
+	plan.Settings = settings
+	plan.addRegions(regions)
+	return plan, nil
+}
+
+// addRegions keeps the regions whose image is part of the plan, a region without its image is never looked up.
+func (p *importPlan) addRegions(regions []importRegion) {
+	for _, r := range regions {
+		if _, ok := p.index[r.key()]; ok {
+			p.Regions = append(p.Regions, r)
+		}
+	}
+}
+
+// csvRecords reads a csv file and returns its records as maps from the header names.
+func csvRecords(r io.Reader, required ...string) ([]map[string]string, error) {
+	records, err := csv.NewReader(r).ReadAll()
+	if err != nil {
+		return nil, err
+	}
+	if len(records) == 0 {
+		return nil, nil
+	}
+	for _, name := range required {
+		if !slices.Contains(records[0], name) {
+			return nil, fmt.Errorf("缺少 %s 列", name)
+		}
+	}
+	rows := make([]map[string]string, 0, len(records)-1)
+	for _, record := range records[1:] {
+		row := make(map[string]string, len(record))
+		for i, value := range record {
+			if i < len(records[0]) {
+				row[records[0][i]] = strings.TrimSpace(value)
+			}
+		}
+		rows = append(rows, row)
+	}
+	return rows, nil
+}
+
+// parseImportRegions reads mars_region_hash.csv. Region hashes can be recomputed from the images,
+// so invalid rows are dropped without failing the import.
+func parseImportRegions(r io.Reader) ([]importRegion, error) {
+	rows, err := csvRecords(r, "media_type", "hash_algo", "pic_dhash", "region", "region_hash")
+	if err != nil {
+		return nil, err
+	}
+	var regions []importRegion
+	for _, row := range rows {
+		if region, err := parseImportRegion(row["media_type"], row["hash_algo"], row["pic_dhash"], row["region"], row["region_hash"]); err == nil {
+			regions = append(regions, region)
+		}
+	}
+	return regions, nil
+}
+
+func parseImportRegion(media, algo, hash, region, regionHash string) (importRegion, error) {
+	var r importRegion
+	var err error
+	if r.Media, err = parseMediaType(media); err != nil {
+		return r, err
+	}
+	if r.Algo, err = parseImportAlgo(algo); err != nil {
+		return r, err
+	}
+	if r.Hash, err = hex.DecodeString(hash); err != nil || minicv.HashSizeForLen(len(r.Hash)) == 0 {
+		return r, fmt.Errorf("pic_dhash %q 无效", hash)
+	}
+	if r.Region, err = strconv.ParseInt(region, 10, 64); err != nil || r.Region < 0 || r.Region >= int64(minicv.RegionCount) {
+		return r, fmt.Errorf("region %q 无效", region)
+	}
+	if r.RegionHash, err = hex.DecodeString(regionHash); err != nil || len(r.RegionHash) != len(r.Hash) {
+		return r, fmt.Errorf("region_hash %q 无效", regionHash)
+	}
+	return r, nil
+}
+
+// parseImportSettings reads group_settings.csv, unknown keys are ignored and values are clamped like /settings does.
+func parseImportSettings(r io.Reader) ([]importSetting, error) {
+	rows, err := csvRecords(r, "key", "value")
+	if err != nil {
+		return nil, err
+	}
+	var settings []importSetting
+	for _, row := range rows {
+		value, err := strconv.ParseInt(row["value"], 10, 64)
+		if err != nil {
+			continue
+		}
+		settings = appendImportSetting(settings, row["key"], value)
+	}
+	return settings, nil
+}
+
+func appendImportSetting(settings []importSetting, key string, value int64) []importSetting {
+	def, ok := findSettingDef(key)
+	if !ok {
+		return settings
+	}
+	return append(settings, importSetting{Key: key, Value: clampSetting(def, value)})
+}
+
+func parseImportUsers(r io.Reader) ([]int64, error) {
+	records, err := csv.NewReader(r).ReadAll()
+	if err != nil {
+		return nil, err
+	}
+	if len(records) == 0 {
+		return nil, nil
+	}
+	col := slices.Index(records[0], "user_id")
+	if col < 0 {
+		return nil, errors.New("缺少 user_id 列")
+	}
+	var users []int64
+	for _, record := range records[1:] {
+		if col >= len(record) {
+			continue
+		}
+		if user, err := strconv.ParseInt(strings.TrimSpace(record[col]), 10, 64); err == nil && user != 0 {
+			users = append(users, user)
+		}
+	}
+	return users, nil
+}
+
+// parseImportJSON reads a json export. Its rows go through the same checks as csv rows.
+func parseImportJSON(data []byte, groupID int64) (importPlan, error) {
+	var doc jsonExport
+	if err := json.Unmarshal(data, &doc); err != nil {
+		return importPlan{}, fmt.Errorf("json格式错误: %w", err)
+	}
+	var plan importPlan
+	source := strconv.FormatInt(doc.Manifest.GroupID, 10)
+	for i, m := range doc.MarsInfo {
+		fields := map[string]string{
+			"group_id":     source,
+			"pic_dhash":    m.PicDhash,
+			"count":        strconv.FormatInt(m.Count, 10),
+			"last_msg_id":  strconv.FormatInt(m.LastMsgID, 10),
+			"in_whitelist": strconv.FormatInt(m.InWhitelist, 10),
+			"hash_algo":    m.HashAlgo,
+			"hash_size":    strconv.FormatInt(m.HashSize, 10),
+			"media_type":   m.MediaType,
+		}
+		row, err := parseImportRow(func(name string) (string, bool) {
+			v, ok := fields[name]
+			return v, ok
+		}, groupID)
+		if err != nil {
+			plan.skip(fmt.Sprintf("第%d条", i+1), err.Error())
+			continue
+		}
+		plan.add(row)
+	}
+	for _, user := range doc.WhitelistUsers {
+		if user != 0 {
+			plan.Users = append(plan.Users, user)
+		}
+	}
+	var regions []importRegion
+	for _, r := range doc.RegionHashes {
+		region, err := parseImportRegion(r.MediaType, r.HashAlgo, r.PicDhash, strconv.FormatInt(r.Region, 10), r.RegionHash)
+		if err == nil {
+			regions = append(regions, region)
+		}
+	}
+	plan.addRegions(regions)
+	for _, setting := range doc.Settings {
+		plan.Settings = appendImportSetting(plan.Settings, setting.Key, setting.Value)
+	}
+	return plan, nil
+}
+
+// parseImportCSV reads the mars_info.csv of an export, including the plain csv files of older versions with fewer columns.
+// The header decides the column order and only pic_dhash and count are required. Invalid rows are skipped.
+// Rows exported from another group keep their counts, but their message IDs would link into the wrong chat
+// and are dropped.
+func parseImportCSV(r io.Reader, groupID int64) (importPlan, error) {
+	reader := csv.NewReader(r)
+	reader.FieldsPerRecord = -1
+	header, err := reader.Read()
+	if err != nil {
+		return importPlan{}, fmt.Errorf("读取表头失败: %w", err)
+	}
+	cols := make(map[string]int, len(header))
+	for i, name := range header {
+		cols[strings.TrimSpace(strings.TrimPrefix(name, "\ufeff"))] = i
+	}
+	for _, name := range []string{"pic_dhash", "count"} {
+		if _, ok := cols[name]; !ok {
+			return importPlan{}, fmt.Errorf("缺少 %s 列", name)
+		}
+	}
+
+	var plan importPlan
+	for line := 2; ; line++ {
+		record, err := reader.Read()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			var parseErr *csv.ParseError
+			if errors.As(err, &parseErr) {
+				plan.skip(fmt.Sprintf("第%d行", line), parseErr.Err.Error())
+				continue
+			}
+			return importPlan{}, err
+		}
+		field := func(name string) (string, bool) {
+			i, ok := cols[name]
+			if !ok || i >= len(record) {
+				return "", false
+			}
+			return strings.TrimSpace(record[i]), true
+		}
+		row, err := parseImportRow(field, groupID)
+		if err != nil {
+			plan.skip(fmt.Sprintf("第%d行", line), err.Error())
+			continue
+		}
+		plan.add(row)
+	}
+	return plan, nil
+}
+
+func parseImportRow(field func(string) (string, bool), groupID int64) (importRow, error) {
+	var row importRow
+	value, _ := field("pic_dhash")
+	hash, err := hex.DecodeString(value)
+	if err != nil {
+		return row, fmt.Errorf("pic_dhash %q 不是十六进制", value)
+	}
+	row.Hash = hash
+	row.Size = minicv.HashSizeForLen(len(hash))
+	if row.Size == 0 {
+		return row, fmt.Errorf("pic_dhash 长度 %d 字节不受支持", len(hash))
+	}
+	if value, ok := field("hash_size"); ok && value != "" {
+		size, err := strconv.Atoi(value)
+		if err != nil || size != row.Size {
+			return row, fmt.Errorf("hash_size %q 与 pic_dhash 长度不符", value)
+		}
+	}
+
+	value, _ = field("count")
+	if row.Count, err = strconv.ParseInt(value, 10, 64); err != nil || row.Count < 0 {
+		return row, fmt.Errorf("count %q 无效", value)
+	}
+	if value, ok := field("last_msg_id"); ok && value != "" {
+		if row.LastMsgID, err = strconv.ParseInt(value, 10, 64); err != nil || row.LastMsgID < 0 {
+			return row, fmt.Errorf("last_msg_id %q 无效", value)
+		}
+	}
+	if value, ok := field("group_id"); ok && value != "" {
+		source, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return row, fmt.Errorf("group_id %q 无效", value)
+		}
+		if source != groupID {
+			row.LastMsgID = 0
+		}
+	}
+	if value, ok := field("in_whitelist"); ok && value != "" {
+		if row.InWhitelist, err = strconv.ParseInt(value, 10, 64); err != nil || (row.InWhitelist != 0 && row.InWhitelist != 1) {
+			return row, fmt.Errorf("in_whitelist %q 只能是0或1", value)
+		}
+	}
+	if value, ok := field("hash_algo"); ok && value != "" {
+		if row.Algo, err = parseImportAlgo(value); err != nil {
+			return row, err
+		}
+	}
+	if value, ok := field("media_type"); ok && value != "" {
+		if row.Media, err = parseMediaType(value); err != nil {
+			return row, err
+		}
+	}
+	return row, nil
+}
+
+// parseImportAlgo accepts the names written by exports as well as the stored numbers.
+func parseImportAlgo(s string) (minicv.Algo, error) {
+	if n, err := strconv.ParseInt(s, 10, 64); err == nil && minicv.Algo(n).Valid() {
+		return minicv.Algo(n), nil
+	}
+	algo, err := minicv.ParseAlgo(s)
+	if err != nil {
+		return 0, fmt.Errorf("hash_algo %q 无效", s)
+	}
+	return algo, nil
+}
+
+type importResult struct {
+	Imported    int
+	Conflicting int
+	// Users counts whitelisted users that were new to the group.
+	Users int
+}
+
+// applyImport writes plan to groupID in one transaction. replace drops the group's current records, region hashes
+// and settings first and takes the exported settings, otherwise an image the group already knows is merged:
+// counts add up, the group keeps its own message link and its own settings.
+// Region hashes and whitelisted users are added in both modes, replace does not remove the group's own users.
+func applyImport(ctx context.Context, groupID int64, plan importPlan, replace bool) (importResult, error) {
+	result := importResult{Conflicting: plan.Duplicates}
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return importResult{}, err
+	}
+	qtx := queries.WithTx(tx)
+	if replace {
+		if err := qtx.DeleteRegionHashesByGroup(ctx, groupID); err != nil {
+			_ = tx.Rollback()
+			return importResult{}, err
+		}
+		if err := qtx.DeleteMarsInfoByGroup(ctx, groupID); err != nil {
+			_ = tx.Rollback()
+			return importResult{}, err
+		}
+		if err := qtx.DeleteGroupSettings(ctx, groupID); err != nil {
+			_ = tx.Rollback()
+			return importResult{}, err
+		}
+		for _, setting := range plan.Settings {
+			if err := qtx.UpsertGroupSetting(ctx, groupID, setting.Key, setting.Value); err != nil {
+				_ = tx.Rollback()
+				return importResult{}, err
+			}
+		}
+	}
+	for _, row := range plan.Rows {
+		params := q.UpsertMarsInfoParams{
+			GroupID:     groupID,
+			MediaType:   int64(row.Media),
+			HashAlgo:    int64(row.Algo),
+			HashSize:    int64(row.Size),
+			PicDhash:    row.Hash,
+			Count:       row.Count,
+			LastMsgID:   row.LastMsgID,
+			InWhitelist: row.InWhitelist,
+		}
+		if !replace {
+			existing, err := qtx.GetMarsInfo(ctx, groupID, params.MediaType, params.HashAlgo, params.PicDhash)
+			switch {
+			case err == nil:
+				result.Conflicting++
+				params.Count += existing.Count
+				if existing.LastMsgID != 0 {
+					params.LastMsgID = existing.LastMsgID
+				}
+				params.InWhitelist = max(params.InWhitelist, existing.InWhitelist)
+			case !errors.Is(err, sql.ErrNoRows):
+				_ = tx.Rollback()
+				return importResult{}, err
+			}
+		}
+		if err := qtx.UpsertMarsInfo(ctx, params); err != nil {
+			_ = tx.Rollback()
+			return importResult{}, err
+		}
+		result.Imported++
+	}
+	for _, r := range plan.Regions {
+		if err := qtx.UpsertRegionHash(ctx, q.UpsertRegionHashParams{
+			GroupID:    groupID,
+			MediaType:  int64(r.Media),
+			HashAlgo:   int64(r.Algo),
+			PicDhash:   r.Hash,
+			Region:     r.Region,
+			RegionHash: r.RegionHash,
+		}); err != nil {
+			_ = tx.Rollback()
+			return importResult{}, err
+		}
+	}
+	for _, user := range plan.Users {
+		exists, err := qtx.IsUserInWhitelist(ctx, groupID, user)
+		if err != nil {
+			_ = tx.Rollback()
+			return importResult{}, err
+		}
+		if exists != 0 {
+			continue
+		}
+		if err := qtx.AddUserToWhitelist(ctx, groupID, user); err != nil {
+			_ = tx.Rollback()
+			return importResult{}, err
+		}
+		result.Users++
+	}
+	if err := qtx.RefreshGroupStat(ctx, groupID); err != nil {
+		_ = tx.Rollback()
+		return importResult{}, err
+	}
+	if err := tx.Commit(); err != nil {
+		return importResult{}, err
+	}
+	invalidateSimilarIndex(groupID)
+	if replace {
+		settingsMu.Lock()
+		delete(settingsCache, groupID)
+		settingsMu.Unlock()
+	}
+	return result, nil
+}
+
+type pendingImport struct {
+	groupID int64
+	plan    importPlan
+	timer   *time.Timer
+}
+
+var (
+	importMu       sync.Mutex
+	pendingImports = make(map[string]*pendingImport)
+)
+
+func storePendingImport(groupID int64, plan importPlan) (string, error) {
+	var buf [8]byte
+	if _, err := rand.Read(buf[:]); err != nil {
+		return "", err
+	}
+	token := hex.EncodeToString(buf[:])
+	importMu.Lock()
+	defer importMu.Unlock()
+	pendingImports[token] = &pendingImport{
+		groupID: groupID,
+		plan:    plan,
+		timer:   time.AfterFunc(importTTL, func() { takePendingImport(token, groupID) }),
+	}
+	return token, nil
+}
+
+// takePendingImport removes and returns the import waiting under token for groupID, so a double click cannot
+// apply it twice. A token of another group leaves that group's import untouched.
+func takePendingImport(token string, groupID int64) *pendingImport {
+	importMu.Lock()
+	defer importMu.Unlock()
+	p, ok := pendingImports[token]
+	if !ok || p.groupID != groupID {
+		return nil
+	}
+	delete(pendingImports, token)
+	p.timer.Stop()
+	return p
+}
+
+func handleImport(b *gotgbot.Bot, ctx *ext.Context) error {
+	msg := ctx.EffectiveMessage
+	if msg == nil || ctx.EffectiveChat == nil {
+		return nil
+	}
+	reply := func(text string) error {
+		_, err := b.SendMessage(ctx.EffectiveChat.Id, text, &gotgbot.SendMessageOpts{ReplyParameters: replyTo(msg.MessageId)})
+		return err
+	}
+	if ctx.EffectiveChat.Type == "private" {
+		return reply("请在群组中使用该命令。")
+	}
+	if msg.ReplyToMessage == nil || msg.ReplyToMessage.Document == nil {
+		return reply("请回复一个由 /ensure_marsbot_export 导出的文件并使用该命令。")
+	}
+	doc := msg.ReplyToMessage.Document
+	if doc.FileSize > importMaxSize {
+		return reply("文件过大，火星车最多导入20MB的文件。")
+	}
+	data, err := fetchFile(rootCtx, b, doc.FileId)
+	if err != nil {
+		return err
+	}
+	plan, err := parseImportFile(data, ctx.EffectiveChat.Id)
+	if err != nil {
+		return reply("无法读取该文件：" + err.Error())
+	}
+	if len(plan.Rows) == 0 {
+		return reply(buildImportPreview(plan) + "\n没有可以导入的记录。")
+	}
+	token, err := storePendingImport(ctx.EffectiveChat.Id, plan)
+	if err != nil {
+		return err
+	}
+	_, err = b.SendMessage(ctx.EffectiveChat.Id, buildImportPreview(plan)+
+		"\n合并：保留本群现有记录和设置，相同图片的火星次数相加。\n替换：清空本群现有记录和设置后再导入。", &gotgbot.SendMessageOpts{
+		ReplyParameters: replyTo(msg.MessageId),
+		ReplyMarkup: gotgbot.InlineKeyboardMarkup{InlineKeyboard: [][]gotgbot.InlineKeyboardButton{{
+			{Text: "合并", CallbackData: "imp:" + token + ":merge"},
+			{Text: "替换", CallbackData: "imp:" + token + ":replace"},
+			{Text: "取消", CallbackData: "imp:" + token + ":cancel"},
+		}}},
+	})
+	return err
+}
+
+func buildImportPreview(plan importPlan) string {
+	lines := []string{fmt.Sprintf("文件中共有%d条有效记录，%d行无效将被跳过。", len(plan.Rows), plan.Skipped)}
+	if plan.Duplicates > 0 {
+		lines = append(lines, fmt.Sprintf("有%d行是文件中重复的图片，已合并。", plan.Duplicates))
+	}
+	if len(plan.Users) > 0 {
+		lines = append(lines, fmt.Sprintf("文件中还有%d个白名单用户。", len(plan.Users)))
+	}
+	if len(plan.Settings) > 0 {
+		lines = append(lines, fmt.Sprintf("文件中有%d项群组设置，仅在替换时导入。", len(plan.Settings)))
+	}
+	lines = append(lines, plan.Errors...)
+	if plan.Skipped > len(plan.Errors) {
+		lines = append(lines, "……")
+	}
+	return strings.Join(lines, "\n")
+}
+
+func handleImportCallback(b *gotgbot.Bot, ctx *ext.Context) error {
+	cb := ctx.CallbackQuery
+	if cb == nil || ctx.EffectiveChat == nil || ctx.EffectiveMessage == nil {
+		return nil
+	}
+	parts := strings.Split(cb.Data, ":")
+	if len(parts) != 3 {
+		_, err := cb.Answer(b, &gotgbot.AnswerCallbackQueryOpts{Text: "not valid callback"})
+		return err
+	}
+	token, op := parts[1], parts[2]
+	if op != "merge" && op != "replace" && op != "cancel" {
+		_, err := cb.Answer(b, &gotgbot.AnswerCallbackQueryOpts{Text: "not valid callback"})
+		return err
+	}
+	pending := takePendingImport(token, ctx.EffectiveChat.Id)
+	if pending == nil {
+		_, err := cb.Answer(b, &gotgbot.AnswerCallbackQueryOpts{Text: "导入已过期，请重新使用 /import", ShowAlert: true})
+		return err
+	}
+	var text string
+	switch op {
+	case "cancel":
+		text = "已取消导入。"
+	default:
+		result, err := applyImport(rootCtx, pending.groupID, pending.plan, op == "replace")
+		if err != nil {
+			logger.Warn("import", zap.Error(err), zap.Int64("group_id", pending.groupID))
+			text = "导入失败，本群数据没有改变：" + err.Error()
+			break
+		}
+		text = fmt.Sprintf("导入完成：导入%d条，跳过%d条，冲突%d条（已合并）。",
+			result.Imported, pending.plan.Skipped, result.Conflicting)
+		if result.Users > 0 {
+			text += fmt.Sprintf("\n新增白名单用户%d个。", result.Users)
+		}
+	}
+	_, _, err := b.EditMessageText(text, &gotgbot.EditMessageTextOpts{
+		ChatId:    ctx.EffectiveChat.Id,
+		MessageId: ctx.EffectiveMessage.MessageId,
+	})
+	if err != nil {
+		return err
+	}
+	_, err = cb.Answer(b, nil)
+	return err
+}
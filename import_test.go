@@ -0,0 +1,182 @@
+package marsbot
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/PaulSonOfLars/gotgbot/v2"
+
+	"marsbot/minicv"
+	"marsbot/q"
+)
+
+func TestParseImportCSV(t *testing.T) {
+	const groupID = -100
+	input := "group_id,pic_dhash,count,last_msg_id,in_whitelist\n" +
+		"-100,0102030405060708,3,42,0\n" +
+		"-100,zz,1,1,0\n" + // not hex
+		"-100,0102,1,1,0\n" + // unsupported length
+		"-100,1112131415161718,-1,1,0\n" + // negative count
+		"-100,2122232425262728,1,1,2\n" + // bad whitelist flag
+		"-100,0102030405060708,2,50,1\n" + // duplicate of the first row
+		"-200,3132333435363738,1,7,0\n" // from another group
+	plan, err := parseImportCSV(strings.NewReader(input), groupID)
+	if err != nil {
+		t.Fatalf("parse: %v", err)
+	}
+	if len(plan.Rows) != 2 || plan.Skipped != 4 || plan.Duplicates != 1 || len(plan.Errors) != 4 {
+		t.Fatalf("plan = %+v", plan)
+	}
+	first := plan.Rows[0]
+	if first.Count != 5 || first.LastMsgID != 50 || first.InWhitelist != 1 || first.Algo != minicv.AlgoDHash || first.Size != 8 {
+		t.Fatalf("merged duplicate = %+v", first)
+	}
+	if plan.Rows[1].LastMsgID != 0 {
+		t.Fatalf("message id from another group kept: %+v", plan.Rows[1])
+	}
+
+	if _, err := parseImportCSV(strings.NewReader("group_id,count\n1,1\n"), groupID); err == nil {
+		t.Fatalf("expected missing column error")
+	}
+}
+
+func TestImportRoundTrip(t *testing.T) {
+	useTestDB(t)
+	ctx := context.Background()
+	const source, target = -1005, -1006
+	photo := picHash{Algo: minicv.AlgoDHash, Size: 8, Hash: []byte{1, 2, 3, 4, 5, 6, 7, 8}}
+	video := picHash{Media: mediaVideo, Algo: minicv.AlgoPHash, Size: 16, Hash: make([]byte, 32)}
+	for msgID, hash := range []picHash{photo, photo, video} {
+		if _, err := recordMars(ctx, source, int64(msgID+1), hash); err != nil {
+			t.Fatalf("record: %v", err)
+		}
+	}
+	if _, err := recordMars(ctx, target, 9, photo); err != nil {
+		t.Fatalf("record target: %v", err)
+	}
+
+	path, err := exportChatData(ctx, &gotgbot.Chat{Id: source}, exportCSV)
+	if err != nil {
+		t.Fatalf("export: %v", err)
+	}
+	defer os.Remove(path)
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("read export: %v", err)
+	}
+	plan, err := parseImportFile(data, target)
+	if err != nil {
+		t.Fatalf("parse export: %v", err)
+	}
+	if len(plan.Rows) != 2 || plan.Skipped != 0 {
+		t.Fatalf("plan = %+v", plan)
+	}
+
+	res, err := applyImport(ctx, target, plan, false)
+	if err != nil {
+		t.Fatalf("merge: %v", err)
+	}
+	if res.Imported != 2 || res.Conflicting != 1 {
+		t.Fatalf("merge result = %+v", res)
+	}
+	info, err := queries.GetMarsInfo(ctx, target, int64(mediaPhoto), int64(photo.Algo), photo.Hash)
+	if err != nil || info.Count != 3 || info.LastMsgID != 9 {
+		t.Fatalf("merged photo = %+v, %v", info, err)
+	}
+	if _, err := queries.GetMarsInfo(ctx, target, int64(mediaVideo), int64(video.Algo), video.Hash); err != nil {
+		t.Fatalf("imported video missing: %v", err)
+	}
+
+	res, err = applyImport(ctx, target, plan, true)
+	if err != nil {
+		t.Fatalf("replace: %v", err)
+	}
+	if res.Imported != 2 || res.Conflicting != 0 {
+		t.Fatalf("replace result = %+v", res)
+	}
+	info, err = queries.GetMarsInfo(ctx, target, int64(mediaPhoto), int64(photo.Algo), photo.Hash)
+	if err != nil || info.Count != 2 || info.LastMsgID != 0 {
+		t.Fatalf("replaced photo = %+v, %v", info, err)
+	}
+	count, err := queries.GetGroupMarsCount(ctx, target)
+	if err != nil || count != 2 {
+		t.Fatalf("group stat = %d, %v", count, err)
+	}
+}
+
+func TestImportReplaceKeepsRegionsAndSettings(t *testing.T) {
+	useTestDB(t)
+	ctx := context.Background()
+	const groupID = -1007
+	seedExportGroup(t, groupID)
+	before, err := loadGroupSnapshot(ctx, groupID, exportCSV)
+	if err != nil {
+		t.Fatalf("snapshot: %v", err)
+	}
+	if len(before.Regions) == 0 || len(before.Settings) == 0 {
+		t.Fatalf("seed has no regions or settings: %+v", before)
+	}
+
+	for _, format := range []exportFormat{exportCSV, exportJSON} {
+		path, err := exportChatData(ctx, &gotgbot.Chat{Id: groupID}, format)
+		if err != nil {
+			t.Fatalf("%s export: %v", format, err)
+		}
+		data, err := os.ReadFile(path)
+		_ = os.Remove(path)
+		if err != nil {
+			t.Fatalf("read export: %v", err)
+		}
+		plan, err := parseImportFile(data, groupID)
+		if err != nil {
+			t.Fatalf("%s parse: %v", format, err)
+		}
+		// settings changed after the export are rolled back by replacing
+		if _, err := setGroupSetting(ctx, groupID, settingDefs[0], 3); err != nil {
+			t.Fatalf("change setting: %v", err)
+		}
+		if _, err := applyImport(ctx, groupID, plan, true); err != nil {
+			t.Fatalf("%s replace: %v", format, err)
+		}
+
+		after, err := loadGroupSnapshot(ctx, groupID, exportCSV)
+		if err != nil {
+			t.Fatalf("snapshot: %v", err)
+		}
+		if !slices.EqualFunc(after.Regions, before.Regions, func(a, b q.ListRegionHashesByGroupRow) bool {
+			return a.MediaType == b.MediaType && a.HashAlgo == b.HashAlgo && a.Region == b.Region &&
+				bytes.Equal(a.PicDhash, b.PicDhash) && bytes.Equal(a.RegionHash, b.RegionHash)
+		}) {
+			t.Fatalf("%s regions = %+v, want %+v", format, after.Regions, before.Regions)
+		}
+		if !slices.Equal(after.Settings, before.Settings) {
+			t.Fatalf("%s settings = %+v, want %+v", format, after.Settings, before.Settings)
+		}
+		if got := getGroupSettings(ctx, groupID).ReplyStyle; got != 1 {
+			t.Fatalf("%s cached reply style = %d", format, got)
+		}
+		if len(after.MarsInfo) != len(before.MarsInfo) || len(after.Users) != len(before.Users) {
+			t.Fatalf("%s snapshot = %+v, want %+v", format, after, before)
+		}
+	}
+}
+
+func TestTakePendingImportChecksGroup(t *testing.T) {
+	token, err := storePendingImport(-100, importPlan{})
+	if err != nil {
+		t.Fatalf("store: %v", err)
+	}
+	if p := takePendingImport(token, -200); p != nil {
+		t.Fatalf("another group took the import")
+	}
+	if p := takePendingImport(token, -100); p == nil || p.groupID != -100 {
+		t.Fatalf("import was lost after a foreign callback: %+v", p)
+	}
+	if p := takePendingImport(token, -100); p != nil {
+		t.Fatalf("import was taken twice")
+	}
+}
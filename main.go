@@ -4,9 +4,8 @@ import (
 	"bytes"
 	"context"
 	"database/sql"
-	"encoding/csv"
+	"encoding/base64"
 	"encoding/hex"
-	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
@@ -15,6 +14,7 @@ import (
 	"net/url"
 	"os"
 	"path/filepath"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
@@ -24,19 +24,66 @@ import (
 	"github.com/PaulSonOfLars/gotgbot/v2/ext/handlers"
 	"github.com/PaulSonOfLars/gotgbot/v2/ext/handlers/filters/callbackquery"
 	"github.com/PaulSonOfLars/gotgbot/v2/ext/handlers/filters/chatmember"
-	"github.com/PaulSonOfLars/gotgbot/v2/ext/handlers/filters/message"
 	"github.com/caarlos0/env/v11"
 	"github.com/mattn/go-sqlite3"
 	"go.uber.org/zap"
 
+	"marsbot/bktree"
 	"marsbot/minicv"
 	"marsbot/q"
 )
 
+// BackupConfig is the part of Config that the backup subcommands read, they run without a bot token.
+type BackupConfig struct {
+	DbPath string `env:"MARS_DB_PATH,required,notEmpty"`
+
+	NoBackup       bool   `env:"NO_BACKUP"`
+	S3ApiEndpoint  string `env:"S3_API_ENDPOINT"`
+	S3ApiKeyID     string `env:"S3_API_KEY_ID"`
+	S3ApiKeySecret string `env:"S3_API_KEY_SECRET"`
+	S3Bucket       string `env:"S3_BUCKET"`
+	S3Region       string `env:"S3_REGION"`
+	// S3PathStyle addresses the bucket as endpoint/bucket instead of bucket.endpoint, as MinIO expects.
+	S3PathStyle bool `env:"S3_PATH_STYLE"`
+	S3UseTLS    bool `env:"S3_USE_TLS" envDefault:"true"`
+	// S3CAFile is a PEM bundle trusted in addition to the system roots, for a self-signed endpoint.
+	S3CAFile string `env:"S3_CA_FILE"`
+	// BackupLocalDir keeps backups in a directory as well as or instead of S3.
+	BackupLocalDir  string `env:"BACKUP_LOCAL_DIR"`
+	S3BackupMinutes int    `env:"BACKUP_INTERVAL_MINUTES" envDefault:"2880"`
+	// BackupDeltaMinutes ships the changed pages between full backups at this interval, 0 disables it.
+	// "marsbotgo backup restore -at" replays them. Deltas build on a full backup of the running process:
+	// the one made at startup, or the next interval makes one instead of a delta while there is none.
+	BackupDeltaMinutes int `env:"BACKUP_DELTA_INTERVAL_MINUTES"`
+	// BackupKeyFile holds a 32 byte key (raw, hex or base64), backups and deltas are then encrypted with
+	// AES-256-GCM before upload. Restore needs the same file.
+	BackupKeyFile string `env:"BACKUP_KEY_FILE"`
+	// BackupVerifyMinutes test restores the newest backup of every target at this interval, 0 disables it.
+	BackupVerifyMinutes int `env:"BACKUP_VERIFY_INTERVAL_MINUTES"`
+	// BackupAlertChatID receives a message when a backup fails its integrity check or a test restore.
+	BackupAlertChatID int64 `env:"BACKUP_ALERT_CHAT_ID"`
+
+	// Retention of uploaded backups, everything is kept while all of them are 0. The newest backup is never pruned.
+	// Set any BACKUP_KEEP_* to keep only the newest backup of that many days, ISO weeks and months,
+	// BACKUP_MAX_AGE and BACKUP_MAX_COUNT then further limit what is kept.
+	BackupKeepDaily   int           `env:"BACKUP_KEEP_DAILY"`
+	BackupKeepWeekly  int           `env:"BACKUP_KEEP_WEEKLY"`
+	BackupKeepMonthly int           `env:"BACKUP_KEEP_MONTHLY"`
+	BackupMaxAge      time.Duration `env:"BACKUP_MAX_AGE"`
+	BackupMaxCount    int           `env:"BACKUP_MAX_COUNT"`
+}
+
 type Config struct {
 	BotToken string `env:"BOT_TOKEN,required,notEmpty"`
-
-	DbPath        string `env:"MARS_DB_PATH,required,notEmpty"`
+	BackupConfig
+
+	// EventWebhooks receive signed JSON events, entries are separated by ";" and are a URL optionally followed by
+	// a space and the comma separated events it wants, e.g. "https://a/hook mars_detected,bot_joined".
+	EventWebhooks      []string `env:"EVENT_WEBHOOKS" envSeparator:";"`
+	EventWebhookSecret string   `env:"EVENT_WEBHOOK_SECRET"`
+	EventMaxAttempts   int      `env:"EVENT_WEBHOOK_MAX_ATTEMPTS" envDefault:"5"`
+	// Deprecated: ReportStatUrl receives mars_detected with the flat {"group_id", "mars_count"} body it always got,
+	// signed and retried like EVENT_WEBHOOKS.
 	ReportStatUrl string `env:"MARS_REPORT_STAT_URL"`
 	LogLevel      string `env:"LOG_LEVEL" envDefault:"INFO"`
 
@@ -44,14 +91,40 @@ type Config struct {
 	BotBaseFileUrl string   `env:"BOT_BASE_FILE_URL"`
 	BotProxy       *url.URL `env:"BOT_PROXY"`
 
-	NoBackup        bool   `env:"NO_BACKUP"`
-	S3ApiEndpoint   string `env:"S3_API_ENDPOINT"`
-	S3ApiKeyID      string `env:"S3_API_KEY_ID"`
-	S3ApiKeySecret  string `env:"S3_API_KEY_SECRET"`
-	S3Bucket        string `env:"S3_BUCKET"`
-	S3BackupMinutes int    `env:"BACKUP_INTERVAL_MINUTES" envDefault:"2880"`
+	UpdateMode        string `env:"UPDATE_MODE" envDefault:"polling"`
+	WebhookUrl        string `env:"WEBHOOK_URL"`
+	WebhookListenAddr string `env:"WEBHOOK_LISTEN_ADDR" envDefault:"0.0.0.0:8443"`
+	WebhookPath       string `env:"WEBHOOK_PATH" envDefault:"marsbot"`
+	WebhookSecret     string `env:"WEBHOOK_SECRET"`
+	WebhookSelfSigned bool   `env:"WEBHOOK_SELF_SIGNED"`
+	WebhookCertDir    string `env:"WEBHOOK_CERT_DIR"`
 
+	// PprofAddr serves /debug/pprof, the Prometheus /metrics and the /healthz and /readyz probes, empty disables them.
 	PprofAddr string `env:"PPROF_ADDR" envDefault:"localhost:4025"`
+	// HealthAddr serves only the probes and /metrics, for an orchestrator that cannot reach PPROF_ADDR.
+	HealthAddr string `env:"HEALTH_ADDR"`
+	// /readyz fails when polling has not got a getUpdates answer for ReadyUpdatesMaxAge, or no backup was uploaded
+	// for ReadyBackupMaxAge, by default twice BACKUP_INTERVAL_MINUTES.
+	ReadyUpdatesMaxAge time.Duration `env:"READY_UPDATES_MAX_AGE" envDefault:"2m"`
+	ReadyBackupMaxAge  time.Duration `env:"READY_BACKUP_MAX_AGE"`
+
+	HashAlgo minicv.Algo `env:"HASH_ALGO" envDefault:"dhash"`
+	HashSize int         `env:"HASH_SIZE" envDefault:"8"`
+
+	// Distances are in bits of a 64-bit hash and scale with HASH_SIZE, 0 disables the check.
+	FuzzyMatchDistance    int64 `env:"FUZZY_MATCH_DISTANCE" envDefault:"0"`
+	SimilarNoticeDistance int64 `env:"SIMILAR_NOTICE_DISTANCE" envDefault:"0"`
+	// MatchOrientations also matches rotated and mirrored copies, groups can override it in /settings.
+	MatchOrientations bool `env:"MATCH_ORIENTATIONS" envDefault:"true"`
+	// CropMatchRegions is how many of the minicv.Regions must agree to match a cropped copy, 0 disables it.
+	CropMatchRegions int64 `env:"CROP_MATCH_REGIONS" envDefault:"4"`
+
+	// CommandRoles maps a command (or callback prefix) to member, admin or owner, e.g. "add_whitelist:member".
+	CommandRoles  map[string]string `env:"COMMAND_ROLES"`
+	AdminCacheTTL time.Duration     `env:"ADMIN_CACHE_TTL" envDefault:"5m"`
+
+	// ShutdownTimeout bounds how long SIGINT or SIGTERM waits for handlers, albums and a running backup.
+	ShutdownTimeout time.Duration `env:"SHUTDOWN_TIMEOUT" envDefault:"30s"`
 
 	DevMode bool `env:"DEV_MODE" envDefault:"false"`
 }
@@ -63,36 +136,70 @@ const (
 	groupedMediaWait           = 1 * time.Second
 	mediaGroupLimit            = 10
 	similarHDThreshold   int64 = 6
+	similarResultLimit         = 10
+	regionMatchDistance  int64 = 8 // per sub-region, in bits of a 64-bit hash
 	exportCooldown             = 10 * time.Minute
 	hammingDistanceError       = "dhash length mismatch"
 
-	botRequestTimeout    = 15 * time.Second
-	fileDownloadTimeout  = 20 * time.Second
-	reportRequestTimeout = 10 * time.Second
-	reportStatTimeout    = 5 * time.Second
+	botRequestTimeout   = 15 * time.Second
+	fileDownloadTimeout = 20 * time.Second
 
 	hammdistSOName = "libhammdist"
+
+	updateModePolling = "polling"
+	updateModeWebhook = "webhook"
 )
 
+var allowedUpdates = []string{
+	"callback_query",
+	"channel_post",
+	"message",
+	"edited_message",
+	"my_chat_member",
+}
+
 var (
-	logger       *zap.Logger
-	db           *sql.DB
-	queries      *q.Queries
-	fileClient   *http.Client
-	reportClient *http.Client
-	mediaMu      sync.Mutex
-	mediaGroups  map[string]chan *gotgbot.Message
+	logger      *zap.Logger
+	db          *sql.DB
+	queries     *q.Queries
+	fileClient  *http.Client
+	mediaMu     sync.Mutex
+	mediaGroups map[string]chan *gotgbot.Message
 
 	exportMu           sync.Mutex
 	exporting          map[int64]*exportState
 	registerSQLiteOnce sync.Once
 )
 
+// picHash is a perceptual hash together with the algorithm and grid size that produced it,
+// and the kind of media it was taken from.
+type picHash struct {
+	Media mediaType
+	Algo  minicv.Algo
+	Size  int
+	Hash  []byte
+	// Orientations holds the hashes of the rotated and mirrored image indexed by minicv.Orientation,
+	// nil when the algorithm cannot produce them. They are only used for lookups and never stored in mars_info.
+	Orientations [][]byte
+	// Regions holds the hashes of the sub-regions in minicv.Regions, nil for images too small to have them.
+	Regions [][]byte
+}
+
 type marsResult struct {
 	PrevCount     int64
 	PrevLastMsgID int64
 	Info          q.MarsInfo
 	Skipped       bool
+	// Hash is the stored entry that was credited, which differs from the input on a fuzzy match.
+	Hash     picHash
+	Distance int
+	// Orientation is how the image had to be turned to match Hash (or SimilarInfo), usually minicv.OrientIdentity.
+	Orientation minicv.Orientation
+	// Regions is the number of agreeing sub-regions when Hash was only matched as a crop, 0 otherwise.
+	Regions int
+	// Similar is set when the image was recorded as new but lies close to SimilarInfo.
+	Similar     bool
+	SimilarInfo q.MarsInfo
 }
 
 type exportState struct {
@@ -105,6 +212,10 @@ func Start() {
 		fmt.Println(err.Error())
 		os.Exit(2)
 	}
+	if !minicv.ValidHashSize(config.HashSize) {
+		fmt.Printf("unsupported HASH_SIZE %d, use 8 or 16\n", config.HashSize)
+		os.Exit(2)
+	}
 	var err error
 	logger, err = buildLogger(config.LogLevel)
 	if err != nil {
@@ -112,7 +223,7 @@ func Start() {
 	}
 	defer logger.Sync()
 	startPprof(config.PprofAddr)
-	go StartBackupThread()
+	startHealthServer(config.HealthAddr)
 
 	mediaGroups = make(map[string]chan *gotgbot.Message)
 	exporting = make(map[int64]*exportState)
@@ -120,56 +231,80 @@ func Start() {
 	if err := initDB(); err != nil {
 		logger.Fatal("failed to start: init db", zap.Error(err))
 	}
+	// the thread backs up right away, which needs the database open
+	StartBackupThread()
 	bot, err := buildBot()
 	if err != nil {
 		logger.Fatal("failed to start: build bot", zap.Error(err))
 	}
+	alertBot.Store(bot)
+	if err := startEvents(); err != nil {
+		logger.Fatal("failed to start: event webhooks", zap.Error(err))
+	}
+
+	dp := buildDispatcher()
+	updater := ext.NewUpdater(dp, nil)
 
+	switch config.UpdateMode {
+	case updateModePolling:
+		if _, err := bot.DeleteWebhook(nil); err != nil {
+			logger.Fatal("failed to delete webhook", zap.Error(err))
+		}
+		pollingOpts := &ext.PollingOpts{
+			GetUpdatesOpts: &gotgbot.GetUpdatesOpts{
+				AllowedUpdates: allowedUpdates,
+			},
+		}
+		if err := updater.StartPolling(bot, pollingOpts); err != nil {
+			logger.Fatal("failed to start polling", zap.Error(err))
+		}
+	case updateModeWebhook:
+		if err := startWebhook(updater, bot); err != nil {
+			logger.Fatal("failed to start webhook", zap.Error(err))
+		}
+	default:
+		logger.Fatal("unknown update mode", zap.String("mode", config.UpdateMode))
+	}
+	logger.Info("marsbot is running", zap.String("username", bot.Username), zap.String("mode", config.UpdateMode))
+	waitForSignal()
+	shutdown(updater, config.ShutdownTimeout)
+}
+
+func buildDispatcher() *ext.Dispatcher {
 	dp := ext.NewDispatcher(&ext.DispatcherOpts{
 		Error: func(_ *gotgbot.Bot, _ *ext.Context, err error) ext.DispatcherAction {
+			handlerErrors.inc()
 			logger.Warn("handler error", zap.Error(err))
 			return ext.DispatcherActionNoop
 		},
 		Panic: func(_ *gotgbot.Bot, _ *ext.Context, r interface{}) {
+			handlerPanics.inc()
 			logger.Error("handler panic", zap.Any("r", r), zap.Stack("stack"))
 		},
 	})
-	dp.AddHandler(handlers.NewMessage(message.Photo, handlePhoto).
+	dp.AddHandler(handlers.NewMessage(hasHashableMedia, handleMedia).
 		SetAllowChannel(true))
-	dp.AddHandler(handlers.NewCallback(callbackquery.Prefix("wl:"), handleAddPicWhitelistByCallback))
+	dp.AddHandler(handlers.NewCallback(callbackquery.Prefix("wl:"), requireRole("wl", handleAddPicWhitelistByCallback)))
 	dp.AddHandler(handlers.NewCallback(callbackquery.Prefix("find:"), handleFindSimilarByCallback))
+	dp.AddHandler(handlers.NewCallback(callbackquery.Prefix("set:"), requireRole("settings", handleSettingsCallback)))
+	dp.AddHandler(handlers.NewCallback(callbackquery.Prefix("imp:"), requireRole("import", handleImportCallback)))
 	dp.AddHandler(handlers.NewCommand("pic_info", handlePicInfo))
-	dp.AddHandler(handlers.NewCommand("add_whitelist", handleAddToWhitelist))
-	dp.AddHandler(handlers.NewCommand("remove_whitelist", handleRemoveFromWhitelist))
+	dp.AddHandler(handlers.NewCommand("add_whitelist", requireRole("add_whitelist", handleAddToWhitelist)))
+	dp.AddHandler(handlers.NewCommand("remove_whitelist", requireRole("remove_whitelist", handleRemoveFromWhitelist)))
 	dp.AddHandler(handlers.NewCommand("add_me_to_whitelist", handleAddUserToWhitelist))
 	dp.AddHandler(handlers.NewCommand("remove_me_from_whitelist", handleRemoveUserFromWhitelist))
+	dp.AddHandler(handlers.NewCommand("whitelist_user", requireRole("whitelist_user", handleWhitelistUser)))
+	dp.AddHandler(handlers.NewCommand("unwhitelist_user", requireRole("unwhitelist_user", handleUnwhitelistUser)))
 	dp.AddHandler(handlers.NewCommand("stat", handleBotStat))
+	dp.AddHandler(handlers.NewCommand("settings", handleSettings))
 	dp.AddHandler(handlers.NewCommand("help", handleHelp))
 	dp.AddHandler(handlers.NewCommand("start", handleHelp))
 	dp.AddHandler(handlers.NewCommand("mars_bot_welcome", handleCmdWelcome))
-	dp.AddHandler(handlers.NewCommand("ensure_marsbot_export", handleExportData))
+	dp.AddHandler(handlers.NewCommand("ensure_marsbot_export", requireRole("export", handleExportData)))
 	dp.AddHandler(handlers.NewCommand("export", handleExportHelp))
+	dp.AddHandler(handlers.NewCommand("import", requireRole("import", handleImport)))
 	dp.AddHandler(handlers.NewMyChatMember(chatmember.All, handleWelcome))
-	updater := ext.NewUpdater(dp, nil)
-
-	allowed := []string{
-		"callback_query",
-		"channel_post",
-		"message",
-		"edited_message",
-		"my_chat_member",
-	}
-	pollingOpts := &ext.PollingOpts{
-		GetUpdatesOpts: &gotgbot.GetUpdatesOpts{
-			AllowedUpdates: allowed,
-		},
-	}
-
-	if err := updater.StartPolling(bot, pollingOpts); err != nil {
-		logger.Fatal("failed to start polling", zap.Error(err))
-	}
-	logger.Info("marsbot is running", zap.String("username", bot.Username))
-	updater.Idle()
+	return dp
 }
 
 func buildLogger(level string) (*zap.Logger, error) {
@@ -200,6 +335,7 @@ func startPprof(addr string) {
 	mux.Handle("/debug/pprof/heap", pprof.Handler("heap"))
 	mux.Handle("/debug/pprof/threadcreate", pprof.Handler("threadcreate"))
 	mux.Handle("/debug/pprof/block", pprof.Handler("block"))
+	registerProbeHandlers(mux)
 
 	srv := &http.Server{
 		Addr:              addr,
@@ -232,12 +368,22 @@ func registerSQLiteDriver(soFile string) {
 		})
 	})
 }
-func initDB() error {
+
+// registerBundledSQLiteDriver registers the driver with the hammdist extension that is shipped next to the binary.
+func registerBundledSQLiteDriver() error {
 	f, err := os.Executable()
 	if err != nil {
 		return fmt.Errorf("get executable path: %w", err)
 	}
 	registerSQLiteDriver(filepath.Join(filepath.Dir(f), hammdistSOName))
+	return nil
+}
+
+func initDB() error {
+	if err := registerBundledSQLiteDriver(); err != nil {
+		return err
+	}
+	var err error
 	db, err = sql.Open(sqliteDriverName, config.DbPath)
 	if err != nil {
 		return fmt.Errorf("open database: %w", err)
@@ -257,7 +403,12 @@ func initDB() error {
 			return fmt.Errorf("apply pragma %q: %w", p, err)
 		}
 	}
+	if err := migrateDB(rootCtx, db); err != nil {
+		db.Close()
+		return fmt.Errorf("migrate database: %w", err)
+	}
 	queries = q.NewWithLogger(db, logger)
+	queries.Observe = observeQuery
 	return nil
 }
 
@@ -271,11 +422,6 @@ func buildBot() (*gotgbot.Bot, error) {
 		Timeout:   fileDownloadTimeout,
 		Transport: transport,
 	}
-	if config.ReportStatUrl != "" {
-		reportClient = &http.Client{
-			Timeout: reportRequestTimeout,
-		}
-	}
 	client := &gotgbot.BaseBotClient{
 		Client: http.Client{
 			Timeout:   botRequestTimeout,
@@ -285,26 +431,28 @@ func buildBot() (*gotgbot.Bot, error) {
 	if config.BotBaseUrl != "" {
 		client.DefaultRequestOpts = &gotgbot.RequestOpts{APIURL: config.BotBaseUrl}
 	}
-	bot, err := gotgbot.NewBot(config.BotToken, &gotgbot.BotOpts{BotClient: client})
+	bot, err := gotgbot.NewBot(config.BotToken, &gotgbot.BotOpts{BotClient: trackingBotClient{client}})
 	if err != nil {
 		return nil, fmt.Errorf("create bot: %w", err)
 	}
 	return bot, err
 }
 
-func handlePhoto(bot *gotgbot.Bot, ctx *ext.Context) error {
+// handleMedia checks photos, and videos, animations and video notes through their thumbnails.
+func handleMedia(bot *gotgbot.Bot, ctx *ext.Context) error {
 	msg := ctx.EffectiveMessage
 	chat := ctx.EffectiveChat
-	if msg == nil || chat == nil || len(msg.Photo) == 0 {
+	if msg == nil || chat == nil || !hasHashableMedia(msg) {
 		return nil
 	}
 	// skip edited grouped media to avoid double counting
 	if msg.MediaGroupId != "" && ctx.EditedMessage != nil {
 		return nil
 	}
+	mediaReceived.inc(mediaLabel(messageMedia(msg).Type))
 
 	if ctx.EffectiveUser != nil {
-		inWl, err := isUserInWhitelist(context.Background(), chat.Id, ctx.EffectiveUser.Id)
+		inWl, err := isUserInWhitelist(rootCtx, chat.Id, ctx.EffectiveUser.Id)
 		if err != nil {
 			logger.Warn("check user whitelist", zap.Error(err))
 		}
@@ -317,35 +465,51 @@ func handlePhoto(bot *gotgbot.Bot, ctx *ext.Context) error {
 		enqueueMediaGroup(bot, msg)
 		return nil
 	}
-	return processSinglePhoto(bot, msg)
+	return processSingleMedia(bot, msg)
 }
 
-func processSinglePhoto(bot *gotgbot.Bot, msg *gotgbot.Message) error {
-	ctx := context.Background()
-	photo := msg.Photo[len(msg.Photo)-1]
-	dhash, err := getDHash(ctx, bot, photo)
+func processSingleMedia(bot *gotgbot.Bot, msg *gotgbot.Message) error {
+	ctx := rootCtx
+	file := messageMedia(msg)
+	media := file.Type
+	hash, err := getDHash(ctx, bot, *file)
 	if err != nil {
 		return err
 	}
-	result, err := recordMars(ctx, msg.Chat.Id, msg.MessageId, dhash)
+	result, err := recordMars(ctx, msg.Chat.Id, msg.MessageId, hash)
 	if err != nil {
 		return err
 	}
+	settings := getGroupSettings(ctx, msg.Chat.Id)
+	if result.Similar && settings.ReplyStyle != replyStyleSilent {
+		reply := buildSimilarReply(&msg.Chat, media, result.SimilarInfo.LastMsgID) + matchNote(result)
+		_, err = bot.SendMessage(msg.Chat.Id, reply,
+			&gotgbot.SendMessageOpts{ReplyParameters: replyTo(msg.MessageId), ParseMode: "HTML"})
+		if err != nil {
+			logger.Warn("send similar reply", zap.Error(err))
+		}
+		return nil
+	}
 	if result.Skipped || result.PrevCount == 0 {
 		return nil
 	}
+	emitMarsDetected(msg, result)
+	if settings.ReplyStyle == replyStyleSilent {
+		return nil
+	}
 
-	reply := buildMarsReply(&msg.Chat, result.PrevCount, result.PrevLastMsgID)
+	reply := buildMarsReply(&msg.Chat, settings.ReplyStyle, media, result.PrevCount, result.PrevLastMsgID) +
+		matchNote(result)
 	opt := &gotgbot.SendMessageOpts{
 		ReplyParameters: replyTo(msg.MessageId),
 		ParseMode:       "HTML",
 	}
-	if result.PrevCount > 3 {
+	if result.PrevCount > settings.WhitelistButtonMin {
 		opt.ReplyMarkup = &gotgbot.InlineKeyboardMarkup{
 			InlineKeyboard: [][]gotgbot.InlineKeyboardButton{{
 				{
 					Text:         "将图片添加至白名单",
-					CallbackData: fmt.Sprintf("wl:%s", hex.EncodeToString(dhash)),
+					CallbackData: hashCallbackData("wl", result.Hash),
 				},
 			}},
 		}
@@ -354,7 +518,6 @@ func processSinglePhoto(bot *gotgbot.Bot, msg *gotgbot.Message) error {
 	if err != nil {
 		logger.Warn("send mars reply", zap.Error(err))
 	}
-	go reportStat(msg.Chat.Id, result.PrevCount)
 	return nil
 }
 
@@ -365,7 +528,9 @@ func enqueueMediaGroup(bot *gotgbot.Bot, msg *gotgbot.Message) {
 	if !ok {
 		c = make(chan *gotgbot.Message, mediaGroupLimit)
 		mediaGroups[msg.MediaGroupId] = c
-		go flushMediaGroup(bot, msg.MediaGroupId, c)
+		wait := getGroupSettings(rootCtx, msg.Chat.Id).MediaGroupWait()
+		mediaWG.Add(1)
+		go flushMediaGroup(bot, msg.MediaGroupId, c, wait)
 	}
 	select {
 	case c <- msg:
@@ -373,59 +538,74 @@ func enqueueMediaGroup(bot *gotgbot.Bot, msg *gotgbot.Message) {
 	}
 }
 
-func flushMediaGroup(bot *gotgbot.Bot, groupID string, c chan *gotgbot.Message) {
-	defer func() {
-		mediaMu.Lock()
-		delete(mediaGroups, groupID)
-		mediaMu.Unlock()
-	}()
+// flushMediaGroup collects the album until no message arrived for wait, or right away once shutdown begins.
+func flushMediaGroup(bot *gotgbot.Bot, groupID string, c chan *gotgbot.Message, wait time.Duration) {
+	defer mediaWG.Done()
 	msgs := make([]*gotgbot.Message, 0, mediaGroupLimit)
-	timer := time.NewTimer(groupedMediaWait)
+	timer := time.NewTimer(wait)
 	defer timer.Stop()
 loop:
 	for {
 		select {
 		case msg := <-c:
 			msgs = append(msgs, msg)
-			timer.Reset(groupedMediaWait)
+			timer.Reset(wait)
 		case <-timer.C:
 			break loop
+		case <-mediaFlush:
+			break loop
+		}
+	}
+	// messages are only sent to c while the group is in the map, so after removing it the rest can be drained
+	mediaMu.Lock()
+	delete(mediaGroups, groupID)
+	mediaMu.Unlock()
+drain:
+	for {
+		select {
+		case msg := <-c:
+			msgs = append(msgs, msg)
+		default:
+			break drain
 		}
 	}
 	if err := handleMediaGroup(bot, msgs); err != nil {
+		handlerErrors.inc()
 		logger.Warn("handle media group", zap.Error(err), zap.String("group_id", groupID))
 	}
 }
 
 func handleMediaGroup(bot *gotgbot.Bot, msgs []*gotgbot.Message) error {
-	ctx := context.Background()
+	ctx := rootCtx
 	type item struct {
 		msg *gotgbot.Message
 		res marsResult
 	}
 	unique := make(map[string]*item)
+	mediaGroupSize.observe(float64(len(msgs)))
 
 	for _, msg := range msgs {
-		if len(msg.Photo) == 0 {
+		file := messageMedia(msg)
+		if file == nil {
 			continue
 		}
-		dhash, err := getDHash(ctx, bot, msg.Photo[len(msg.Photo)-1])
+		hash, err := getDHash(ctx, bot, *file)
 		if err != nil {
 			logger.Warn("get dhash for group media", zap.Error(err))
 			continue
 		}
-		key := hex.EncodeToString(dhash)
+		key := fmt.Sprintf("%d:%x", hash.Media, hash.Hash)
 		if _, ok := unique[key]; ok {
 			continue // avoid duplicate reporting inside one album
 		}
-		res, err := recordMars(ctx, msg.Chat.Id, msg.MessageId, dhash)
+		res, err := recordMars(ctx, msg.Chat.Id, msg.MessageId, hash)
 		if err != nil {
 			logger.Warn("record mars for group media", zap.Error(err))
 			continue
 		}
 		unique[key] = &item{msg: msg, res: res}
 		if res.PrevCount > 0 && !res.Skipped {
-			go reportStat(msg.Chat.Id, res.PrevCount)
+			emitMarsDetected(msg, res)
 		}
 	}
 
@@ -441,7 +621,11 @@ func handleMediaGroup(bot *gotgbot.Bot, msgs []*gotgbot.Message) error {
 	if best == nil {
 		return nil
 	}
-	reply := buildGroupedReply(&best.msg.Chat, best.res.PrevCount, best.res.PrevLastMsgID)
+	style := getGroupSettings(ctx, best.msg.Chat.Id).ReplyStyle
+	if style == replyStyleSilent {
+		return nil
+	}
+	reply := buildGroupedReply(&best.msg.Chat, style, best.res.PrevCount, best.res.PrevLastMsgID)
 	_, err := bot.SendMessage(best.msg.Chat.Id, reply, &gotgbot.SendMessageOpts{
 		ReplyParameters: replyTo(best.msg.MessageId),
 		ParseMode:       "HTML",
@@ -449,38 +633,97 @@ func handleMediaGroup(bot *gotgbot.Bot, msgs []*gotgbot.Message) error {
 	return err
 }
 
-func getDHash(ctx context.Context, b *gotgbot.Bot, photo gotgbot.PhotoSize) ([]byte, error) {
-	dhash, err := queries.GetDhashFromFileUid(ctx, photo.FileUniqueId)
+// getDHash returns the hash of pic computed with the configured HASH_ALGO and HASH_SIZE, cached by file unique id.
+// pic.Type only labels the result, the same thumbnail hashes the same no matter what it belongs to.
+func getDHash(ctx context.Context, b *gotgbot.Bot, pic mediaFile) (picHash, error) {
+	algo, size, media := config.HashAlgo, config.HashSize, pic.Type
+	cached, err := queries.GetDhashFromFileUid(ctx, pic.FileUniqueId, int64(algo), int64(size))
 	if err == nil {
-		return dhash, nil
+		hashCacheRequests.inc("hit")
+		return picHash{Media: media, Algo: algo, Size: size, Hash: cached.Dhash,
+			Orientations: splitHashes(cached.Orientations, size, minicv.OrientationCount),
+			Regions:      splitHashes(cached.Regions, size, minicv.RegionCount)}, nil
 	}
 	if !errors.Is(err, sql.ErrNoRows) {
-		return nil, err
+		return picHash{}, err
 	}
+	hashCacheRequests.inc("miss")
 
-	file, err := b.GetFile(photo.FileId, nil)
+	start := time.Now()
+	data, err := fetchFile(ctx, b, pic.FileId)
 	if err != nil {
-		return nil, fmt.Errorf("get file: %w", err)
+		return picHash{}, err
 	}
-	var data []byte
-	if data2, err := os.ReadFile(file.FilePath); err == nil {
-		data = data2
-	} else {
-		u := file.URL(b, &gotgbot.RequestOpts{APIURL: config.BotBaseFileUrl})
-		data, err = downloadFile(ctx, u)
-		if err != nil {
-			return nil, err
+	fileDownloadSeconds.since(start)
+	start = time.Now()
+	hash, err := hashImage(data, algo, size)
+	hashSeconds.since(start)
+	if err != nil {
+		return picHash{}, err
+	}
+	hash.Media = media
+	if err := queries.UpsertDhash(ctx, q.UpsertDhashParams{
+		Fuid:         pic.FileUniqueId,
+		HashAlgo:     int64(algo),
+		HashSize:     int64(size),
+		Dhash:        hash.Hash,
+		Orientations: bytes.Join(hash.Orientations, nil),
+		Regions:      bytes.Join(hash.Regions, nil),
+	}); err != nil {
+		logger.Warn("cache dhash", zap.Error(err))
+	}
+	return hash, nil
+}
+
+// hashImage hashes data, together with its rotated and mirrored copies when the algorithm supports them
+// and its sub-regions when the image is large enough. Media is left for the caller to fill in.
+func hashImage(data []byte, algo minicv.Algo, size int) (picHash, error) {
+	img, err := minicv.DecodeBytes(data)
+	if err != nil {
+		return picHash{}, err
+	}
+	hash := picHash{Algo: algo, Size: size}
+	hash.Orientations, err = minicv.HashOrientations(img, algo, size)
+	switch {
+	case err == nil:
+		hash.Hash = hash.Orientations[minicv.OrientIdentity]
+	case errors.Is(err, minicv.ErrOrientationsUnsupported):
+		if hash.Hash, err = minicv.HashImage(img, algo, size); err != nil {
+			return picHash{}, err
 		}
+	default:
+		return picHash{}, err
 	}
-	dhashArr, err := minicv.DHashBytes(data)
+	hash.Regions, err = minicv.HashRegions(img, algo, size)
+	if err != nil && !errors.Is(err, minicv.ErrImageTooSmall) {
+		return picHash{}, err
+	}
+	return hash, nil
+}
+
+// splitHashes undoes the concatenation fuid_to_dhash stores orientation and region hashes in.
+func splitHashes(data []byte, size int, count int) [][]byte {
+	n := minicv.HashLen(size)
+	if len(data) != n*count {
+		return nil
+	}
+	out := make([][]byte, count)
+	for i := range out {
+		out[i] = data[i*n : (i+1)*n]
+	}
+	return out
+}
+
+// fetchFile returns the content of a Telegram file, read straight from disk when a local Bot API server shares it.
+func fetchFile(ctx context.Context, b *gotgbot.Bot, fileID string) ([]byte, error) {
+	file, err := b.GetFile(fileID, nil)
 	if err != nil {
-		return nil, err
+		return nil, fmt.Errorf("get file: %w", err)
 	}
-	dhash = dhashArr[:]
-	if err := queries.UpsertDhash(ctx, photo.FileUniqueId, dhash); err != nil {
-		logger.Warn("cache dhash", zap.Error(err))
+	if data, err := os.ReadFile(file.FilePath); err == nil {
+		return data, nil
 	}
-	return dhash, nil
+	return downloadFile(ctx, file.URL(b, &gotgbot.RequestOpts{APIURL: config.BotBaseFileUrl}))
 }
 
 func downloadFile(ctx context.Context, url string) ([]byte, error) {
@@ -503,14 +746,83 @@ func downloadFile(ctx context.Context, url string) ([]byte, error) {
 	return body, nil
 }
 
-func recordMars(ctx context.Context, groupID, msgID int64, dhash []byte) (marsResult, error) {
+// recordMars counts one sighting of hash in the group.
+// Without an exact match the nearest stored hash within the group's fuzzy distance is credited instead,
+// and one within the notice distance only marks the result as Similar.
+// When the group matches orientations, stored hashes close to a rotated or mirrored copy of the image count too,
+// but only after the plain hash found nothing. Last, an entry whose sub-regions mostly agree with the image's is
+// credited as a crop of it.
+func recordMars(ctx context.Context, groupID, msgID int64, hash picHash) (result marsResult, err error) {
+	defer func() { recordOutcomes.inc(recordOutcome(result, err)) }()
+	settings := getGroupSettings(ctx, groupID)
+	matchDist := scaleDistance(settings.FuzzyDistance, hash.Size)
+	noticeDist := scaleDistance(settings.NoticeDistance, hash.Size)
+	var near bktree.Match
+	hasNear := false
+	if matchDist > 0 || noticeDist > 0 {
+		// the index may need to load from the database, which must happen outside the transaction
+		var err error
+		near, hasNear, err = nearestSimilar(ctx, groupID, hash, int(max(matchDist, noticeDist)))
+		if err != nil {
+			logger.Warn("search near duplicates", zap.Error(err), zap.Int64("group_id", groupID))
+		}
+	}
+	var turned bktree.Match
+	turnedOrient := minicv.OrientIdentity
+	hasTurned := false
+	if settings.MatchOrientations != 0 && len(hash.Orientations) == minicv.OrientationCount {
+		var err error
+		turned, turnedOrient, hasTurned, err = nearestOriented(ctx, groupID, hash, int(max(matchDist, noticeDist)))
+		if err != nil {
+			logger.Warn("search rotated duplicates", zap.Error(err), zap.Int64("group_id", groupID))
+		}
+	}
+	var crop cropMatch
+	hasCrop := false
+	if settings.CropMatchRegions > 0 && len(hash.Regions) == minicv.RegionCount {
+		var err error
+		crop, hasCrop, err = bestCropMatch(ctx, groupID, hash, int(scaleDistance(regionMatchDistance, hash.Size)), int(settings.CropMatchRegions))
+		if err != nil {
+			logger.Warn("search cropped duplicates", zap.Error(err), zap.Int64("group_id", groupID))
+		}
+	}
+
 	tx, err := db.BeginTx(ctx, nil)
 	if err != nil {
 		return marsResult{}, err
 	}
 	qtx := queries.WithTx(tx)
 
-	info, err := qtx.GetMarsInfo(ctx, groupID, dhash)
+	target := hash
+	distance := 0
+	info, err := qtx.GetMarsInfo(ctx, groupID, int64(hash.Media), int64(hash.Algo), hash.Hash)
+	if errors.Is(err, sql.ErrNoRows) && hasNear && int64(near.Distance) <= matchDist {
+		nearHash := picHash{Media: hash.Media, Algo: hash.Algo, Size: hash.Size, Hash: near.Hash}
+		info, err = qtx.GetMarsInfo(ctx, groupID, int64(hash.Media), int64(hash.Algo), nearHash.Hash)
+		if err == nil {
+			target = nearHash
+			distance = near.Distance
+		}
+	}
+	orientation := minicv.OrientIdentity
+	if errors.Is(err, sql.ErrNoRows) && hasTurned && int64(turned.Distance) <= matchDist {
+		turnedHash := picHash{Media: hash.Media, Algo: hash.Algo, Size: hash.Size, Hash: turned.Hash}
+		info, err = qtx.GetMarsInfo(ctx, groupID, int64(hash.Media), int64(hash.Algo), turnedHash.Hash)
+		if err == nil {
+			target = turnedHash
+			distance = turned.Distance
+			orientation = turnedOrient
+		}
+	}
+	regions := 0
+	if errors.Is(err, sql.ErrNoRows) && hasCrop {
+		cropHash := picHash{Media: hash.Media, Algo: hash.Algo, Size: hash.Size, Hash: crop.Hash}
+		info, err = qtx.GetMarsInfo(ctx, groupID, int64(hash.Media), int64(hash.Algo), cropHash.Hash)
+		if err == nil {
+			target = cropHash
+			regions = crop.Regions
+		}
+	}
 	prevCount := int64(0)
 	prevLastMsgID := int64(0)
 	if err == nil {
@@ -518,14 +830,41 @@ func recordMars(ctx context.Context, groupID, msgID int64, dhash []byte) (marsRe
 		prevLastMsgID = info.LastMsgID
 		if info.LastMsgID == msgID || info.InWhitelist != 0 {
 			_ = tx.Rollback()
-			return marsResult{PrevCount: prevCount, PrevLastMsgID: prevLastMsgID, Info: info, Skipped: true}, nil
+			return marsResult{PrevCount: prevCount, PrevLastMsgID: prevLastMsgID, Info: info, Skipped: true,
+				Hash: target, Distance: distance, Orientation: orientation, Regions: regions}, nil
 		}
 	} else if !errors.Is(err, sql.ErrNoRows) {
 		_ = tx.Rollback()
 		return marsResult{}, err
 	}
 
-	newInfo, err := qtx.IncrementMarsInfo(ctx, groupID, dhash, msgID)
+	var similarInfo q.MarsInfo
+	similar := false
+	if prevCount == 0 {
+		candidate, candidateOrient, ok := near, minicv.OrientIdentity, hasNear && int64(near.Distance) <= noticeDist
+		if !ok && hasTurned && int64(turned.Distance) <= noticeDist {
+			candidate, candidateOrient, ok = turned, turnedOrient, true
+		}
+		if ok {
+			similarInfo, err = qtx.GetMarsInfo(ctx, groupID, int64(hash.Media), int64(hash.Algo), candidate.Hash)
+			if err == nil {
+				similar = true
+				orientation = candidateOrient
+			} else if !errors.Is(err, sql.ErrNoRows) {
+				_ = tx.Rollback()
+				return marsResult{}, err
+			}
+		}
+	}
+
+	newInfo, err := qtx.IncrementMarsInfo(ctx, q.IncrementMarsInfoParams{
+		GroupID:   groupID,
+		MediaType: int64(target.Media),
+		HashAlgo:  int64(target.Algo),
+		HashSize:  int64(target.Size),
+		PicDhash:  target.Hash,
+		LastMsgID: msgID,
+	})
 	if err != nil {
 		_ = tx.Rollback()
 		return marsResult{}, err
@@ -535,14 +874,36 @@ func recordMars(ctx context.Context, groupID, msgID int64, dhash []byte) (marsRe
 			_ = tx.Rollback()
 			return marsResult{}, err
 		}
+		for region, regionHash := range target.Regions {
+			if err := qtx.UpsertRegionHash(ctx, q.UpsertRegionHashParams{
+				GroupID:    groupID,
+				MediaType:  int64(target.Media),
+				HashAlgo:   int64(target.Algo),
+				PicDhash:   target.Hash,
+				Region:     int64(region),
+				RegionHash: regionHash,
+			}); err != nil {
+				_ = tx.Rollback()
+				return marsResult{}, err
+			}
+		}
 	}
 	if err := tx.Commit(); err != nil {
 		return marsResult{}, err
 	}
+	if prevCount == 0 {
+		indexHash(groupID, target)
+	}
 	return marsResult{
 		PrevCount:     prevCount,
 		PrevLastMsgID: prevLastMsgID,
 		Info:          newInfo,
+		Hash:          target,
+		Distance:      distance,
+		Orientation:   orientation,
+		Regions:       regions,
+		Similar:       similar,
+		SimilarInfo:   similarInfo,
 	}, nil
 }
 
@@ -554,42 +915,27 @@ func isUserInWhitelist(ctx context.Context, groupID, userID int64) (bool, error)
 	return val != 0, nil
 }
 
-func reportStat(groupID int64, marsCount int64) {
-	if reportClient == nil || config.ReportStatUrl == "" {
-		return
-	}
-	ctx, cancel := context.WithTimeout(context.Background(), reportStatTimeout)
-	defer cancel()
-	body, _ := json.Marshal(map[string]int64{
-		"group_id":   groupID,
-		"mars_count": marsCount,
-	})
-	req, err := http.NewRequestWithContext(ctx, http.MethodPost, config.ReportStatUrl, bytes.NewReader(body))
-	if err != nil {
-		logger.Warn("build report request", zap.Error(err))
-		return
-	}
-	req.Header.Set("Content-Type", "application/json")
-	resp, err := reportClient.Do(req)
-	if err != nil {
-		logger.Warn("report stat", zap.Error(err))
-		return
-	}
-	_ = resp.Body.Close()
-}
-
 func handleAddPicWhitelistByCallback(b *gotgbot.Bot, ctx *ext.Context) error {
 	if ctx.CallbackQuery == nil || ctx.EffectiveChat == nil {
 		return nil
 	}
-	dhash, err := parseCallback(ctx.CallbackQuery.Data)
+	hash, err := parseCallback(ctx.CallbackQuery.Data)
 	if err != nil {
 		_, err = ctx.CallbackQuery.Answer(b, &gotgbot.AnswerCallbackQueryOpts{Text: err.Error()})
 		return err
 	}
-	if err := queries.SetMarsWhitelist(context.Background(), ctx.EffectiveChat.Id, dhash, 1); err != nil {
+	if err := queries.SetMarsWhitelist(rootCtx, q.SetMarsWhitelistParams{
+		GroupID:     ctx.EffectiveChat.Id,
+		MediaType:   int64(hash.Media),
+		HashAlgo:    int64(hash.Algo),
+		HashSize:    int64(hash.Size),
+		PicDhash:    hash.Hash,
+		InWhitelist: 1,
+	}); err != nil {
 		return err
 	}
+	indexHash(ctx.EffectiveChat.Id, hash)
+	emitMediaWhitelist(ctx, hash, true)
 	_, err = ctx.CallbackQuery.Answer(b, &gotgbot.AnswerCallbackQueryOpts{Text: "该图片已加入白名单"})
 	return err
 }
@@ -599,20 +945,20 @@ func handlePicInfo(b *gotgbot.Bot, ctx *ext.Context) error {
 	if msg == nil || ctx.EffectiveChat == nil {
 		return nil
 	}
-	photo := getReferPhoto(msg)
-	if photo == nil {
+	file := getReferMedia(msg)
+	if file == nil {
 		_, err := b.SendMessage(ctx.EffectiveChat.Id, "火星车没有发现您引用了任何图片。\n尝试发送图片使用命令，或回复特定图片。",
 			&gotgbot.SendMessageOpts{ReplyParameters: replyTo(msg.MessageId)})
 		return err
 	}
 
-	dhash, err := getDHash(context.Background(), b, *photo)
+	hash, err := getDHash(rootCtx, b, *file)
 	if err != nil {
 		return err
 	}
-	info, err := queries.GetMarsInfo(context.Background(), ctx.EffectiveChat.Id, dhash)
+	info, err := queries.GetMarsInfo(rootCtx, ctx.EffectiveChat.Id, int64(hash.Media), int64(hash.Algo), hash.Hash)
 	if errors.Is(err, sql.ErrNoRows) {
-		info = q.MarsInfo{GroupID: ctx.EffectiveChat.Id, PicDhash: dhash, Count: 0, LastMsgID: 0, InWhitelist: 0}
+		info = q.MarsInfo{GroupID: ctx.EffectiveChat.Id, PicDhash: hash.Hash, Count: 0, LastMsgID: 0, InWhitelist: 0, HashAlgo: int64(hash.Algo), HashSize: int64(hash.Size), MediaType: int64(hash.Media)}
 	} else if err != nil {
 		return err
 	}
@@ -623,13 +969,13 @@ func handlePicInfo(b *gotgbot.Bot, ctx *ext.Context) error {
 	}
 	markup := &gotgbot.InlineKeyboardMarkup{
 		InlineKeyboard: [][]gotgbot.InlineKeyboardButton{{
-			{Text: "查找DHASH相似图片", CallbackData: fmt.Sprintf("find:%s", hex.EncodeToString(dhash))},
+			{Text: fmt.Sprintf("查找%s相似%s", strings.ToUpper(hash.Algo.String()), hash.Media.noun()), CallbackData: hashCallbackData("find", hash)},
 		}},
 	}
 
 	_, err = b.SendMessage(ctx.EffectiveChat.Id, fmt.Sprintf("File unique id: %s\n"+
-		"dhash: %s\n在本群的火星次数:%d\n%s",
-		photo.FileUniqueId, strings.ToUpper(hex.EncodeToString(dhash)), info.Count, whitelistStr),
+		"%s(%d位): %s\n在本群的火星次数:%d\n%s",
+		file.FileUniqueId, hash.Algo, hash.Size*hash.Size, strings.ToUpper(hex.EncodeToString(hash.Hash)), info.Count, whitelistStr),
 		&gotgbot.SendMessageOpts{
 			ReplyParameters: replyTo(msg.MessageId),
 			ReplyMarkup:     markup,
@@ -650,17 +996,17 @@ func updateWhitelistForPhoto(b *gotgbot.Bot, ctx *ext.Context, toWhitelist bool)
 	if msg == nil || ctx.EffectiveChat == nil || b == nil {
 		return nil
 	}
-	photo := getReferPhoto(msg)
-	if photo == nil {
+	file := getReferMedia(msg)
+	if file == nil {
 		_, err := b.SendMessage(ctx.EffectiveChat.Id, "火星车没有发现您引用了任何图片。\n尝试发送图片使用命令，或回复特定图片。",
 			&gotgbot.SendMessageOpts{ReplyParameters: replyTo(msg.MessageId)})
 		return err
 	}
-	dhash, err := getDHash(context.Background(), b, *photo)
+	hash, err := getDHash(rootCtx, b, *file)
 	if err != nil {
 		return err
 	}
-	info, err := queries.GetMarsInfo(context.Background(), ctx.EffectiveChat.Id, dhash)
+	info, err := queries.GetMarsInfo(rootCtx, ctx.EffectiveChat.Id, int64(hash.Media), int64(hash.Algo), hash.Hash)
 	if errors.Is(err, sql.ErrNoRows) {
 		info = q.MarsInfo{InWhitelist: 0}
 	} else if err != nil {
@@ -682,9 +1028,18 @@ func updateWhitelistForPhoto(b *gotgbot.Bot, ctx *ext.Context, toWhitelist bool)
 		flag = 1
 		successMsg = "成功将图片加入白名单"
 	}
-	if err := queries.SetMarsWhitelist(context.Background(), ctx.EffectiveChat.Id, dhash, flag); err != nil {
+	if err := queries.SetMarsWhitelist(rootCtx, q.SetMarsWhitelistParams{
+		GroupID:     ctx.EffectiveChat.Id,
+		MediaType:   int64(hash.Media),
+		HashAlgo:    int64(hash.Algo),
+		HashSize:    int64(hash.Size),
+		PicDhash:    hash.Hash,
+		InWhitelist: flag,
+	}); err != nil {
 		return err
 	}
+	indexHash(ctx.EffectiveChat.Id, hash)
+	emitMediaWhitelist(ctx, hash, toWhitelist)
 	_, err = b.SendMessage(ctx.EffectiveChat.Id, successMsg, &gotgbot.SendMessageOpts{ReplyParameters: replyTo(msg.MessageId)})
 	return err
 }
@@ -693,7 +1048,7 @@ func handleAddUserToWhitelist(b *gotgbot.Bot, ctx *ext.Context) error {
 	if ctx.EffectiveChat == nil || ctx.EffectiveUser == nil || ctx.EffectiveMessage == nil {
 		return nil
 	}
-	err := queries.AddUserToWhitelist(context.Background(), ctx.EffectiveChat.Id, ctx.EffectiveUser.Id)
+	err := queries.AddUserToWhitelist(rootCtx, ctx.EffectiveChat.Id, ctx.EffectiveUser.Id)
 	if err != nil {
 		var sqliteErr sqlite3.Error
 		if errors.As(err, &sqliteErr) && errors.Is(sqliteErr.Code, sqlite3.ErrConstraint) {
@@ -703,6 +1058,7 @@ func handleAddUserToWhitelist(b *gotgbot.Bot, ctx *ext.Context) error {
 		}
 		return err
 	}
+	emitUserWhitelist(ctx, ctx.EffectiveUser.Id, true)
 	name := ctx.EffectiveMessage.GetSender().Name()
 	_, err = b.SendMessage(ctx.EffectiveChat.Id, fmt.Sprintf("已将用户 %s 加入白名单，您发的任何图片都不会被处理。", name),
 		&gotgbot.SendMessageOpts{ReplyParameters: replyTo(ctx.EffectiveMessage.MessageId)})
@@ -713,30 +1069,72 @@ func handleRemoveUserFromWhitelist(b *gotgbot.Bot, ctx *ext.Context) error {
 	if ctx.EffectiveChat == nil || ctx.EffectiveUser == nil || ctx.EffectiveMessage == nil {
 		return nil
 	}
-	err := queries.DeleteUserFromWhitelist(context.Background(), ctx.EffectiveChat.Id, ctx.EffectiveUser.Id)
+	err := queries.DeleteUserFromWhitelist(rootCtx, ctx.EffectiveChat.Id, ctx.EffectiveUser.Id)
 	if err != nil {
 		return err
 	}
+	emitUserWhitelist(ctx, ctx.EffectiveUser.Id, false)
 	_, err = b.SendMessage(ctx.EffectiveChat.Id, fmt.Sprintf("已将用户 %s 移除本群白名单，火星车会继续为您服务。",
 		ctx.EffectiveMessage.GetSender().Name()),
 		&gotgbot.SendMessageOpts{ReplyParameters: replyTo(ctx.EffectiveMessage.MessageId)})
 	return err
 }
 
+func handleWhitelistUser(b *gotgbot.Bot, ctx *ext.Context) error {
+	return updateUserWhitelist(b, ctx, true)
+}
+
+func handleUnwhitelistUser(b *gotgbot.Bot, ctx *ext.Context) error {
+	return updateUserWhitelist(b, ctx, false)
+}
+
+// updateUserWhitelist adds or removes the user a command refers to, unlike the add_me variants which use the caller.
+func updateUserWhitelist(b *gotgbot.Bot, ctx *ext.Context, toWhitelist bool) error {
+	msg := ctx.EffectiveMessage
+	if msg == nil || ctx.EffectiveChat == nil {
+		return nil
+	}
+	reply := func(text string) error {
+		_, err := b.SendMessage(ctx.EffectiveChat.Id, text, &gotgbot.SendMessageOpts{ReplyParameters: replyTo(msg.MessageId)})
+		return err
+	}
+	userID, name, err := resolveWhitelistTarget(msg)
+	if err != nil {
+		return reply(err.Error())
+	}
+	if !toWhitelist {
+		if err := queries.DeleteUserFromWhitelist(rootCtx, ctx.EffectiveChat.Id, userID); err != nil {
+			return err
+		}
+		emitUserWhitelist(ctx, userID, false)
+		return reply(fmt.Sprintf("已将用户 %s 移出本群白名单。", name))
+	}
+	err = queries.AddUserToWhitelist(rootCtx, ctx.EffectiveChat.Id, userID)
+	if err != nil {
+		var sqliteErr sqlite3.Error
+		if errors.As(err, &sqliteErr) && errors.Is(sqliteErr.Code, sqlite3.ErrConstraint) {
+			return reply(fmt.Sprintf("用户 %s 已经在本群的白名单中。", name))
+		}
+		return err
+	}
+	emitUserWhitelist(ctx, userID, true)
+	return reply(fmt.Sprintf("已将用户 %s 加入本群白名单，TA发的任何图片都不会被处理。", name))
+}
+
 func handleBotStat(b *gotgbot.Bot, ctx *ext.Context) error {
 	if ctx.EffectiveChat == nil || ctx.EffectiveUser == nil || ctx.EffectiveMessage == nil {
 		return nil
 	}
 	start := time.Now()
-	groupCount, err := queries.CountGroups(context.Background())
+	groupCount, err := queries.CountGroups(rootCtx)
 	if err != nil {
 		groupCount = 0
 	}
-	marsCount, err := queries.GetGroupMarsCount(context.Background(), ctx.EffectiveChat.Id)
+	marsCount, err := queries.GetGroupMarsCount(rootCtx, ctx.EffectiveChat.Id)
 	if err != nil && !errors.Is(err, sql.ErrNoRows) {
 		return err
 	}
-	inWhitelist, err := isUserInWhitelist(context.Background(), ctx.EffectiveChat.Id, ctx.EffectiveUser.Id)
+	inWhitelist, err := isUserInWhitelist(rootCtx, ctx.EffectiveChat.Id, ctx.EffectiveUser.Id)
 	if err != nil {
 		return err
 	}
@@ -775,7 +1173,11 @@ func handleHelp(b *gotgbot.Bot, ctx *ext.Context) error {
 			"/remove_whitelist@botname 将图片移除白名单\n"+
 			"/add_me_to_whitelist@botname 将用户加入群组白名单\n"+
 			"/remove_me_from_whitelist@botname 将用户移出群组白名单\n"+
-			"/export@botname 导出火星车的帮助信息", "@botname", atSuffix),
+			"/whitelist_user@botname 将回复的用户或指定ID加入群组白名单(管理员)\n"+
+			"/unwhitelist_user@botname 将回复的用户或指定ID移出群组白名单(管理员)\n"+
+			"/settings@botname 查看或修改本群设置\n"+
+			"/export@botname 导出火星车的帮助信息\n"+
+			"/import@botname 回复导出的csv文件，将数据导入本群(管理员)", "@botname", atSuffix),
 		&gotgbot.SendMessageOpts{ReplyParameters: replyTo(ctx.EffectiveMessage.MessageId)})
 	return err
 }
@@ -785,6 +1187,7 @@ func handleWelcome(b *gotgbot.Bot, ctx *ext.Context) error {
 	if update == nil || update.Chat.Type == "private" {
 		return nil
 	}
+	emitChatMemberChange(update)
 	if update.Chat.Type != "channel" && update.NewChatMember.GetStatus() == "administrator" {
 		_, err := b.SendMessage(update.Chat.Id, "火星车的任何功能均不需要管理员权限，您无需将本bot设置为群组管理员。", nil)
 		return err
@@ -812,7 +1215,7 @@ func sendWelcome(bot *gotgbot.Bot, chatID int64) error {
 			"本bot为 @Ytyan 为其群组开发的重复图片检测工具\n"+
 			"当您将火星车加入群组或频道中后，火星车将自动开始工作。bot会实时检测群组中的图片，将其转换为DHASH，当检测到重复图片时，会回复图片的发送者。\n"+
 			"bot会收集并持久保存工作需要的必要信息，包括群组ID、图片唯一ID、图片DHASH和携带图片的消息的ID。bot会在必要时下载图片，但不会持久保存\n"+
-			"bot只会检查普通图片，文件形式的图片、表情包、视频等均不会被检测。\n"+
+			"bot会检查普通图片和以文件形式发送的图片，以及视频、GIF和视频消息的缩略图，表情包不会被检测。\n"+
 			`本bot为开源项目，您可以前往<a href="https://github.com/zytyan/pymarsbot">Github开源地址</a>自行克隆该项目。`,
 		&gotgbot.SendMessageOpts{ParseMode: "HTML"})
 	return err
@@ -823,6 +1226,19 @@ func handleExportData(b *gotgbot.Bot, ctx *ext.Context) error {
 		return nil
 	}
 	chatID := ctx.EffectiveChat.Id
+	format, toDM, err := parseExportArgs(ctx.Args())
+	if err != nil {
+		_, err := b.SendMessage(chatID, "用法：/ensure_marsbot_export [csv|json|sqlite] [dm]", &gotgbot.SendMessageOpts{ReplyParameters: replyTo(ctx.EffectiveMessage.MessageId)})
+		return err
+	}
+	if ctx.EffectiveUser == nil || ctx.EffectiveChat.Type == "private" {
+		toDM = false
+	}
+	if toDM {
+		if ok, err := checkRole(b, ctx, "export_dm"); err != nil || !ok {
+			return err
+		}
+	}
 
 	exportMu.Lock()
 	state, ok := exporting[chatID]
@@ -840,7 +1256,7 @@ func handleExportData(b *gotgbot.Bot, ctx *ext.Context) error {
 	exporting[chatID] = state
 	exportMu.Unlock()
 
-	filePath, err := exportChatData(chatID)
+	filePath, err := exportChatData(rootCtx, ctx.EffectiveChat, format)
 	if err != nil {
 		exportMu.Lock()
 		delete(exporting, chatID)
@@ -855,8 +1271,23 @@ func handleExportData(b *gotgbot.Bot, ctx *ext.Context) error {
 	}
 	defer f.Close()
 
-	_, err = b.SendDocument(chatID, gotgbot.InputFileByReader(filepath.Base(filePath), f),
-		&gotgbot.SendDocumentOpts{ReplyParameters: replyTo(ctx.EffectiveMessage.MessageId)})
+	if toDM {
+		_, err = b.SendDocument(ctx.EffectiveUser.Id, gotgbot.InputFileByReader(filepath.Base(filePath), f),
+			&gotgbot.SendDocumentOpts{Caption: fmt.Sprintf("群组 %s 的火星车数据", ctx.EffectiveChat.Title)})
+		if err == nil {
+			_, err = b.SendMessage(chatID, "导出的数据已私聊发送给您。", &gotgbot.SendMessageOpts{ReplyParameters: replyTo(ctx.EffectiveMessage.MessageId)})
+		} else {
+			logger.Info("send export to dm", zap.Error(err), zap.Int64("user_id", ctx.EffectiveUser.Id))
+			exportMu.Lock()
+			delete(exporting, chatID)
+			exportMu.Unlock()
+			_, err = b.SendMessage(chatID, "无法私聊发送导出的数据，请先私聊火星车并发送 /start 后再试。", &gotgbot.SendMessageOpts{ReplyParameters: replyTo(ctx.EffectiveMessage.MessageId)})
+			return err
+		}
+	} else {
+		_, err = b.SendDocument(chatID, gotgbot.InputFileByReader(filepath.Base(filePath), f),
+			&gotgbot.SendDocumentOpts{ReplyParameters: replyTo(ctx.EffectiveMessage.MessageId)})
+	}
 	if err != nil {
 		exportMu.Lock()
 		delete(exporting, chatID)
@@ -864,6 +1295,18 @@ func handleExportData(b *gotgbot.Bot, ctx *ext.Context) error {
 		return err
 	}
 
+	var size int64
+	if fi, err := f.Stat(); err == nil {
+		size = fi.Size()
+	}
+	emitEvent(eventExportDone, exportDoneEvent{
+		GroupID:  chatID,
+		Format:   string(format),
+		ToDM:     toDM,
+		Size:     size,
+		ByUserID: actorID(ctx),
+	})
+
 	exportMu.Lock()
 	state.running = false
 	state.timer = time.AfterFunc(exportCooldown, func() {
@@ -875,44 +1318,11 @@ func handleExportData(b *gotgbot.Bot, ctx *ext.Context) error {
 	return nil
 }
 
-func exportChatData(chatID int64) (string, error) {
-	rows, err := queries.ListMarsInfoByGroup(context.Background(), chatID)
-	if err != nil {
-		return "", err
-	}
-	filename := filepath.Join(os.TempDir(), fmt.Sprintf("mars-export_%d.csv", chatID))
-	file, err := os.Create(filename)
-	if err != nil {
-		return "", err
-	}
-	defer file.Close()
-
-	writer := csv.NewWriter(file)
-	defer writer.Flush()
-
-	if err := writer.Write([]string{"group_id", "pic_dhash", "count", "last_msg_id", "in_whitelist"}); err != nil {
-		return "", err
-	}
-	for _, row := range rows {
-		record := []string{
-			fmt.Sprint(row.GroupID),
-			hex.EncodeToString(row.PicDhash),
-			fmt.Sprint(row.Count),
-			fmt.Sprint(row.LastMsgID),
-			fmt.Sprint(row.InWhitelist),
-		}
-		if err := writer.Write(record); err != nil {
-			return "", err
-		}
-	}
-	return filename, nil
-}
-
 func handleExportHelp(b *gotgbot.Bot, ctx *ext.Context) error {
 	if ctx.EffectiveMessage == nil || ctx.EffectiveChat == nil {
 		return nil
 	}
-	_, err := b.SendMessage(ctx.EffectiveChat.Id, "想部署自己的火星车，又放不下当前数据？\n现在，您可以使用命令 /ensure_marsbot_export 导出火星车的数据，它们包括群组ID、DHASH值、火星数量、上一次消息ID及白名单状态\n这些信息将会被导出为csv格式，您可以在解压后放心地直接使用逗号分割。\n请注意，为避免无意义的性能消耗，每个群组在十分钟内只能导出一次。",
+	_, err := b.SendMessage(ctx.EffectiveChat.Id, "想部署自己的火星车，又放不下当前数据？\n现在，您可以使用命令 /ensure_marsbot_export 导出火星车的数据，它们包括群组ID、DHASH值、火星数量、上一次消息链接、白名单状态、白名单用户及群组设置\n导出的文件使用zstd压缩，格式可以在命令后指定：\ncsv（默认）：每张表一个csv文件，打包为tar，您可以在解压后放心地直接使用逗号分割。\njson：单个json文件。\nsqlite：只包含本群数据的火星车数据库，可以直接用于部署新的火星车。\n管理员可以在格式后加上 dm，火星车会将文件私聊发送给您，而不是发送到群组中，例如 /ensure_marsbot_export json dm\n请注意，为避免无意义的性能消耗，每个群组在十分钟内只能导出一次。\n在新的群组中，管理员回复导出的文件并使用 /import 即可导入这些数据。",
 		&gotgbot.SendMessageOpts{ReplyParameters: replyTo(ctx.EffectiveMessage.MessageId)})
 	return err
 }
@@ -928,16 +1338,22 @@ func handleFindSimilarByCallback(b *gotgbot.Bot, ctx *ext.Context) error {
 	}
 
 	start := time.Now()
-	items, err := queries.ListSimilarPhotos(context.Background(), target, ctx.EffectiveChat.Id, similarHDThreshold)
+	threshold := scaleDistance(getGroupSettings(rootCtx, ctx.EffectiveChat.Id).SimilarDistance, target.Size)
+	matches, err := searchSimilar(rootCtx, ctx.EffectiveChat.Id, target, int(threshold), similarResultLimit)
 	if err != nil {
 		return err
 	}
 	var textLines []string
-	textLines = append(textLines, fmt.Sprintf("火星车为您找到了%d张相似的图片\n这些图片的汉明距离小于%d\n耗时:%s\n",
-		len(items), similarHDThreshold, time.Since(start)))
-	for i, item := range items {
-		startLabel, endLabel := buildLabel(ctx.EffectiveChat, item.MarsInfo.LastMsgID)
-		textLines = append(textLines, fmt.Sprintf("%s图片%d: 距离: %d 消息ID: %d%s", startLabel, i+1, item.Hd, item.MarsInfo.LastMsgID, endLabel))
+	noun := target.Media.noun()
+	textLines = append(textLines, fmt.Sprintf("火星车为您找到了%d%s相似的%s\n这些%s的汉明距离小于%d\n耗时:%s\n",
+		len(matches), target.Media.measure(), noun, noun, threshold, time.Since(start)))
+	for i, m := range matches {
+		info, err := queries.GetMarsInfo(rootCtx, ctx.EffectiveChat.Id, int64(target.Media), int64(target.Algo), m.Hash)
+		if err != nil {
+			return err
+		}
+		startLabel, endLabel := buildLabel(ctx.EffectiveChat, info.LastMsgID)
+		textLines = append(textLines, fmt.Sprintf("%s%s%d: 距离: %d 消息ID: %d%s", startLabel, noun, i+1, m.Distance, info.LastMsgID, endLabel))
 	}
 	_, err = b.SendMessage(ctx.EffectiveChat.Id, strings.Join(textLines, "\n"),
 		&gotgbot.SendMessageOpts{
@@ -951,10 +1367,40 @@ func handleFindSimilarByCallback(b *gotgbot.Bot, ctx *ext.Context) error {
 	return err
 }
 
-func parseCallback(s string) ([]byte, error) {
-	parts := strings.SplitN(s, ":", 2)
-	if len(parts) != 2 {
-		return nil, errors.New("not valid callback")
+// parseCallback decodes callback data built by hashCallbackData.
+// Buttons sent before the algorithm was recorded look like "prefix:hex" and always carry a 64-bit photo dhash,
+// and ones sent before media types existed look like "prefix:algo:base64".
+func parseCallback(s string) (picHash, error) {
+	parts := strings.Split(s, ":")
+	var hash picHash
+	var err error
+	switch len(parts) {
+	case 2:
+		hash.Algo = minicv.AlgoDHash
+		hash.Hash, err = hex.DecodeString(parts[1])
+	case 3, 4:
+		algo, perr := strconv.ParseInt(parts[1], 10, 64)
+		if perr != nil || !minicv.Algo(algo).Valid() {
+			return picHash{}, errors.New("not valid callback")
+		}
+		hash.Algo = minicv.Algo(algo)
+		if len(parts) == 4 {
+			media, perr := strconv.ParseInt(parts[2], 10, 64)
+			if perr != nil || !mediaType(media).Valid() {
+				return picHash{}, errors.New("not valid callback")
+			}
+			hash.Media = mediaType(media)
+		}
+		hash.Hash, err = base64.RawURLEncoding.DecodeString(parts[len(parts)-1])
+	default:
+		return picHash{}, errors.New("not valid callback")
+	}
+	if err != nil {
+		return picHash{}, err
+	}
+	hash.Size = minicv.HashSizeForLen(len(hash.Hash))
+	if hash.Size == 0 {
+		return picHash{}, errors.New("not valid callback")
 	}
-	return hex.DecodeString(parts[1])
+	return hash, nil
 }
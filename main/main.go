@@ -1,7 +1,14 @@
 package main
 
-import "marsbot"
+import (
+	"os"
+
+	"marsbot"
+)
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "backup" {
+		os.Exit(marsbot.RunBackupCommand(os.Args[2:]))
+	}
 	marsbot.Start()
 }
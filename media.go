@@ -0,0 +1,125 @@
+package marsbot
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/PaulSonOfLars/gotgbot/v2"
+)
+
+// mediaType separates the mars_info namespaces, so a video thumbnail never matches a photo.
+// The numeric values are persisted, do not reorder them.
+type mediaType int64
+
+const (
+	mediaPhoto mediaType = iota
+	mediaVideo
+	mediaAnimation
+	mediaVideoNote
+)
+
+var mediaNames = [...]struct{ measure, noun string }{
+	mediaPhoto:     {"张", "图片"},
+	mediaVideo:     {"个", "视频"},
+	mediaAnimation: {"个", "GIF"},
+	mediaVideoNote: {"条", "视频消息"},
+}
+
+func (m mediaType) Valid() bool {
+	return m >= 0 && int(m) < len(mediaNames)
+}
+
+func (m mediaType) noun() string {
+	if !m.Valid() {
+		return mediaNames[mediaPhoto].noun
+	}
+	return mediaNames[m].noun
+}
+
+func (m mediaType) measure() string {
+	if !m.Valid() {
+		return mediaNames[mediaPhoto].measure
+	}
+	return mediaNames[m].measure
+}
+
+// parseMediaType accepts the stored numbers as well as the nouns exports write.
+func parseMediaType(s string) (mediaType, error) {
+	if n, err := strconv.ParseInt(s, 10, 64); err == nil && mediaType(n).Valid() {
+		return mediaType(n), nil
+	}
+	for i, name := range mediaNames {
+		if name.noun == s {
+			return mediaType(i), nil
+		}
+	}
+	return 0, fmt.Errorf("media_type %q 无效", s)
+}
+
+// this returns the "this photo" phrase the replies start with.
+func (m mediaType) this() string {
+	return "这" + m.measure() + m.noun()
+}
+
+// short is the colloquial form used by the louder replies.
+func (m mediaType) short() string {
+	if m == mediaPhoto {
+		return "这张图"
+	}
+	return m.this()
+}
+
+// maxImageDocumentSize bounds the images sent as files that get downloaded and decoded.
+const maxImageDocumentSize = 20 << 20
+
+// mediaFile is the picture that stands for the media of a message.
+type mediaFile struct {
+	FileId       string
+	FileUniqueId string
+	Type         mediaType
+}
+
+func photoFile(photo *gotgbot.PhotoSize, media mediaType) *mediaFile {
+	return &mediaFile{FileId: photo.FileId, FileUniqueId: photo.FileUniqueId, Type: media}
+}
+
+// isImageDocument reports whether doc is an image sent as a file that the decoders in minicv understand.
+func isImageDocument(doc *gotgbot.Document) bool {
+	if doc == nil || doc.FileSize > maxImageDocumentSize {
+		return false
+	}
+	switch strings.ToLower(doc.MimeType) {
+	case "image/jpeg", "image/png", "image/webp", "image/gif", "image/bmp", "image/x-ms-bmp":
+		return true
+	}
+	return false
+}
+
+// messageMedia returns the picture that stands for the media of msg: the largest photo size,
+// an image sent as a file, or the thumbnail Telegram generates for videos, animations and video notes.
+// Bot API updates carry no decoded first frame, and decoding the clips would need ffmpeg, so thumbnails are hashed.
+// Images sent as files share the photo namespace, so re-uploading a photo as a file is still caught.
+func messageMedia(msg *gotgbot.Message) *mediaFile {
+	if msg == nil {
+		return nil
+	}
+	switch {
+	case len(msg.Photo) > 0:
+		return photoFile(&msg.Photo[len(msg.Photo)-1], mediaPhoto)
+	case msg.Video != nil && msg.Video.Thumbnail != nil:
+		return photoFile(msg.Video.Thumbnail, mediaVideo)
+	case msg.Animation != nil && msg.Animation.Thumbnail != nil:
+		// animations also carry a Document, so they have to be matched first
+		return photoFile(msg.Animation.Thumbnail, mediaAnimation)
+	case msg.VideoNote != nil && msg.VideoNote.Thumbnail != nil:
+		return photoFile(msg.VideoNote.Thumbnail, mediaVideoNote)
+	case msg.Animation == nil && isImageDocument(msg.Document):
+		return &mediaFile{FileId: msg.Document.FileId, FileUniqueId: msg.Document.FileUniqueId, Type: mediaPhoto}
+	}
+	return nil
+}
+
+func hasHashableMedia(msg *gotgbot.Message) bool {
+	return messageMedia(msg) != nil
+}
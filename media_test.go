@@ -0,0 +1,39 @@
+package marsbot
+
+import (
+	"testing"
+
+	"github.com/PaulSonOfLars/gotgbot/v2"
+)
+
+func TestMessageMedia(t *testing.T) {
+	thumb := &gotgbot.PhotoSize{FileId: "thumb", FileUniqueId: "thumb-u"}
+	tests := []struct {
+		name string
+		msg  *gotgbot.Message
+		want *mediaFile
+	}{
+		{"photo", &gotgbot.Message{Photo: []gotgbot.PhotoSize{{FileId: "s"}, {FileId: "l", FileUniqueId: "l-u"}}},
+			&mediaFile{FileId: "l", FileUniqueId: "l-u", Type: mediaPhoto}},
+		{"video", &gotgbot.Message{Video: &gotgbot.Video{Thumbnail: thumb}},
+			&mediaFile{FileId: "thumb", FileUniqueId: "thumb-u", Type: mediaVideo}},
+		{"video without thumbnail", &gotgbot.Message{Video: &gotgbot.Video{}}, nil},
+		{"animation with document", &gotgbot.Message{
+			Animation: &gotgbot.Animation{Thumbnail: thumb},
+			Document:  &gotgbot.Document{FileId: "doc", MimeType: "image/gif"},
+		}, &mediaFile{FileId: "thumb", FileUniqueId: "thumb-u", Type: mediaAnimation}},
+		{"image document", &gotgbot.Message{Document: &gotgbot.Document{FileId: "doc", FileUniqueId: "doc-u", MimeType: "image/WEBP"}},
+			&mediaFile{FileId: "doc", FileUniqueId: "doc-u", Type: mediaPhoto}},
+		{"huge image document", &gotgbot.Message{Document: &gotgbot.Document{MimeType: "image/png", FileSize: maxImageDocumentSize + 1}}, nil},
+		{"pdf document", &gotgbot.Message{Document: &gotgbot.Document{MimeType: "application/pdf"}}, nil},
+		{"text", &gotgbot.Message{Text: "hi"}, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := messageMedia(tt.msg)
+			if (got == nil) != (tt.want == nil) || (got != nil && *got != *tt.want) {
+				t.Fatalf("messageMedia = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
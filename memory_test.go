@@ -82,10 +82,21 @@ func TestMemoryUsageManyImages(t *testing.T) {
 			t.Fatalf("dhash %s: %v", path, err)
 		}
 		fuid := filepath.ToSlash(path)
-		if err := queries.UpsertDhash(ctx, fuid, dhash[:]); err != nil {
+		if err := queries.UpsertDhash(ctx, q.UpsertDhashParams{
+			Fuid:     fuid,
+			HashAlgo: int64(minicv.AlgoDHash),
+			HashSize: minicv.DefaultHashSize,
+			Dhash:    dhash[:],
+		}); err != nil {
 			t.Fatalf("upsert dhash %s: %v", path, err)
 		}
-		if _, err := queries.IncrementMarsInfo(ctx, groupID, dhash[:], msgID); err != nil {
+		if _, err := queries.IncrementMarsInfo(ctx, q.IncrementMarsInfoParams{
+			GroupID:   groupID,
+			HashAlgo:  int64(minicv.AlgoDHash),
+			HashSize:  minicv.DefaultHashSize,
+			PicDhash:  dhash[:],
+			LastMsgID: msgID,
+		}); err != nil {
 			t.Fatalf("increment mars info %s: %v", path, err)
 		}
 		if err := queries.IncrementGroupStat(ctx, groupID); err != nil {
@@ -0,0 +1,263 @@
+package marsbot
+
+import (
+	"bufio"
+	"database/sql"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The metrics are served in the Prometheus text format at /metrics on PPROF_ADDR. They are kept in a few small
+// vectors here rather than a client library, the bot only needs counters and histograms.
+
+type metric interface {
+	writeTo(w *bufio.Writer)
+}
+
+var metricsRegistry []metric
+
+type counterVec struct {
+	name, help string
+	labels     []string
+	mu         sync.Mutex
+	values     map[string]float64
+}
+
+func newCounterVec(name, help string, labels ...string) *counterVec {
+	c := &counterVec{name: name, help: help, labels: labels, values: make(map[string]float64)}
+	if len(labels) == 0 {
+		// a single series is exported as 0 before the first increment
+		c.values[""] = 0
+	}
+	metricsRegistry = append(metricsRegistry, c)
+	return c
+}
+
+// inc adds one to the series of labelValues, given in the order of the vector's labels.
+func (c *counterVec) inc(labelValues ...string) {
+	key := seriesKey(labelValues)
+	c.mu.Lock()
+	c.values[key]++
+	c.mu.Unlock()
+}
+
+func (c *counterVec) value(labelValues ...string) float64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.values[seriesKey(labelValues)]
+}
+
+func (c *counterVec) writeTo(w *bufio.Writer) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n", c.name, c.help, c.name)
+	for _, key := range sortedKeys(c.values) {
+		fmt.Fprintf(w, "%s%s %s\n", c.name, formatLabels(c.labels, key, ""), formatFloat(c.values[key]))
+	}
+}
+
+type histogram struct {
+	counts []uint64
+	sum    float64
+	count  uint64
+}
+
+type histogramVec struct {
+	name, help string
+	labels     []string
+	buckets    []float64
+	mu         sync.Mutex
+	series     map[string]*histogram
+}
+
+func newHistogramVec(name, help string, buckets []float64, labels ...string) *histogramVec {
+	h := &histogramVec{name: name, help: help, labels: labels, buckets: buckets, series: make(map[string]*histogram)}
+	metricsRegistry = append(metricsRegistry, h)
+	return h
+}
+
+func (h *histogramVec) observe(v float64, labelValues ...string) {
+	key := seriesKey(labelValues)
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	s := h.series[key]
+	if s == nil {
+		s = &histogram{counts: make([]uint64, len(h.buckets))}
+		h.series[key] = s
+	}
+	for i, le := range h.buckets {
+		if v <= le {
+			s.counts[i]++
+		}
+	}
+	s.sum += v
+	s.count++
+}
+
+func (h *histogramVec) since(start time.Time, labelValues ...string) {
+	h.observe(time.Since(start).Seconds(), labelValues...)
+}
+
+func (h *histogramVec) writeTo(w *bufio.Writer) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", h.name, h.help, h.name)
+	keys := make([]string, 0, len(h.series))
+	for key := range h.series {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		s := h.series[key]
+		for i, le := range h.buckets {
+			fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, formatLabels(h.labels, key, formatFloat(le)), s.counts[i])
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, formatLabels(h.labels, key, "+Inf"), s.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", h.name, formatLabels(h.labels, key, ""), formatFloat(s.sum))
+		fmt.Fprintf(w, "%s_count%s %d\n", h.name, formatLabels(h.labels, key, ""), s.count)
+	}
+}
+
+func seriesKey(labelValues []string) string {
+	return strings.Join(labelValues, "\xff")
+}
+
+func sortedKeys(m map[string]float64) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// formatLabels renders the label set of a series, with an le label for histogram buckets when le is not empty.
+func formatLabels(names []string, key, le string) string {
+	var pairs []string
+	if len(names) > 0 {
+		for i, v := range strings.Split(key, "\xff") {
+			if i < len(names) {
+				pairs = append(pairs, names[i]+`="`+escapeLabel(v)+`"`)
+			}
+		}
+	}
+	if le != "" {
+		pairs = append(pairs, `le="`+le+`"`)
+	}
+	if len(pairs) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func escapeLabel(v string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(v)
+}
+
+func formatFloat(v float64) string {
+	if math.IsInf(v, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+func writeMetrics(w io.Writer) error {
+	bw := bufio.NewWriter(w)
+	for _, m := range metricsRegistry {
+		m.writeTo(bw)
+	}
+	return bw.Flush()
+}
+
+func handleMetrics(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	_ = writeMetrics(w)
+}
+
+var (
+	latencyBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10, 20}
+	queryBuckets   = []float64{.0001, .0005, .001, .0025, .005, .01, .025, .05, .1, .25, .5, 1}
+	backupBuckets  = []float64{1, 5, 15, 30, 60, 120, 300, 600, 1800}
+
+	mediaReceived = newCounterVec("marsbot_media_received_total",
+		"Hashable media seen by the bot, by media type.", "media")
+	hashCacheRequests = newCounterVec("marsbot_hash_cache_requests_total",
+		"Hash lookups by file unique id, result is hit or miss.", "result")
+	fileDownloadSeconds = newHistogramVec("marsbot_file_download_seconds",
+		"Time to fetch a media file from Telegram.", latencyBuckets)
+	hashSeconds = newHistogramVec("marsbot_hash_seconds",
+		"Time to decode and hash a media file.", latencyBuckets)
+	recordOutcomes = newCounterVec("marsbot_record_total",
+		"Results of recordMars: new, repeat, skipped, whitelisted or error.", "outcome")
+	mediaGroupSize = newHistogramVec("marsbot_media_group_size",
+		"Messages per media group.", []float64{1, 2, 3, 4, 5, 6, 7, 8, 9, 10})
+	handlerErrors = newCounterVec("marsbot_handler_errors_total",
+		"Errors returned by update handlers.")
+	handlerPanics = newCounterVec("marsbot_handler_panics_total",
+		"Panics recovered in update handlers.")
+	backupSeconds = newHistogramVec("marsbot_backup_duration_seconds",
+		"Time to make and upload a backup, kind is full or delta.", backupBuckets, "kind")
+	backupRuns = newCounterVec("marsbot_backup_runs_total",
+		"Backup runs by kind and result, ok or error.", "kind", "result")
+	queryDuration = newHistogramVec("marsbot_query_duration_seconds",
+		"Latency of database queries by query name.", queryBuckets, "query")
+	queryErrors = newCounterVec("marsbot_query_errors_total",
+		"Failed database queries by query name, a missing row is not a failure.", "query")
+	eventDeliveries = newCounterVec("marsbot_event_deliveries_total",
+		"Event webhook deliveries by event type and result, ok, failed or dropped.", "type", "result")
+)
+
+var mediaMetricNames = [...]string{
+	mediaPhoto:     "photo",
+	mediaVideo:     "video",
+	mediaAnimation: "animation",
+	mediaVideoNote: "video_note",
+}
+
+func mediaLabel(m mediaType) string {
+	if !m.Valid() {
+		return "unknown"
+	}
+	return mediaMetricNames[m]
+}
+
+// observeQuery is the q.Queries.Observe hook.
+func observeQuery(query string, duration time.Duration, err error) {
+	queryDuration.observe(duration.Seconds(), query)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		queryErrors.inc(query)
+	}
+}
+
+func recordOutcome(res marsResult, err error) string {
+	switch {
+	case err != nil:
+		return "error"
+	case res.Skipped && res.Info.InWhitelist != 0:
+		return "whitelisted"
+	case res.Skipped:
+		return "skipped"
+	case res.PrevCount == 0:
+		return "new"
+	default:
+		return "repeat"
+	}
+}
+
+// observeBackup records one backup run of kind, started at start.
+func observeBackup(kind string, start time.Time, err error) {
+	backupSeconds.since(start, kind)
+	result := "ok"
+	if err != nil {
+		result = "error"
+	}
+	backupRuns.inc(kind, result)
+}
@@ -0,0 +1,87 @@
+package marsbot
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"marsbot/minicv"
+	"marsbot/q"
+)
+
+func TestMetricsExposition(t *testing.T) {
+	c := &counterVec{name: "test_total", help: "Test counter.", labels: []string{"kind"}, values: make(map[string]float64)}
+	c.inc(`a"b`)
+	c.inc(`a"b`)
+	h := &histogramVec{name: "test_seconds", help: "Test histogram.", buckets: []float64{.1, 1}, series: make(map[string]*histogram)}
+	h.observe(.05)
+	h.observe(.5)
+	h.observe(5)
+
+	var sb strings.Builder
+	w := bufio.NewWriter(&sb)
+	c.writeTo(w)
+	h.writeTo(w)
+	w.Flush()
+	want := `# HELP test_total Test counter.
+# TYPE test_total counter
+test_total{kind="a\"b"} 2
+# HELP test_seconds Test histogram.
+# TYPE test_seconds histogram
+test_seconds_bucket{le="0.1"} 1
+test_seconds_bucket{le="1"} 2
+test_seconds_bucket{le="+Inf"} 3
+test_seconds_sum 5.55
+test_seconds_count 3
+`
+	if sb.String() != want {
+		t.Fatalf("exposition:\n%s\nwant:\n%s", sb.String(), want)
+	}
+}
+
+func TestRecordMarsOutcomes(t *testing.T) {
+	useTestDB(t)
+	ctx := context.Background()
+	const groupID = -1002
+	hash := picHash{Algo: minicv.AlgoDHash, Size: 8, Hash: []byte{1, 1, 2, 3, 5, 8, 13, 21}}
+	before := map[string]float64{}
+	for _, outcome := range []string{"new", "repeat", "skipped", "whitelisted"} {
+		before[outcome] = recordOutcomes.value(outcome)
+	}
+
+	if _, err := recordMars(ctx, groupID, 1, hash); err != nil {
+		t.Fatalf("record: %v", err)
+	}
+	if _, err := recordMars(ctx, groupID, 2, hash); err != nil {
+		t.Fatalf("record: %v", err)
+	}
+	if _, err := recordMars(ctx, groupID, 2, hash); err != nil {
+		t.Fatalf("record: %v", err)
+	}
+	if err := queries.SetMarsWhitelist(ctx, q.SetMarsWhitelistParams{
+		GroupID: groupID, MediaType: int64(hash.Media), HashAlgo: int64(hash.Algo), HashSize: int64(hash.Size),
+		PicDhash: hash.Hash, InWhitelist: 1,
+	}); err != nil {
+		t.Fatalf("whitelist: %v", err)
+	}
+	if _, err := recordMars(ctx, groupID, 3, hash); err != nil {
+		t.Fatalf("record: %v", err)
+	}
+	for outcome, n := range before {
+		if got := recordOutcomes.value(outcome) - n; got != 1 {
+			t.Errorf("%s outcomes = %v, want 1", outcome, got)
+		}
+	}
+}
+
+func TestObserveQuery(t *testing.T) {
+	before := queryErrors.value("TestQuery")
+	observeQuery("TestQuery", time.Millisecond, nil)
+	observeQuery("TestQuery", time.Millisecond, errors.New("disk I/O error"))
+	if got := queryErrors.value("TestQuery") - before; got != 1 {
+		t.Fatalf("query errors = %v, want 1", got)
+	}
+}
@@ -0,0 +1,139 @@
+package marsbot
+
+import (
+	"context"
+	"database/sql"
+	"embed"
+	"errors"
+	"fmt"
+	"io/fs"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+
+	"go.uber.org/zap"
+)
+
+//go:embed sql/migrations/*.sql
+var migrationFS embed.FS
+
+const (
+	migrationDir     = "sql/migrations"
+	schemaVersionKey = "schema_version"
+)
+
+type migration struct {
+	version int64
+	name    string
+	sql     string
+}
+
+// loadMigrations reads the embedded NNNN_name.sql files and returns them ordered by version.
+// Versions must start at 1 and have no gaps so that every database walks the same path.
+func loadMigrations() ([]migration, error) {
+	entries, err := fs.ReadDir(migrationFS, migrationDir)
+	if err != nil {
+		return nil, fmt.Errorf("read migrations: %w", err)
+	}
+	migrations := make([]migration, 0, len(entries))
+	for _, e := range entries {
+		if e.IsDir() || !strings.HasSuffix(e.Name(), ".sql") {
+			continue
+		}
+		prefix, _, ok := strings.Cut(e.Name(), "_")
+		if !ok {
+			return nil, fmt.Errorf("migration %s: missing version prefix", e.Name())
+		}
+		version, err := strconv.ParseInt(prefix, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("migration %s: bad version: %w", e.Name(), err)
+		}
+		body, err := migrationFS.ReadFile(path.Join(migrationDir, e.Name()))
+		if err != nil {
+			return nil, fmt.Errorf("read migration %s: %w", e.Name(), err)
+		}
+		migrations = append(migrations, migration{version: version, name: e.Name(), sql: string(body)})
+	}
+	sort.Slice(migrations, func(i, j int) bool { return migrations[i].version < migrations[j].version })
+	for i, m := range migrations {
+		if m.version != int64(i+1) {
+			return nil, fmt.Errorf("migration %s: expected version %d", m.name, i+1)
+		}
+	}
+	if len(migrations) == 0 {
+		return nil, errors.New("no migrations embedded")
+	}
+	return migrations, nil
+}
+
+// migrateDB brings the database up to the newest embedded schema in a single transaction.
+// It refuses to touch a database that was written by a newer binary.
+func migrateDB(ctx context.Context, db *sql.DB) error {
+	migrations, err := loadMigrations()
+	if err != nil {
+		return err
+	}
+	latest := migrations[len(migrations)-1].version
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("begin migration: %w", err)
+	}
+	defer func() {
+		_ = tx.Rollback()
+	}()
+
+	current, err := schemaVersion(ctx, tx)
+	if err != nil {
+		return err
+	}
+	if current > latest {
+		return fmt.Errorf("database schema version %d is newer than this binary supports (%d)", current, latest)
+	}
+	if current == latest {
+		return nil
+	}
+	for _, m := range migrations {
+		if m.version <= current {
+			continue
+		}
+		if _, err := tx.ExecContext(ctx, m.sql); err != nil {
+			return fmt.Errorf("apply migration %s: %w", m.name, err)
+		}
+		if logger != nil {
+			logger.Info("applied migration", zap.Int64("version", m.version), zap.String("name", m.name))
+		}
+	}
+	if _, err := tx.ExecContext(ctx, `INSERT INTO mars_stat_meta (key, value)
+VALUES (?, ?)
+ON CONFLICT(key) DO UPDATE SET value = excluded.value`, schemaVersionKey, latest); err != nil {
+		return fmt.Errorf("record schema version: %w", err)
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("commit migration: %w", err)
+	}
+	return nil
+}
+
+// schemaVersion reports the version stored in mars_stat_meta, or 0 for databases that predate it.
+func schemaVersion(ctx context.Context, tx *sql.Tx) (int64, error) {
+	var tables int64
+	err := tx.QueryRowContext(ctx,
+		"SELECT COUNT(*) FROM sqlite_master WHERE type = 'table' AND name = 'mars_stat_meta'").Scan(&tables)
+	if err != nil {
+		return 0, fmt.Errorf("inspect schema: %w", err)
+	}
+	if tables == 0 {
+		return 0, nil
+	}
+	var version int64
+	err = tx.QueryRowContext(ctx, "SELECT value FROM mars_stat_meta WHERE key = ?", schemaVersionKey).Scan(&version)
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, fmt.Errorf("read schema version: %w", err)
+	}
+	return version, nil
+}
@@ -0,0 +1,89 @@
+package marsbot
+
+import (
+	"context"
+	"database/sql"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func openTestDB(t *testing.T) *sql.DB {
+	t.Helper()
+	db, err := sql.Open(sqliteDriverName, filepath.Join(t.TempDir(), "mars.db"))
+	if err != nil {
+		t.Fatalf("open db: %v", err)
+	}
+	db.SetMaxOpenConns(1)
+	t.Cleanup(func() { _ = db.Close() })
+	return db
+}
+
+func TestMigrateFreshDatabase(t *testing.T) {
+	db := openTestDB(t)
+	ctx := context.Background()
+	if err := migrateDB(ctx, db); err != nil {
+		t.Fatalf("migrate: %v", err)
+	}
+	// running twice must be a no-op
+	if err := migrateDB(ctx, db); err != nil {
+		t.Fatalf("migrate again: %v", err)
+	}
+	migrations, err := loadMigrations()
+	if err != nil {
+		t.Fatalf("load migrations: %v", err)
+	}
+	var version int64
+	if err := db.QueryRow("SELECT value FROM mars_stat_meta WHERE key = ?", schemaVersionKey).Scan(&version); err != nil {
+		t.Fatalf("read version: %v", err)
+	}
+	if want := migrations[len(migrations)-1].version; version != want {
+		t.Fatalf("schema version = %d, want %d", version, want)
+	}
+	for _, table := range []string{"mars_info", "fuid_to_dhash", "group_user_in_whitelist", "mars_group_stat", "group_settings", "mars_region_hash"} {
+		if _, err := db.Exec("SELECT COUNT(*) FROM " + table); err != nil {
+			t.Fatalf("table %s missing: %v", table, err)
+		}
+	}
+}
+
+func TestMigrateRefusesNewerDatabase(t *testing.T) {
+	db := openTestDB(t)
+	ctx := context.Background()
+	if err := migrateDB(ctx, db); err != nil {
+		t.Fatalf("migrate: %v", err)
+	}
+	if _, err := db.Exec("UPDATE mars_stat_meta SET value = value + 1 WHERE key = ?", schemaVersionKey); err != nil {
+		t.Fatalf("bump version: %v", err)
+	}
+	err := migrateDB(ctx, db)
+	if err == nil || !strings.Contains(err.Error(), "newer than this binary") {
+		t.Fatalf("expected newer schema error, got %v", err)
+	}
+}
+
+func TestMigrateKeepsUnversionedData(t *testing.T) {
+	db := openTestDB(t)
+	ctx := context.Background()
+	// databases created before migrations were embedded only have the initial schema and no version row
+	initial, err := migrationFS.ReadFile(migrationDir + "/0001_init.sql")
+	if err != nil {
+		t.Fatalf("read initial schema: %v", err)
+	}
+	if _, err := db.Exec(string(initial)); err != nil {
+		t.Fatalf("apply initial schema: %v", err)
+	}
+	if _, err := db.Exec("INSERT INTO mars_info (group_id, pic_dhash, count, last_msg_id, in_whitelist) VALUES (-100, X'0102030405060708', 3, 42, 0)"); err != nil {
+		t.Fatalf("seed mars_info: %v", err)
+	}
+	if err := migrateDB(ctx, db); err != nil {
+		t.Fatalf("migrate: %v", err)
+	}
+	var count, algo, size, media int64
+	if err := db.QueryRow("SELECT count, hash_algo, hash_size, media_type FROM mars_info WHERE group_id = -100").Scan(&count, &algo, &size, &media); err != nil {
+		t.Fatalf("read migrated row: %v", err)
+	}
+	if count != 3 || algo != 0 || size != 8 || media != 0 {
+		t.Fatalf("migrated row = count %d algo %d size %d media %d, want 3, 0, 8 and 0", count, algo, size, media)
+	}
+}
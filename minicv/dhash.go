@@ -9,16 +9,117 @@ import "C"
 import (
 	"bytes"
 	"errors"
+	"fmt"
 	"image"
 	"image/draw"
+	_ "image/gif" // first frame only
 	_ "image/jpeg"
 	_ "image/png"
 	"math"
 	"os"
 	"unsafe"
+
+	_ "golang.org/x/image/bmp"
+	_ "golang.org/x/image/webp"
 )
 
+// Algo identifies the perceptual hash algorithm that produced a hash.
+// The numeric values are persisted, do not reorder them.
+type Algo int64
+
+const (
+	AlgoDHash Algo = iota // (N+1)xN gradient hash
+	AlgoPHash             // DCT hash over a 4Nx4N thumbnail
+	AlgoAHash             // average hash over an NxN thumbnail
+	AlgoWHash             // Haar wavelet hash over a 64x64 thumbnail
+)
+
+var algoNames = [...]string{
+	AlgoDHash: "dhash",
+	AlgoPHash: "phash",
+	AlgoAHash: "ahash",
+	AlgoWHash: "whash",
+}
+
+func (a Algo) String() string {
+	if a < 0 || int(a) >= len(algoNames) {
+		return fmt.Sprintf("algo(%d)", int64(a))
+	}
+	return algoNames[a]
+}
+
+func (a Algo) Valid() bool {
+	return a >= 0 && int(a) < len(algoNames)
+}
+
+// ParseAlgo accepts the names returned by Algo.String.
+func ParseAlgo(s string) (Algo, error) {
+	for i, name := range algoNames {
+		if name == s {
+			return Algo(i), nil
+		}
+	}
+	return 0, fmt.Errorf("unknown hash algorithm %q", s)
+}
+
+func (a *Algo) UnmarshalText(text []byte) error {
+	v, err := ParseAlgo(string(text))
+	if err != nil {
+		return err
+	}
+	*a = v
+	return nil
+}
+
+func (a Algo) MarshalText() ([]byte, error) {
+	return []byte(a.String()), nil
+}
+
 func DHashFile(path string) (out [8]byte, err error) {
+	return HashFile(path, AlgoDHash)
+}
+
+// DHashBytes computes a dhash for the provided image bytes without touching disk.
+func DHashBytes(data []byte) (out [8]byte, err error) {
+	return HashBytes(data, AlgoDHash)
+}
+
+func PHashBytes(data []byte) (out [8]byte, err error) {
+	return HashBytes(data, AlgoPHash)
+}
+
+func AHashBytes(data []byte) (out [8]byte, err error) {
+	return HashBytes(data, AlgoAHash)
+}
+
+func WHashBytes(data []byte) (out [8]byte, err error) {
+	return HashBytes(data, AlgoWHash)
+}
+
+// DefaultHashSize is the side of the bit grid used by the [8]byte helpers (64-bit hashes).
+const DefaultHashSize = 8
+
+// ValidHashSize reports whether the C core can produce a size x size bit hash.
+func ValidHashSize(size int) bool {
+	return C.mini_hash_size_valid(C.int(size)) != 0
+}
+
+// HashLen returns the number of bytes of a hash with the given grid side.
+func HashLen(size int) int {
+	return size * size / 8
+}
+
+// HashSizeForLen maps a hash length in bytes back to its grid side, or 0 if no supported size matches.
+func HashSizeForLen(n int) int {
+	for _, size := range []int{8, 16} {
+		if HashLen(size) == n {
+			return size
+		}
+	}
+	return 0
+}
+
+func HashFile(path string, algo Algo) (out [8]byte, err error) {
 	f, err := os.Open(path)
 	if err != nil {
 		return out, err
@@ -28,33 +129,68 @@ func DHashFile(path string) (out [8]byte, err error) {
 	if err != nil {
 		return out, err
 	}
-	return dhashFromImage(img)
+	hash, err := hashFromImage(img, algo, DefaultHashSize)
+	if err != nil {
+		return out, err
+	}
+	copy(out[:], hash)
+	return out, nil
 }
 
-// DHashBytes computes a dhash for the provided image bytes without touching disk.
-func DHashBytes(data []byte) (out [8]byte, err error) {
-	if len(data) == 0 {
-		return out, errors.New("empty image data")
-	}
-	img, _, err := image.Decode(bytes.NewReader(data))
+// HashBytes computes the hash selected by algo for the provided image bytes.
+func HashBytes(data []byte, algo Algo) (out [8]byte, err error) {
+	hash, err := HashBytesSize(data, algo, DefaultHashSize)
 	if err != nil {
 		return out, err
 	}
-	return dhashFromImage(img)
+	copy(out[:], hash)
+	return out, nil
 }
 
-func dhashFromImage(img image.Image) (out [8]byte, err error) {
+// HashBytesSize is HashBytes with a size x size bit grid, e.g. 16 for a 256-bit hash.
+func HashBytesSize(data []byte, algo Algo, size int) ([]byte, error) {
+	img, err := DecodeBytes(data)
+	if err != nil {
+		return nil, err
+	}
+	return hashFromImage(img, algo, size)
+}
+
+// DecodeBytes decodes any of the supported formats (JPEG, PNG, GIF, WebP and BMP),
+// for callers that compute several hashes of the same image.
+func DecodeBytes(data []byte) (image.Image, error) {
+	if len(data) == 0 {
+		return nil, errors.New("empty image data")
+	}
+	img, _, err := image.Decode(bytes.NewReader(data))
+	return img, err
+}
+
+// HashImage is HashBytesSize for an already decoded image.
+func HashImage(img image.Image, algo Algo, size int) ([]byte, error) {
+	return hashFromImage(img, algo, size)
+}
+
+// rawImage is an image laid out for the C core.
+type rawImage struct {
+	input         *C.uchar
+	width, height C.int
+	stride        C.int
+	code          C.mini_color_code
+}
+
+func prepareImage(img image.Image) (rawImage, error) {
 	if img == nil {
-		return out, errors.New("nil image")
+		return rawImage{}, errors.New("nil image")
 	}
 	bounds := img.Bounds()
 	width := bounds.Dx()
 	height := bounds.Dy()
 	if width <= 0 || height <= 0 {
-		return out, errors.New("invalid image size")
+		return rawImage{}, errors.New("invalid image size")
 	}
 	if width > math.MaxInt32/4 || height > math.MaxInt32 {
-		return out, errors.New("image too large")
+		return rawImage{}, errors.New("image too large")
 	}
 	var code C.mini_color_code = C.MINI_RGBA2GRAY
 	var input *C.uchar
@@ -75,16 +211,35 @@ func dhashFromImage(img image.Image) (out [8]byte, err error) {
 		stride = rgba.Stride
 		code = C.MINI_RGBA2GRAY
 	}
-	ret := C.mini_dhash_from_raw(
-		input,
-		C.int(width),
-		C.int(height),
-		C.int(stride),
-		(*C.uchar)(unsafe.Pointer(&out[0])),
-		code,
-	)
+	return rawImage{input: input, width: C.int(width), height: C.int(height), stride: C.int(stride), code: code}, nil
+}
+
+func hashFromImage(img image.Image, algo Algo, size int) ([]byte, error) {
+	if !algo.Valid() {
+		return nil, fmt.Errorf("unknown hash algorithm %d", int64(algo))
+	}
+	if !ValidHashSize(size) {
+		return nil, fmt.Errorf("unsupported hash size %d", size)
+	}
+	raw, err := prepareImage(img)
+	if err != nil {
+		return nil, err
+	}
+	out := make([]byte, HashLen(size))
+	outPtr := (*C.uchar)(unsafe.Pointer(&out[0]))
+	var ret C.int
+	switch algo {
+	case AlgoDHash:
+		ret = C.mini_dhash_from_raw(raw.input, raw.width, raw.height, raw.stride, outPtr, raw.code, C.int(size))
+	case AlgoPHash:
+		ret = C.mini_phash_from_raw(raw.input, raw.width, raw.height, raw.stride, outPtr, raw.code, C.int(size))
+	case AlgoAHash:
+		ret = C.mini_ahash_from_raw(raw.input, raw.width, raw.height, raw.stride, outPtr, raw.code, C.int(size))
+	case AlgoWHash:
+		ret = C.mini_whash_from_raw(raw.input, raw.width, raw.height, raw.stride, outPtr, raw.code, C.int(size))
+	}
 	if ret != 0 {
-		return out, errors.New("C function mini_dhash_from_raw failed")
+		return nil, fmt.Errorf("C function mini_%s_from_raw failed", algo)
 	}
 	return out, nil
 }
@@ -2,15 +2,19 @@ package minicv
 
 import (
 	"bytes"
+	"encoding/base64"
 	"encoding/hex"
 	"fmt"
 	"image"
+	"image/gif"
 	"image/png"
 	"os"
 	"path/filepath"
 	"runtime"
 	"testing"
 	"time"
+
+	"golang.org/x/image/bmp"
 )
 
 func loadTestImage(t *testing.T) []byte {
@@ -75,3 +79,153 @@ func TestDHashBytesNoCLibraryLeak(t *testing.T) {
 		t.Fatalf("RSS grew too much: before=%d after=%d (+%d)", before, after, after-before)
 	}
 }
+
+func testPattern(shift int, mirror bool) *image.Gray {
+	const size = 96
+	img := image.NewGray(image.Rect(0, 0, size, size))
+	for y := 0; y < size; y++ {
+		for x := 0; x < size; x++ {
+			sx := x
+			if mirror {
+				sx = size - 1 - x
+			}
+			v := sx*2 + (y*y)%37
+			if (sx-30)*(sx-30)+(y-60)*(y-60) < 300 {
+				v = 230
+			}
+			v += shift
+			if v > 255 {
+				v = 255
+			}
+			img.Pix[y*img.Stride+x] = uint8(v)
+		}
+	}
+	return img
+}
+
+func hashDistance(a, b []byte) int {
+	d := 0
+	for i := range a {
+		for x := a[i] ^ b[i]; x != 0; x &= x - 1 {
+			d++
+		}
+	}
+	return d
+}
+
+func TestHashAlgosToleratePhotometricChanges(t *testing.T) {
+	for _, size := range []int{8, 16} {
+		bits := size * size
+		for _, algo := range []Algo{AlgoDHash, AlgoPHash, AlgoAHash, AlgoWHash} {
+			t.Run(fmt.Sprintf("%s/%d", algo, size), func(t *testing.T) {
+				orig, err := hashFromImage(testPattern(0, false), algo, size)
+				if err != nil {
+					t.Fatalf("hash: %v", err)
+				}
+				if len(orig) != HashLen(size) {
+					t.Fatalf("hash length %d, want %d", len(orig), HashLen(size))
+				}
+				again, err := hashFromImage(testPattern(0, false), algo, size)
+				if err != nil {
+					t.Fatalf("hash: %v", err)
+				}
+				if !bytes.Equal(orig, again) {
+					t.Fatalf("hash not deterministic: %x vs %x", orig, again)
+				}
+				brighter, err := hashFromImage(testPattern(12, false), algo, size)
+				if err != nil {
+					t.Fatalf("hash: %v", err)
+				}
+				if d := hashDistance(orig, brighter); d > bits*6/64 {
+					t.Fatalf("brightness shift moved hash by %d bits", d)
+				}
+				mirrored, err := hashFromImage(testPattern(0, true), algo, size)
+				if err != nil {
+					t.Fatalf("hash: %v", err)
+				}
+				if d := hashDistance(orig, mirrored); d < bits/4 {
+					t.Fatalf("mirrored image only %d bits away", d)
+				}
+			})
+		}
+	}
+}
+
+func TestHashBytesSize(t *testing.T) {
+	img := loadTestImage(t)
+	small, err := HashBytes(img, AlgoDHash)
+	if err != nil {
+		t.Fatalf("HashBytes: %v", err)
+	}
+	same, err := HashBytesSize(img, AlgoDHash, DefaultHashSize)
+	if err != nil {
+		t.Fatalf("HashBytesSize: %v", err)
+	}
+	if !bytes.Equal(small[:], same) {
+		t.Fatalf("default size differs: %x vs %x", small, same)
+	}
+	big, err := HashBytesSize(img, AlgoDHash, 16)
+	if err != nil {
+		t.Fatalf("HashBytesSize(16): %v", err)
+	}
+	if len(big) != 32 {
+		t.Fatalf("256-bit hash has %d bytes", len(big))
+	}
+	for _, size := range []int{0, 4, 12, 32} {
+		if ValidHashSize(size) {
+			t.Fatalf("size %d should be rejected", size)
+		}
+		if _, err := HashBytesSize(img, AlgoDHash, size); err == nil {
+			t.Fatalf("expected error for size %d", size)
+		}
+	}
+}
+
+func TestHashBytesImageFormats(t *testing.T) {
+	img := testPattern(0, false)
+	var pngBuf, gifBuf, bmpBuf bytes.Buffer
+	if err := png.Encode(&pngBuf, img); err != nil {
+		t.Fatalf("encode png: %v", err)
+	}
+	if err := gif.Encode(&gifBuf, img, nil); err != nil {
+		t.Fatalf("encode gif: %v", err)
+	}
+	if err := bmp.Encode(&bmpBuf, img); err != nil {
+		t.Fatalf("encode bmp: %v", err)
+	}
+	want, err := HashBytesSize(pngBuf.Bytes(), AlgoDHash, DefaultHashSize)
+	if err != nil {
+		t.Fatalf("hash png: %v", err)
+	}
+	for name, data := range map[string][]byte{"gif": gifBuf.Bytes(), "bmp": bmpBuf.Bytes()} {
+		got, err := HashBytesSize(data, AlgoDHash, DefaultHashSize)
+		if err != nil {
+			t.Fatalf("hash %s: %v", name, err)
+		}
+		// gif quantizes to a palette, so allow a few bits of drift
+		if d := hashDistance(want, got); d > 4 {
+			t.Fatalf("%s hash %d bits away from png", name, d)
+		}
+	}
+
+	// 1x1 lossless webp, there is no webp encoder in the standard library or x/image
+	webp, err := base64.StdEncoding.DecodeString("UklGRhoAAABXRUJQVlA4TA0AAAAvAAAAEAcQERGIiP4HAA==")
+	if err != nil {
+		t.Fatalf("decode webp fixture: %v", err)
+	}
+	if _, err := HashBytesSize(webp, AlgoDHash, DefaultHashSize); err != nil {
+		t.Fatalf("hash webp: %v", err)
+	}
+}
+
+func TestParseAlgo(t *testing.T) {
+	for _, algo := range []Algo{AlgoDHash, AlgoPHash, AlgoAHash, AlgoWHash} {
+		got, err := ParseAlgo(algo.String())
+		if err != nil || got != algo {
+			t.Fatalf("ParseAlgo(%q) = %v, %v", algo.String(), got, err)
+		}
+	}
+	if _, err := ParseAlgo("md5"); err == nil {
+		t.Fatal("expected error for unknown algorithm")
+	}
+}
@@ -415,13 +415,14 @@ int mini_cvtcolor_u8(const uint8_t* src, int width, int height, int src_stride,
     }
 }
 
-static void mini_pack_dhash_bits(const uint8_t* img, int width, uint8_t* out_hash) {
-    // img is 8 rows of width 9 grayscale pixels.
-    memset(out_hash, 0, 8);
-    for (int y = 0; y < 8; ++y) {
+static void mini_pack_dhash_bits(const uint8_t* img, int hash_size, uint8_t* out_hash) {
+    // img is hash_size rows of width hash_size + 1 grayscale pixels.
+    int width = hash_size + 1;
+    memset(out_hash, 0, (size_t)(hash_size * hash_size) / 8);
+    for (int y = 0; y < hash_size; ++y) {
         const uint8_t* row = img + y * width;
-        for (int x = 0; x < 8; ++x) {
-            int bit_index = y * 8 + x;
+        for (int x = 0; x < hash_size; ++x) {
+            int bit_index = y * hash_size + x;
             uint8_t mask = (uint8_t)(1u << (7 - (bit_index & 7)));
             if (row[x] > row[x + 1]) {
                 out_hash[bit_index >> 3] |= mask;
@@ -430,37 +431,286 @@ static void mini_pack_dhash_bits(const uint8_t* img, int width, uint8_t* out_has
     }
 }
 
-int mini_dhash_from_raw(const uint8_t* raw, int width, int height, int stride, uint8_t* out_hash, mini_color_code code) {
-    if (!raw || !out_hash || width <= 0 || height <= 0 || stride <= 0) return -1;
+int mini_hash_size_valid(int hash_size) {
+    return hash_size == 8 || hash_size == 16;
+}
+
+// mini_gray_from_raw returns raw itself for MINI_NO_CHANGE, otherwise a malloc'd grayscale copy
+// with the same stride that the caller frees with mini_free_gray.
+static int mini_gray_from_raw(const uint8_t* raw, int width, int height, int stride,
+                              mini_color_code code, const uint8_t** out_gray) {
+    if (!raw || !out_gray || width <= 0 || height <= 0 || stride <= 0) return -1;
     if (width > INT_MAX / 4 || height > INT_MAX) return -2;
     if (stride < width) return -3;
-    const uint8_t* gray = NULL;
     if (code == MINI_NO_CHANGE) {
-        gray = raw;
-    } else {
-        size_t gray_size = (size_t)(width > stride ? width : stride) * (size_t)height;
-        if (gray_size == 0) {
-            return -4;
+        *out_gray = raw;
+        return 0;
+    }
+    size_t gray_size = (size_t)(width > stride ? width : stride) * (size_t)height;
+    if (gray_size == 0) {
+        return -4;
+    }
+    uint8_t* converted_gray = (uint8_t*)malloc(gray_size);
+    if (!converted_gray) {
+        return -5;
+    }
+
+    int rc = mini_cvtcolor_u8(raw, width, height, stride, 4, converted_gray, stride, 1, code);
+    if (rc != 0) {
+        free(converted_gray);
+        return rc;
+    }
+    *out_gray = (const uint8_t*)converted_gray;
+    return 0;
+}
+
+static void mini_free_gray(const uint8_t* raw, const uint8_t* gray) {
+    if (gray != raw) {
+        free((void*)gray);
+    }
+}
+
+static int mini_gray_resize_from_raw(const uint8_t* raw, int width, int height, int stride,
+                                     mini_color_code code, uint8_t* dst, int dst_w, int dst_h) {
+    if (!dst) return -1;
+    const uint8_t* gray = NULL;
+    int rc = mini_gray_from_raw(raw, width, height, stride, code, &gray);
+    if (rc != 0) return rc;
+    rc = mini_resize_area_u8(gray, width, height, stride, 1, dst, dst_w, dst_h, dst_w);
+    mini_free_gray(raw, gray);
+    return rc;
+}
+
+static void mini_set_hash_bit(uint8_t* out_hash, int bit_index) {
+    out_hash[bit_index >> 3] |= (uint8_t)(1u << (7 - (bit_index & 7)));
+}
+
+static int mini_cmp_float(const void* a, const void* b) {
+    float fa = *(const float*)a;
+    float fb = *(const float*)b;
+    return (fa > fb) - (fa < fb);
+}
+
+static float mini_median_f32(const float* values, int n) {
+    float sorted[MINI_MAX_HASH_BITS];
+    memcpy(sorted, values, sizeof(float) * n);
+    qsort(sorted, n, sizeof(float), mini_cmp_float);
+    if (n % 2 == 1) return sorted[n / 2];
+    return (sorted[n / 2 - 1] + sorted[n / 2]) * 0.5f;
+}
+
+static void mini_pack_threshold_bits(const float* values, int n, float threshold, uint8_t* out_hash) {
+    memset(out_hash, 0, (size_t)n / 8);
+    for (int i = 0; i < n; ++i) {
+        if (values[i] > threshold) {
+            mini_set_hash_bit(out_hash, i);
+        }
+    }
+}
+
+int mini_dhash_from_raw(const uint8_t* raw, int width, int height, int stride, uint8_t* out_hash,
+                        mini_color_code code, int hash_size) {
+    if (!out_hash || !mini_hash_size_valid(hash_size)) return -1;
+    uint8_t resized[MINI_MAX_HASH_SIZE * (MINI_MAX_HASH_SIZE + 1)];
+    int rc = mini_gray_resize_from_raw(raw, width, height, stride, code, resized, hash_size + 1, hash_size);
+    if (rc != 0) return rc;
+
+    mini_pack_dhash_bits(resized, hash_size, out_hash);
+    return 0;
+}
+
+// mini_orient_u8 writes the src image (src_w x src_h, tightly packed) transformed by orient into dst.
+// Orientations that swap the axes produce a src_h x src_w image.
+static void mini_orient_u8(const uint8_t* src, int src_w, int src_h, int orient, uint8_t* dst) {
+    int swap = orient == MINI_ORIENT_ROT90 || orient == MINI_ORIENT_ROT270 ||
+               orient == MINI_ORIENT_TRANSPOSE || orient == MINI_ORIENT_TRANSVERSE;
+    int dst_w = swap ? src_h : src_w;
+    int dst_h = swap ? src_w : src_h;
+    for (int y = 0; y < dst_h; ++y) {
+        for (int x = 0; x < dst_w; ++x) {
+            int sx = x, sy = y;
+            switch (orient) {
+            case MINI_ORIENT_ROT90:
+                sx = y;
+                sy = src_h - 1 - x;
+                break;
+            case MINI_ORIENT_ROT180:
+                sx = src_w - 1 - x;
+                sy = src_h - 1 - y;
+                break;
+            case MINI_ORIENT_ROT270:
+                sx = src_w - 1 - y;
+                sy = x;
+                break;
+            case MINI_ORIENT_FLIP_H:
+                sx = src_w - 1 - x;
+                break;
+            case MINI_ORIENT_TRANSPOSE:
+                sx = y;
+                sy = x;
+                break;
+            case MINI_ORIENT_FLIP_V:
+                sy = src_h - 1 - y;
+                break;
+            case MINI_ORIENT_TRANSVERSE:
+                sx = src_w - 1 - y;
+                sy = src_h - 1 - x;
+                break;
+            default:
+                break;
+            }
+            dst[y * dst_w + x] = src[sy * src_w + sx];
         }
-        uint8_t* converted_gray = (uint8_t*)malloc(gray_size);
-        if (!converted_gray) {
-            return -5;
+    }
+}
+
+int mini_dhash_orientations_from_raw(const uint8_t* raw, int width, int height, int stride,
+                                     uint8_t* out_hashes, mini_color_code code, int hash_size) {
+    if (!out_hashes || !mini_hash_size_valid(hash_size)) return -1;
+    const uint8_t* gray = NULL;
+    int rc = mini_gray_from_raw(raw, width, height, stride, code, &gray);
+    if (rc != 0) return rc;
+
+    // Area resizing commutes with the dihedral transforms, so the (hash_size + 1) x hash_size grid of a
+    // transformed image is the transformed grid of the image, taken from the transposed grid when the axes swap.
+    uint8_t wide[MINI_MAX_HASH_SIZE * (MINI_MAX_HASH_SIZE + 1)];
+    uint8_t tall[MINI_MAX_HASH_SIZE * (MINI_MAX_HASH_SIZE + 1)];
+    rc = mini_resize_area_u8(gray, width, height, stride, 1, wide, hash_size + 1, hash_size, hash_size + 1);
+    if (rc == 0) {
+        rc = mini_resize_area_u8(gray, width, height, stride, 1, tall, hash_size, hash_size + 1, hash_size);
+    }
+    mini_free_gray(raw, gray);
+    if (rc != 0) return rc;
+
+    const int hash_len = hash_size * hash_size / 8;
+    uint8_t oriented[MINI_MAX_HASH_SIZE * (MINI_MAX_HASH_SIZE + 1)];
+    for (int orient = 0; orient < MINI_ORIENT_COUNT; ++orient) {
+        int swap = orient == MINI_ORIENT_ROT90 || orient == MINI_ORIENT_ROT270 ||
+                   orient == MINI_ORIENT_TRANSPOSE || orient == MINI_ORIENT_TRANSVERSE;
+        if (swap) {
+            mini_orient_u8(tall, hash_size, hash_size + 1, orient, oriented);
+        } else {
+            mini_orient_u8(wide, hash_size + 1, hash_size, orient, oriented);
         }
+        mini_pack_dhash_bits(oriented, hash_size, out_hashes + orient * hash_len);
+    }
+    return 0;
+}
 
-        int rc = mini_cvtcolor_u8(raw, width, height, stride, 4, converted_gray, stride, 1, code);
-        if (rc != 0) {
-            free(converted_gray);
-            return rc;
+int mini_ahash_from_raw(const uint8_t* raw, int width, int height, int stride, uint8_t* out_hash,
+                        mini_color_code code, int hash_size) {
+    if (!out_hash || !mini_hash_size_valid(hash_size)) return -1;
+    int bits = hash_size * hash_size;
+    uint8_t resized[MINI_MAX_HASH_BITS];
+    int rc = mini_gray_resize_from_raw(raw, width, height, stride, code, resized, hash_size, hash_size);
+    if (rc != 0) return rc;
+
+    float values[MINI_MAX_HASH_BITS];
+    float sum = 0.0f;
+    for (int i = 0; i < bits; ++i) {
+        values[i] = (float)resized[i];
+        sum += values[i];
+    }
+    mini_pack_threshold_bits(values, bits, sum / (float)bits, out_hash);
+    return 0;
+}
+
+#define MINI_PHASH_FACTOR 4
+#define MINI_PI 3.14159265358979323846
+
+int mini_phash_from_raw(const uint8_t* raw, int width, int height, int stride, uint8_t* out_hash,
+                        mini_color_code code, int hash_size) {
+    if (!out_hash || !mini_hash_size_valid(hash_size)) return -1;
+    const int n = hash_size * MINI_PHASH_FACTOR;
+    const int k_max = hash_size;
+    uint8_t* resized = (uint8_t*)malloc((size_t)n * n);
+    float* cos_tab = (float*)malloc(sizeof(float) * k_max * n);
+    float* rows = (float*)malloc(sizeof(float) * n * k_max);
+    if (!resized || !cos_tab || !rows) {
+        free(resized);
+        free(cos_tab);
+        free(rows);
+        return -5;
+    }
+    int rc = mini_gray_resize_from_raw(raw, width, height, stride, code, resized, n, n);
+    if (rc != 0) {
+        free(resized);
+        free(cos_tab);
+        free(rows);
+        return rc;
+    }
+
+    // Unnormalized DCT-II (scipy.fftpack.dct default), only the hash_size lowest frequencies are needed.
+    for (int k = 0; k < k_max; ++k) {
+        for (int i = 0; i < n; ++i) {
+            cos_tab[k * n + i] = (float)cos(MINI_PI * k * (2 * i + 1) / (2.0 * n));
         }
-        gray = (const uint8_t*)converted_gray;
     }
-    uint8_t resized[8 * 9];
-    int rc = mini_resize_area_u8(gray, width, height, stride, 1, resized, 9, 8, 9);
-    if (gray != raw) {
-        free((void*)gray);
+    for (int y = 0; y < n; ++y) {
+        for (int k = 0; k < k_max; ++k) {
+            float acc = 0.0f;
+            for (int x = 0; x < n; ++x) {
+                acc += (float)resized[y * n + x] * cos_tab[k * n + x];
+            }
+            rows[y * k_max + k] = 2.0f * acc;
+        }
+    }
+    float coeffs[MINI_MAX_HASH_BITS];
+    for (int ky = 0; ky < k_max; ++ky) {
+        for (int kx = 0; kx < k_max; ++kx) {
+            float acc = 0.0f;
+            for (int y = 0; y < n; ++y) {
+                acc += rows[y * k_max + kx] * cos_tab[ky * n + y];
+            }
+            coeffs[ky * k_max + kx] = 2.0f * acc;
+        }
     }
+    int bits = hash_size * hash_size;
+    mini_pack_threshold_bits(coeffs, bits, mini_median_f32(coeffs, bits), out_hash);
+    free(resized);
+    free(cos_tab);
+    free(rows);
+    return 0;
+}
+
+#define MINI_WHASH_SCALE 64
+
+int mini_whash_from_raw(const uint8_t* raw, int width, int height, int stride, uint8_t* out_hash,
+                        mini_color_code code, int hash_size) {
+    if (!out_hash || !mini_hash_size_valid(hash_size)) return -1;
+    int n = MINI_WHASH_SCALE;
+    uint8_t resized[MINI_WHASH_SCALE * MINI_WHASH_SCALE];
+    int rc = mini_gray_resize_from_raw(raw, width, height, stride, code, resized, n, n);
     if (rc != 0) return rc;
 
-    mini_pack_dhash_bits(resized, 9, out_hash);
+    float* pixels = (float*)malloc(sizeof(float) * n * n);
+    if (!pixels) return -5;
+    float mean = 0.0f;
+    for (int i = 0; i < n * n; ++i) {
+        pixels[i] = (float)resized[i] / 255.0f;
+        mean += pixels[i];
+    }
+    mean /= (float)(n * n);
+    // Dropping the coarsest Haar LL coefficient equals removing the image mean.
+    for (int i = 0; i < n * n; ++i) {
+        pixels[i] -= mean;
+    }
+    // Haar approximation (LL) bands in place until the band is hash_size x hash_size.
+    while (n > hash_size) {
+        int half = n / 2;
+        for (int y = 0; y < half; ++y) {
+            for (int x = 0; x < half; ++x) {
+                float a = pixels[(2 * y) * n + 2 * x];
+                float b = pixels[(2 * y) * n + 2 * x + 1];
+                float c = pixels[(2 * y + 1) * n + 2 * x];
+                float d = pixels[(2 * y + 1) * n + 2 * x + 1];
+                pixels[y * half + x] = (a + b + c + d) * 0.5f;
+            }
+        }
+        n = half;
+    }
+    int bits = hash_size * hash_size;
+    mini_pack_threshold_bits(pixels, bits, mini_median_f32(pixels, bits), out_hash);
+    free(pixels);
     return 0;
 }
@@ -26,7 +26,38 @@ int mini_cvtcolor_u8(const uint8_t* src, int width, int height, int src_stride,
 int mini_resize_area_u8(const uint8_t* src, int src_w, int src_h, int src_stride,
                         int channels, uint8_t* dst, int dst_w, int dst_h, int dst_stride);
 
-int mini_dhash_from_raw(const uint8_t* raw, int width, int height, int stride, uint8_t* out_hash, mini_color_code code);
+#define MINI_MAX_HASH_SIZE 16
+#define MINI_MAX_HASH_BITS (MINI_MAX_HASH_SIZE * MINI_MAX_HASH_SIZE)
+
+// hash_size is the side of the bit grid: every function writes hash_size * hash_size / 8 bytes.
+int mini_hash_size_valid(int hash_size);
+
+int mini_dhash_from_raw(const uint8_t* raw, int width, int height, int stride, uint8_t* out_hash,
+                        mini_color_code code, int hash_size);
+int mini_phash_from_raw(const uint8_t* raw, int width, int height, int stride, uint8_t* out_hash,
+                        mini_color_code code, int hash_size);
+int mini_ahash_from_raw(const uint8_t* raw, int width, int height, int stride, uint8_t* out_hash,
+                        mini_color_code code, int hash_size);
+int mini_whash_from_raw(const uint8_t* raw, int width, int height, int stride, uint8_t* out_hash,
+                        mini_color_code code, int hash_size);
+
+// The dihedral group of the square: rotations are clockwise, and the flips mirror across the vertical (H)
+// or horizontal (V) axis. The values index the hashes written by mini_dhash_orientations_from_raw.
+typedef enum {
+    MINI_ORIENT_IDENTITY = 0,
+    MINI_ORIENT_ROT90 = 1,
+    MINI_ORIENT_ROT180 = 2,
+    MINI_ORIENT_ROT270 = 3,
+    MINI_ORIENT_FLIP_H = 4,
+    MINI_ORIENT_TRANSPOSE = 5,
+    MINI_ORIENT_FLIP_V = 6,
+    MINI_ORIENT_TRANSVERSE = 7,
+    MINI_ORIENT_COUNT = 8,
+} mini_orientation;
+
+// Writes MINI_ORIENT_COUNT consecutive dhashes, the one at MINI_ORIENT_IDENTITY equals mini_dhash_from_raw.
+int mini_dhash_orientations_from_raw(const uint8_t* raw, int width, int height, int stride,
+                                     uint8_t* out_hashes, mini_color_code code, int hash_size);
 
 #ifdef __cplusplus
 }
@@ -0,0 +1,93 @@
+package minicv
+
+/*
+#include "mini_cv.h"
+*/
+import "C"
+import (
+	"errors"
+	"fmt"
+	"image"
+	"unsafe"
+)
+
+// Orientation is one of the 8 ways to rotate or mirror an image onto itself.
+// The values match mini_orientation and index the hashes returned by HashOrientationsBytes.
+type Orientation int
+
+const (
+	OrientIdentity   Orientation = iota
+	OrientRot90                  // rotated 90° clockwise
+	OrientRot180                 // rotated 180°
+	OrientRot270                 // rotated 90° counterclockwise
+	OrientFlipH                  // mirrored left to right
+	OrientTranspose              // mirrored across the main diagonal
+	OrientFlipV                  // mirrored top to bottom
+	OrientTransverse             // mirrored across the anti-diagonal
+)
+
+// OrientationCount is the number of hashes returned by HashOrientationsBytes.
+const OrientationCount = 8
+
+var orientNames = [...]string{
+	OrientIdentity:   "identity",
+	OrientRot90:      "rot90",
+	OrientRot180:     "rot180",
+	OrientRot270:     "rot270",
+	OrientFlipH:      "flip_h",
+	OrientTranspose:  "transpose",
+	OrientFlipV:      "flip_v",
+	OrientTransverse: "transverse",
+}
+
+func (o Orientation) String() string {
+	if o < 0 || int(o) >= len(orientNames) {
+		return fmt.Sprintf("orientation(%d)", int(o))
+	}
+	return orientNames[o]
+}
+
+// Mirrored reports whether o reflects the image, the remaining orientations are pure rotations.
+func (o Orientation) Mirrored() bool {
+	return o >= OrientFlipH
+}
+
+// ErrOrientationsUnsupported is returned for algorithms that cannot hash every orientation from one grid.
+var ErrOrientationsUnsupported = errors.New("orientation hashes are only supported for dhash")
+
+// HashOrientationsBytes hashes the image in data as if it had been transformed by each Orientation.
+// The hash at OrientIdentity is the one HashBytesSize returns, and comparing an image's stored hash against
+// all eight finds copies of it that were rotated or mirrored. Only AlgoDHash is supported.
+func HashOrientationsBytes(data []byte, algo Algo, size int) ([][]byte, error) {
+	img, err := DecodeBytes(data)
+	if err != nil {
+		return nil, err
+	}
+	return HashOrientations(img, algo, size)
+}
+
+// HashOrientations is HashOrientationsBytes for an already decoded image.
+func HashOrientations(img image.Image, algo Algo, size int) ([][]byte, error) {
+	if algo != AlgoDHash {
+		return nil, ErrOrientationsUnsupported
+	}
+	if !ValidHashSize(size) {
+		return nil, fmt.Errorf("unsupported hash size %d", size)
+	}
+	raw, err := prepareImage(img)
+	if err != nil {
+		return nil, err
+	}
+	hashLen := HashLen(size)
+	buf := make([]byte, OrientationCount*hashLen)
+	ret := C.mini_dhash_orientations_from_raw(raw.input, raw.width, raw.height, raw.stride,
+		(*C.uchar)(unsafe.Pointer(&buf[0])), raw.code, C.int(size))
+	if ret != 0 {
+		return nil, errors.New("C function mini_dhash_orientations_from_raw failed")
+	}
+	out := make([][]byte, OrientationCount)
+	for i := range out {
+		out[i] = buf[i*hashLen : (i+1)*hashLen : (i+1)*hashLen]
+	}
+	return out, nil
+}
@@ -0,0 +1,78 @@
+package minicv
+
+import (
+	"bytes"
+	"image"
+	"testing"
+)
+
+// orientImage applies o to img the way mini_orient_u8 transforms the hash grid.
+func orientImage(img *image.Gray, o Orientation) *image.Gray {
+	w, h := img.Bounds().Dx(), img.Bounds().Dy()
+	swap := o == OrientRot90 || o == OrientRot270 || o == OrientTranspose || o == OrientTransverse
+	dw, dh := w, h
+	if swap {
+		dw, dh = h, w
+	}
+	out := image.NewGray(image.Rect(0, 0, dw, dh))
+	for y := 0; y < dh; y++ {
+		for x := 0; x < dw; x++ {
+			sx, sy := x, y
+			switch o {
+			case OrientRot90:
+				sx, sy = y, h-1-x
+			case OrientRot180:
+				sx, sy = w-1-x, h-1-y
+			case OrientRot270:
+				sx, sy = w-1-y, x
+			case OrientFlipH:
+				sx = w - 1 - x
+			case OrientTranspose:
+				sx, sy = y, x
+			case OrientFlipV:
+				sy = h - 1 - y
+			case OrientTransverse:
+				sx, sy = w-1-y, h-1-x
+			}
+			out.Pix[y*out.Stride+x] = img.Pix[sy*img.Stride+sx]
+		}
+	}
+	return out
+}
+
+func TestHashOrientationsMatchTransformedImages(t *testing.T) {
+	// not square, so the rotations that swap the axes are exercised
+	img := testPattern(0, false).SubImage(image.Rect(0, 0, 96, 64)).(*image.Gray)
+	for _, size := range []int{8, 16} {
+		hashes, err := HashOrientations(img, AlgoDHash, size)
+		if err != nil {
+			t.Fatalf("orientations: %v", err)
+		}
+		if len(hashes) != OrientationCount {
+			t.Fatalf("got %d hashes", len(hashes))
+		}
+		plain, err := hashFromImage(img, AlgoDHash, size)
+		if err != nil {
+			t.Fatalf("hash: %v", err)
+		}
+		if !bytes.Equal(hashes[OrientIdentity], plain) {
+			t.Fatalf("identity hash %x differs from dhash %x", hashes[OrientIdentity], plain)
+		}
+		bits := size * size
+		for o := Orientation(0); o < OrientationCount; o++ {
+			want, err := hashFromImage(orientImage(img, o), AlgoDHash, size)
+			if err != nil {
+				t.Fatalf("hash %s: %v", o, err)
+			}
+			if d := hashDistance(hashes[o], want); d > bits*3/64 {
+				t.Fatalf("size %d %s: %d bits from the transformed image's dhash", size, o, d)
+			}
+		}
+	}
+}
+
+func TestHashOrientationsUnsupportedAlgo(t *testing.T) {
+	if _, err := HashOrientations(testPattern(0, false), AlgoPHash, 8); err != ErrOrientationsUnsupported {
+		t.Fatalf("expected ErrOrientationsUnsupported, got %v", err)
+	}
+}
@@ -0,0 +1,67 @@
+package minicv
+
+import (
+	"errors"
+	"fmt"
+	"image"
+	"image/draw"
+)
+
+// Region is a fixed sub-rectangle of an image, given as fractions of its width and height.
+// Hashing the same regions of a cropped copy gives hashes close to those of the original,
+// as long as the crop only shaves a few percent off the edges.
+type Region struct {
+	X0, Y0, X1, Y1 float64
+}
+
+// Regions lists the sub-regions hashed by HashRegions. The order is persisted, only append to it.
+var Regions = [...]Region{
+	{0.25, 0.25, 0.75, 0.75}, // center half
+	{0.15, 0.15, 0.85, 0.85}, // center 70%
+	{0, 0, 0.5, 0.5},         // top left
+	{0.5, 0, 1, 0.5},         // top right
+	{0, 0.5, 0.5, 1},         // bottom left
+	{0.5, 0.5, 1, 1},         // bottom right
+}
+
+// RegionCount is the number of hashes returned by HashRegions.
+const RegionCount = len(Regions)
+
+// ErrImageTooSmall is returned by HashRegions when the regions would be smaller than the hash grid.
+var ErrImageTooSmall = errors.New("image too small for region hashes")
+
+// HashRegions hashes every entry of Regions of img with algo and size, indexed like Regions.
+func HashRegions(img image.Image, algo Algo, size int) ([][]byte, error) {
+	if img == nil {
+		return nil, errors.New("nil image")
+	}
+	if !ValidHashSize(size) {
+		return nil, fmt.Errorf("unsupported hash size %d", size)
+	}
+	bounds := img.Bounds()
+	// the smallest region is half the image, which must still cover the (size+1) x size dhash grid
+	if bounds.Dx() < 2*(size+1) || bounds.Dy() < 2*(size+1) {
+		return nil, ErrImageTooSmall
+	}
+	// convert once, the sub-images then share the pixels
+	rgba, ok := img.(*image.RGBA)
+	if !ok {
+		rgba = image.NewRGBA(bounds)
+		draw.Draw(rgba, bounds, img, bounds.Min, draw.Src)
+	}
+	out := make([][]byte, RegionCount)
+	for i, r := range Regions {
+		rect := image.Rect(
+			bounds.Min.X+int(r.X0*float64(bounds.Dx())),
+			bounds.Min.Y+int(r.Y0*float64(bounds.Dy())),
+			bounds.Min.X+int(r.X1*float64(bounds.Dx())),
+			bounds.Min.Y+int(r.Y1*float64(bounds.Dy())),
+		)
+		hash, err := hashFromImage(rgba.SubImage(rect), algo, size)
+		if err != nil {
+			return nil, fmt.Errorf("region %d: %w", i, err)
+		}
+		out[i] = hash
+	}
+	return out, nil
+}
@@ -0,0 +1,69 @@
+package minicv
+
+import (
+	"image"
+	"math"
+	"testing"
+)
+
+// photoPattern is smoother than testPattern, closer to a photo than to a texture.
+func photoPattern() *image.Gray {
+	const w, h = 160, 120
+	img := image.NewGray(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			v := 120 + 50*math.Sin(float64(x)/17) + 40*math.Cos(float64(y)/11+float64(x)/40)
+			if (x-50)*(x-50)+(y-70)*(y-70) < 400 {
+				v = 240
+			}
+			img.Pix[y*img.Stride+x] = uint8(v)
+		}
+	}
+	return img
+}
+
+func TestHashRegionsTolerateSmallCrops(t *testing.T) {
+	img := photoPattern()
+	for _, algo := range []Algo{AlgoDHash, AlgoPHash} {
+		orig, err := HashRegions(img, algo, 8)
+		if err != nil {
+			t.Fatalf("%s: regions: %v", algo, err)
+		}
+		if len(orig) != RegionCount {
+			t.Fatalf("%s: got %d regions", algo, len(orig))
+		}
+		// shave a status bar sized strip off the top
+		cropped, err := HashRegions(img.SubImage(image.Rect(0, 5, 160, 120)), algo, 8)
+		if err != nil {
+			t.Fatalf("%s: cropped regions: %v", algo, err)
+		}
+		agree := 0
+		for i := range orig {
+			if hashDistance(orig[i], cropped[i]) <= 10 {
+				agree++
+			}
+		}
+		if agree < RegionCount-1 {
+			t.Fatalf("%s: only %d of %d regions agree after a small crop", algo, agree, RegionCount)
+		}
+		other, err := HashRegions(testPattern(0, false), algo, 8)
+		if err != nil {
+			t.Fatalf("%s: other regions: %v", algo, err)
+		}
+		agree = 0
+		for i := range orig {
+			if hashDistance(orig[i], other[i]) <= 10 {
+				agree++
+			}
+		}
+		if agree > 1 {
+			t.Fatalf("%s: %d regions of an unrelated image agree", algo, agree)
+		}
+	}
+}
+
+func TestHashRegionsRejectsTinyImages(t *testing.T) {
+	if _, err := HashRegions(image.NewGray(image.Rect(0, 0, 10, 10)), AlgoDHash, 8); err != ErrImageTooSmall {
+		t.Fatalf("expected ErrImageTooSmall, got %v", err)
+	}
+}
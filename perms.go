@@ -0,0 +1,209 @@
+package marsbot
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/PaulSonOfLars/gotgbot/v2"
+	"github.com/PaulSonOfLars/gotgbot/v2/ext"
+	"github.com/PaulSonOfLars/gotgbot/v2/ext/handlers"
+	"go.uber.org/zap"
+)
+
+type role int
+
+const (
+	roleMember role = iota
+	roleAdmin
+	roleOwner
+)
+
+var roleNames = [...]string{
+	roleMember: "member",
+	roleAdmin:  "admin",
+	roleOwner:  "owner",
+}
+
+func (r role) String() string {
+	if r < 0 || int(r) >= len(roleNames) {
+		return fmt.Sprintf("role(%d)", int(r))
+	}
+	return roleNames[r]
+}
+
+func parseRole(s string) (role, error) {
+	for i, name := range roleNames {
+		if strings.EqualFold(name, s) {
+			return role(i), nil
+		}
+	}
+	return roleMember, fmt.Errorf("unknown role %q", s)
+}
+
+// defaultCommandRoles guards the commands and buttons that change what the bot detects for everyone, whitelisting
+// media included, since a single member could otherwise silence detection for the whole group. Everything else is
+// open to members. COMMAND_ROLES overrides single entries, e.g. "add_whitelist:member,wl:member" restores the open
+// behavior.
+var defaultCommandRoles = map[string]role{
+	"add_whitelist":    roleAdmin,
+	"remove_whitelist": roleAdmin,
+	"wl":               roleAdmin,
+	"settings":         roleAdmin,
+	"whitelist_user":   roleAdmin,
+	"unwhitelist_user": roleAdmin,
+	"import":           roleAdmin,
+	// the dm variant of /ensure_marsbot_export hands every table of the group, whitelisted users included,
+	// to one person in private
+	"export_dm": roleAdmin,
+}
+
+func requiredRole(cmd string) role {
+	if name, ok := config.CommandRoles[cmd]; ok {
+		r, err := parseRole(name)
+		if err == nil {
+			return r
+		}
+		logger.Warn("invalid role in COMMAND_ROLES, using default", zap.String("command", cmd), zap.Error(err))
+	}
+	return defaultCommandRoles[cmd]
+}
+
+type cachedRole struct {
+	role    role
+	expires time.Time
+}
+
+var (
+	roleCacheMu sync.Mutex
+	roleCache   = make(map[[2]int64]cachedRole)
+	// roleCacheSweep is when cachedMemberRole next drops every expired entry.
+	roleCacheSweep time.Time
+)
+
+// cachedMemberRole returns the cached role for key if it has not expired. Lookups also evict expired entries,
+// the looked up one right away and all others once per ADMIN_CACHE_TTL, so the cache does not keep every user
+// who ever ran a guarded command.
+func cachedMemberRole(key [2]int64, now time.Time) (role, bool) {
+	roleCacheMu.Lock()
+	defer roleCacheMu.Unlock()
+	if now.After(roleCacheSweep) {
+		for k, c := range roleCache {
+			if !now.Before(c.expires) {
+				delete(roleCache, k)
+			}
+		}
+		roleCacheSweep = now.Add(config.AdminCacheTTL)
+	}
+	cached, ok := roleCache[key]
+	if !ok {
+		return roleMember, false
+	}
+	if !now.Before(cached.expires) {
+		delete(roleCache, key)
+		return roleMember, false
+	}
+	return cached.role, true
+}
+
+// memberRole looks up userID in chatID through getChatMember, caching the answer for ADMIN_CACHE_TTL.
+func memberRole(b *gotgbot.Bot, chatID, userID int64) (role, error) {
+	key := [2]int64{chatID, userID}
+	now := time.Now()
+	if r, ok := cachedMemberRole(key, now); ok {
+		return r, nil
+	}
+	member, err := b.GetChatMember(chatID, userID, nil)
+	if err != nil {
+		return roleMember, fmt.Errorf("get chat member: %w", err)
+	}
+	r := roleMember
+	switch member.GetStatus() {
+	case "creator":
+		r = roleOwner
+	case "administrator":
+		r = roleAdmin
+	}
+	roleCacheMu.Lock()
+	roleCache[key] = cachedRole{role: r, expires: now.Add(config.AdminCacheTTL)}
+	roleCacheMu.Unlock()
+	return r, nil
+}
+
+// senderRole resolves the role of whoever triggered the update.
+// Private chats belong to the user, channel posts can only come from admins,
+// and anonymous admins post as the group itself. Buttons can be pressed by anyone who sees the message,
+// so callbacks are always checked against the user who pressed them.
+func senderRole(b *gotgbot.Bot, ctx *ext.Context) (role, error) {
+	chat := ctx.EffectiveChat
+	if chat == nil {
+		return roleMember, nil
+	}
+	if chat.Type == "private" {
+		return roleOwner, nil
+	}
+	if ctx.Update != nil {
+		if ctx.CallbackQuery != nil {
+			return memberRole(b, chat.Id, ctx.CallbackQuery.From.Id)
+		}
+		if ctx.ChannelPost != nil || ctx.EditedChannelPost != nil {
+			return roleAdmin, nil
+		}
+	}
+	if chat.Type == "channel" {
+		return roleMember, nil
+	}
+	sender := ctx.EffectiveSender
+	if sender == nil {
+		return roleMember, nil
+	}
+	if sender.IsAnonymousAdmin() {
+		return roleAdmin, nil
+	}
+	if sender.User == nil {
+		return roleMember, nil
+	}
+	return memberRole(b, chat.Id, sender.User.Id)
+}
+
+// requireRole wraps h so that it only runs for senders holding at least the role configured for cmd.
+func requireRole(cmd string, h handlers.Response) handlers.Response {
+	return func(b *gotgbot.Bot, ctx *ext.Context) error {
+		ok, err := checkRole(b, ctx, cmd)
+		if err != nil || !ok {
+			return err
+		}
+		return h(b, ctx)
+	}
+}
+
+// checkRole reports whether the sender holds the role configured for cmd, and tells them why not otherwise.
+// Handlers use it directly when only some variants of a command are guarded.
+func checkRole(b *gotgbot.Bot, ctx *ext.Context, cmd string) (bool, error) {
+	need := requiredRole(cmd)
+	if need == roleMember {
+		return true, nil
+	}
+	got, err := senderRole(b, ctx)
+	if err != nil {
+		return false, err
+	}
+	if got >= need {
+		return true, nil
+	}
+	text := "只有管理员可以执行该操作"
+	if need == roleOwner {
+		text = "只有群主可以执行该操作"
+	}
+	if ctx.CallbackQuery != nil {
+		_, err = ctx.CallbackQuery.Answer(b, &gotgbot.AnswerCallbackQueryOpts{Text: text, ShowAlert: true})
+		return false, err
+	}
+	if ctx.EffectiveMessage == nil {
+		return false, nil
+	}
+	_, err = b.SendMessage(ctx.EffectiveChat.Id, text,
+		&gotgbot.SendMessageOpts{ReplyParameters: replyTo(ctx.EffectiveMessage.MessageId)})
+	return false, err
+}
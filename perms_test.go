@@ -0,0 +1,128 @@
+package marsbot
+
+import (
+	"testing"
+	"time"
+
+	"github.com/PaulSonOfLars/gotgbot/v2"
+	"github.com/PaulSonOfLars/gotgbot/v2/ext"
+	"go.uber.org/zap"
+)
+
+func TestRequiredRoleOverrides(t *testing.T) {
+	prevConfig, prevLogger := config, logger
+	t.Cleanup(func() { config, logger = prevConfig, prevLogger })
+	logger = zap.NewNop()
+
+	config.CommandRoles = map[string]string{"wl": "member", "pic_info": "Owner", "stat": "nobody"}
+	cases := map[string]role{
+		"wl":               roleMember,
+		"pic_info":         roleOwner,
+		"stat":             roleMember, // invalid override falls back to the default
+		"add_whitelist":    roleAdmin,
+		"remove_whitelist": roleAdmin,
+		"settings":         roleAdmin,
+		"whitelist_user":   roleAdmin,
+		"unwhitelist_user": roleAdmin,
+		"import":           roleAdmin,
+		"help":             roleMember,
+		"export":           roleMember,
+		"export_dm":        roleAdmin,
+	}
+	for cmd, want := range cases {
+		if got := requiredRole(cmd); got != want {
+			t.Errorf("requiredRole(%q) = %s, want %s", cmd, got, want)
+		}
+	}
+}
+
+func TestSenderRoleWithoutLookup(t *testing.T) {
+	group := &gotgbot.Chat{Id: -1001, Type: "supergroup"}
+	channel := &gotgbot.Chat{Id: -1002, Type: "channel"}
+	cases := []struct {
+		name string
+		ctx  *ext.Context
+		want role
+	}{
+		{"private", &ext.Context{EffectiveChat: &gotgbot.Chat{Id: 1, Type: "private"}}, roleOwner},
+		{"channel post", &ext.Context{
+			Update:        &gotgbot.Update{ChannelPost: &gotgbot.Message{Chat: *channel}},
+			EffectiveChat: channel,
+		}, roleAdmin},
+		{"channel without post", &ext.Context{EffectiveChat: channel}, roleMember},
+		{"anonymous admin", &ext.Context{
+			EffectiveChat:   group,
+			EffectiveSender: &gotgbot.Sender{Chat: group, ChatId: group.Id},
+		}, roleAdmin},
+	}
+	for _, c := range cases {
+		got, err := senderRole(nil, c.ctx)
+		if err != nil || got != c.want {
+			t.Errorf("%s: senderRole = %s, %v; want %s", c.name, got, err, c.want)
+		}
+	}
+}
+
+func TestSenderRoleChannelCallback(t *testing.T) {
+	channel := &gotgbot.Chat{Id: -1002, Type: "channel"}
+	roleCacheMu.Lock()
+	prevCache := roleCache
+	roleCache = map[[2]int64]cachedRole{
+		{channel.Id, 42}: {role: roleMember, expires: time.Now().Add(time.Hour)},
+		{channel.Id, 43}: {role: roleAdmin, expires: time.Now().Add(time.Hour)},
+	}
+	roleCacheMu.Unlock()
+	t.Cleanup(func() {
+		roleCacheMu.Lock()
+		roleCache = prevCache
+		roleCacheMu.Unlock()
+	})
+
+	for userID, want := range map[int64]role{42: roleMember, 43: roleAdmin} {
+		ctx := &ext.Context{
+			Update:          &gotgbot.Update{CallbackQuery: &gotgbot.CallbackQuery{From: gotgbot.User{Id: userID}, Data: "wl:x"}},
+			EffectiveChat:   channel,
+			EffectiveUser:   &gotgbot.User{Id: userID},
+			EffectiveSender: &gotgbot.Sender{User: &gotgbot.User{Id: userID}},
+		}
+		got, err := senderRole(nil, ctx)
+		if err != nil || got != want {
+			t.Errorf("button pressed by %d under a channel post: senderRole = %s, %v; want %s", userID, got, err, want)
+		}
+	}
+}
+
+func TestRoleCacheEviction(t *testing.T) {
+	prevConfig := config
+	config.AdminCacheTTL = time.Minute
+	now := time.Now()
+	roleCacheMu.Lock()
+	prevCache, prevSweep := roleCache, roleCacheSweep
+	roleCache = map[[2]int64]cachedRole{
+		{1, 1}: {role: roleAdmin, expires: now.Add(time.Minute)},
+		{1, 2}: {role: roleAdmin, expires: now.Add(-time.Second)},
+		{2, 3}: {role: roleOwner, expires: now.Add(-time.Hour)},
+	}
+	roleCacheSweep = now.Add(time.Minute)
+	roleCacheMu.Unlock()
+	t.Cleanup(func() {
+		config = prevConfig
+		roleCacheMu.Lock()
+		roleCache, roleCacheSweep = prevCache, prevSweep
+		roleCacheMu.Unlock()
+	})
+
+	if r, ok := cachedMemberRole([2]int64{1, 1}, now); !ok || r != roleAdmin {
+		t.Fatalf("fresh entry = %s, %v", r, ok)
+	}
+	if _, ok := cachedMemberRole([2]int64{1, 2}, now); ok {
+		t.Fatalf("expired entry was returned")
+	}
+	if len(roleCache) != 2 {
+		t.Fatalf("looked up expired entry was kept: %v", roleCache)
+	}
+	cachedMemberRole([2]int64{9, 9}, now.Add(2*time.Minute))
+	if len(roleCache) != 0 {
+		t.Fatalf("sweep left %v", roleCache)
+	}
+}
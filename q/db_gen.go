@@ -34,6 +34,15 @@ func Prepare(ctx context.Context, db DBTX) (*Queries, error) {
 	if q.countGroupsStmt, err = db.PrepareContext(ctx, countGroups); err != nil {
 		return nil, fmt.Errorf("error preparing query CountGroups: %w", err)
 	}
+	if q.deleteGroupSettingsStmt, err = db.PrepareContext(ctx, deleteGroupSettings); err != nil {
+		return nil, fmt.Errorf("error preparing query DeleteGroupSettings: %w", err)
+	}
+	if q.deleteMarsInfoByGroupStmt, err = db.PrepareContext(ctx, deleteMarsInfoByGroup); err != nil {
+		return nil, fmt.Errorf("error preparing query DeleteMarsInfoByGroup: %w", err)
+	}
+	if q.deleteRegionHashesByGroupStmt, err = db.PrepareContext(ctx, deleteRegionHashesByGroup); err != nil {
+		return nil, fmt.Errorf("error preparing query DeleteRegionHashesByGroup: %w", err)
+	}
 	if q.deleteUserFromWhitelistStmt, err = db.PrepareContext(ctx, deleteUserFromWhitelist); err != nil {
 		return nil, fmt.Errorf("error preparing query DeleteUserFromWhitelist: %w", err)
 	}
@@ -55,21 +64,39 @@ func Prepare(ctx context.Context, db DBTX) (*Queries, error) {
 	if q.isUserInWhitelistStmt, err = db.PrepareContext(ctx, isUserInWhitelist); err != nil {
 		return nil, fmt.Errorf("error preparing query IsUserInWhitelist: %w", err)
 	}
+	if q.listGroupSettingsStmt, err = db.PrepareContext(ctx, listGroupSettings); err != nil {
+		return nil, fmt.Errorf("error preparing query ListGroupSettings: %w", err)
+	}
 	if q.listMarsInfoByGroupStmt, err = db.PrepareContext(ctx, listMarsInfoByGroup); err != nil {
 		return nil, fmt.Errorf("error preparing query ListMarsInfoByGroup: %w", err)
 	}
+	if q.listRegionHashesByGroupStmt, err = db.PrepareContext(ctx, listRegionHashesByGroup); err != nil {
+		return nil, fmt.Errorf("error preparing query ListRegionHashesByGroup: %w", err)
+	}
 	if q.listSimilarPhotosStmt, err = db.PrepareContext(ctx, listSimilarPhotos); err != nil {
 		return nil, fmt.Errorf("error preparing query ListSimilarPhotos: %w", err)
 	}
+	if q.listWhitelistUsersByGroupStmt, err = db.PrepareContext(ctx, listWhitelistUsersByGroup); err != nil {
+		return nil, fmt.Errorf("error preparing query ListWhitelistUsersByGroup: %w", err)
+	}
+	if q.refreshGroupStatStmt, err = db.PrepareContext(ctx, refreshGroupStat); err != nil {
+		return nil, fmt.Errorf("error preparing query RefreshGroupStat: %w", err)
+	}
 	if q.setMarsWhitelistStmt, err = db.PrepareContext(ctx, setMarsWhitelist); err != nil {
 		return nil, fmt.Errorf("error preparing query SetMarsWhitelist: %w", err)
 	}
 	if q.upsertDhashStmt, err = db.PrepareContext(ctx, upsertDhash); err != nil {
 		return nil, fmt.Errorf("error preparing query UpsertDhash: %w", err)
 	}
+	if q.upsertGroupSettingStmt, err = db.PrepareContext(ctx, upsertGroupSetting); err != nil {
+		return nil, fmt.Errorf("error preparing query UpsertGroupSetting: %w", err)
+	}
 	if q.upsertMarsInfoStmt, err = db.PrepareContext(ctx, upsertMarsInfo); err != nil {
 		return nil, fmt.Errorf("error preparing query UpsertMarsInfo: %w", err)
 	}
+	if q.upsertRegionHashStmt, err = db.PrepareContext(ctx, upsertRegionHash); err != nil {
+		return nil, fmt.Errorf("error preparing query UpsertRegionHash: %w", err)
+	}
 	return &q, nil
 }
 
@@ -85,6 +112,21 @@ func (q *Queries) Close() error {
 			err = fmt.Errorf("error closing countGroupsStmt: %w", cerr)
 		}
 	}
+	if q.deleteGroupSettingsStmt != nil {
+		if cerr := q.deleteGroupSettingsStmt.Close(); cerr != nil {
+			err = fmt.Errorf("error closing deleteGroupSettingsStmt: %w", cerr)
+		}
+	}
+	if q.deleteMarsInfoByGroupStmt != nil {
+		if cerr := q.deleteMarsInfoByGroupStmt.Close(); cerr != nil {
+			err = fmt.Errorf("error closing deleteMarsInfoByGroupStmt: %w", cerr)
+		}
+	}
+	if q.deleteRegionHashesByGroupStmt != nil {
+		if cerr := q.deleteRegionHashesByGroupStmt.Close(); cerr != nil {
+			err = fmt.Errorf("error closing deleteRegionHashesByGroupStmt: %w", cerr)
+		}
+	}
 	if q.deleteUserFromWhitelistStmt != nil {
 		if cerr := q.deleteUserFromWhitelistStmt.Close(); cerr != nil {
 			err = fmt.Errorf("error closing deleteUserFromWhitelistStmt: %w", cerr)
@@ -120,16 +162,36 @@ func (q *Queries) Close() error {
 			err = fmt.Errorf("error closing isUserInWhitelistStmt: %w", cerr)
 		}
 	}
+	if q.listGroupSettingsStmt != nil {
+		if cerr := q.listGroupSettingsStmt.Close(); cerr != nil {
+			err = fmt.Errorf("error closing listGroupSettingsStmt: %w", cerr)
+		}
+	}
 	if q.listMarsInfoByGroupStmt != nil {
 		if cerr := q.listMarsInfoByGroupStmt.Close(); cerr != nil {
 			err = fmt.Errorf("error closing listMarsInfoByGroupStmt: %w", cerr)
 		}
 	}
+	if q.listRegionHashesByGroupStmt != nil {
+		if cerr := q.listRegionHashesByGroupStmt.Close(); cerr != nil {
+			err = fmt.Errorf("error closing listRegionHashesByGroupStmt: %w", cerr)
+		}
+	}
 	if q.listSimilarPhotosStmt != nil {
 		if cerr := q.listSimilarPhotosStmt.Close(); cerr != nil {
 			err = fmt.Errorf("error closing listSimilarPhotosStmt: %w", cerr)
 		}
 	}
+	if q.listWhitelistUsersByGroupStmt != nil {
+		if cerr := q.listWhitelistUsersByGroupStmt.Close(); cerr != nil {
+			err = fmt.Errorf("error closing listWhitelistUsersByGroupStmt: %w", cerr)
+		}
+	}
+	if q.refreshGroupStatStmt != nil {
+		if cerr := q.refreshGroupStatStmt.Close(); cerr != nil {
+			err = fmt.Errorf("error closing refreshGroupStatStmt: %w", cerr)
+		}
+	}
 	if q.setMarsWhitelistStmt != nil {
 		if cerr := q.setMarsWhitelistStmt.Close(); cerr != nil {
 			err = fmt.Errorf("error closing setMarsWhitelistStmt: %w", cerr)
@@ -140,11 +202,21 @@ func (q *Queries) Close() error {
 			err = fmt.Errorf("error closing upsertDhashStmt: %w", cerr)
 		}
 	}
+	if q.upsertGroupSettingStmt != nil {
+		if cerr := q.upsertGroupSettingStmt.Close(); cerr != nil {
+			err = fmt.Errorf("error closing upsertGroupSettingStmt: %w", cerr)
+		}
+	}
 	if q.upsertMarsInfoStmt != nil {
 		if cerr := q.upsertMarsInfoStmt.Close(); cerr != nil {
 			err = fmt.Errorf("error closing upsertMarsInfoStmt: %w", cerr)
 		}
 	}
+	if q.upsertRegionHashStmt != nil {
+		if cerr := q.upsertRegionHashStmt.Close(); cerr != nil {
+			err = fmt.Errorf("error closing upsertRegionHashStmt: %w", cerr)
+		}
+	}
 	return err
 }
 
@@ -182,61 +254,85 @@ func (q *Queries) queryRow(ctx context.Context, stmt *sql.Stmt, query string, ar
 }
 
 type Queries struct {
-	db                          DBTX
-	logger                      *zap.Logger
-	SlowQueryThreshold          time.Duration
-	txID                        string
-	LogRawSqlString             bool
-	LogArgument                 bool
-	tx                          *sql.Tx
-	addUserToWhitelistStmt      *sql.Stmt
-	countGroupsStmt             *sql.Stmt
-	deleteUserFromWhitelistStmt *sql.Stmt
-	getDhashFromFileUidStmt     *sql.Stmt
-	getGroupMarsCountStmt       *sql.Stmt
-	getMarsInfoStmt             *sql.Stmt
-	incrementGroupStatStmt      *sql.Stmt
-	incrementMarsInfoStmt       *sql.Stmt
-	isUserInWhitelistStmt       *sql.Stmt
-	listMarsInfoByGroupStmt     *sql.Stmt
-	listSimilarPhotosStmt       *sql.Stmt
-	setMarsWhitelistStmt        *sql.Stmt
-	upsertDhashStmt             *sql.Stmt
-	upsertMarsInfoStmt          *sql.Stmt
+	db                 DBTX
+	logger             *zap.Logger
+	SlowQueryThreshold time.Duration
+	txID               string
+	LogRawSqlString    bool
+	LogArgument        bool
+	// Observe, when set, is called with the name, duration and error of every query, e.g. to export metrics.
+	Observe                       func(query string, duration time.Duration, err error)
+	tx                            *sql.Tx
+	addUserToWhitelistStmt        *sql.Stmt
+	countGroupsStmt               *sql.Stmt
+	deleteGroupSettingsStmt       *sql.Stmt
+	deleteMarsInfoByGroupStmt     *sql.Stmt
+	deleteRegionHashesByGroupStmt *sql.Stmt
+	deleteUserFromWhitelistStmt   *sql.Stmt
+	getDhashFromFileUidStmt       *sql.Stmt
+	getGroupMarsCountStmt         *sql.Stmt
+	getMarsInfoStmt               *sql.Stmt
+	incrementGroupStatStmt        *sql.Stmt
+	incrementMarsInfoStmt         *sql.Stmt
+	isUserInWhitelistStmt         *sql.Stmt
+	listGroupSettingsStmt         *sql.Stmt
+	listMarsInfoByGroupStmt       *sql.Stmt
+	listRegionHashesByGroupStmt   *sql.Stmt
+	listSimilarPhotosStmt         *sql.Stmt
+	listWhitelistUsersByGroupStmt *sql.Stmt
+	refreshGroupStatStmt          *sql.Stmt
+	setMarsWhitelistStmt          *sql.Stmt
+	upsertDhashStmt               *sql.Stmt
+	upsertGroupSettingStmt        *sql.Stmt
+	upsertMarsInfoStmt            *sql.Stmt
+	upsertRegionHashStmt          *sql.Stmt
 }
 
 func (q *Queries) WithTx(tx *sql.Tx) *Queries {
 	return &Queries{
-		db:                          tx,
-		logger:                      q.logger,
-		SlowQueryThreshold:          q.SlowQueryThreshold,
-		txID:                        fmt.Sprintf("%p", tx),
-		LogRawSqlString:             q.LogRawSqlString,
-		LogArgument:                 q.LogArgument,
-		tx:                          tx,
-		addUserToWhitelistStmt:      q.addUserToWhitelistStmt,
-		countGroupsStmt:             q.countGroupsStmt,
-		deleteUserFromWhitelistStmt: q.deleteUserFromWhitelistStmt,
-		getDhashFromFileUidStmt:     q.getDhashFromFileUidStmt,
-		getGroupMarsCountStmt:       q.getGroupMarsCountStmt,
-		getMarsInfoStmt:             q.getMarsInfoStmt,
-		incrementGroupStatStmt:      q.incrementGroupStatStmt,
-		incrementMarsInfoStmt:       q.incrementMarsInfoStmt,
-		isUserInWhitelistStmt:       q.isUserInWhitelistStmt,
-		listMarsInfoByGroupStmt:     q.listMarsInfoByGroupStmt,
-		listSimilarPhotosStmt:       q.listSimilarPhotosStmt,
-		setMarsWhitelistStmt:        q.setMarsWhitelistStmt,
-		upsertDhashStmt:             q.upsertDhashStmt,
-		upsertMarsInfoStmt:          q.upsertMarsInfoStmt,
+		db:                            tx,
+		logger:                        q.logger,
+		SlowQueryThreshold:            q.SlowQueryThreshold,
+		txID:                          fmt.Sprintf("%p", tx),
+		LogRawSqlString:               q.LogRawSqlString,
+		LogArgument:                   q.LogArgument,
+		Observe:                       q.Observe,
+		tx:                            tx,
+		addUserToWhitelistStmt:        q.addUserToWhitelistStmt,
+		countGroupsStmt:               q.countGroupsStmt,
+		deleteGroupSettingsStmt:       q.deleteGroupSettingsStmt,
+		deleteMarsInfoByGroupStmt:     q.deleteMarsInfoByGroupStmt,
+		deleteRegionHashesByGroupStmt: q.deleteRegionHashesByGroupStmt,
+		deleteUserFromWhitelistStmt:   q.deleteUserFromWhitelistStmt,
+		getDhashFromFileUidStmt:       q.getDhashFromFileUidStmt,
+		getGroupMarsCountStmt:         q.getGroupMarsCountStmt,
+		getMarsInfoStmt:               q.getMarsInfoStmt,
+		incrementGroupStatStmt:        q.incrementGroupStatStmt,
+		incrementMarsInfoStmt:         q.incrementMarsInfoStmt,
+		isUserInWhitelistStmt:         q.isUserInWhitelistStmt,
+		listGroupSettingsStmt:         q.listGroupSettingsStmt,
+		listMarsInfoByGroupStmt:       q.listMarsInfoByGroupStmt,
+		listRegionHashesByGroupStmt:   q.listRegionHashesByGroupStmt,
+		listSimilarPhotosStmt:         q.listSimilarPhotosStmt,
+		listWhitelistUsersByGroupStmt: q.listWhitelistUsersByGroupStmt,
+		refreshGroupStatStmt:          q.refreshGroupStatStmt,
+		setMarsWhitelistStmt:          q.setMarsWhitelistStmt,
+		upsertDhashStmt:               q.upsertDhashStmt,
+		upsertGroupSettingStmt:        q.upsertGroupSettingStmt,
+		upsertMarsInfoStmt:            q.upsertMarsInfoStmt,
+		upsertRegionHashStmt:          q.upsertRegionHashStmt,
 	}
 }
 
 func (q *Queries) logQuery(sqlString, query string, params []zap.Field, err error, start time.Time) {
+	duration := time.Since(start)
+	if q.Observe != nil {
+		q.Observe(query, duration, err)
+	}
 	if q.logger == nil {
 		return
 	}
 
-	duration := time.Since(start)
 	fields := make([]zap.Field, 0, len(params)+4)
 	fields = append(fields,
 		zap.Time("ts", start),
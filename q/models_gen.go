@@ -5,8 +5,18 @@
 package q
 
 type FuidToDhash struct {
-	Fuid  string `json:"fuid"`
-	Dhash []byte `json:"dhash"`
+	Fuid         string `json:"fuid"`
+	Dhash        []byte `json:"dhash"`
+	HashAlgo     int64  `json:"hash_algo"`
+	HashSize     int64  `json:"hash_size"`
+	Orientations []byte `json:"orientations"`
+	Regions      []byte `json:"regions"`
+}
+
+type GroupSetting struct {
+	GroupID int64  `json:"group_id"`
+	Key     string `json:"key"`
+	Value   int64  `json:"value"`
 }
 
 type GroupUserInWhitelist struct {
@@ -25,6 +35,18 @@ type MarsInfo struct {
 	Count       int64  `json:"count"`
 	LastMsgID   int64  `json:"last_msg_id"`
 	InWhitelist int64  `json:"in_whitelist"`
+	HashAlgo    int64  `json:"hash_algo"`
+	HashSize    int64  `json:"hash_size"`
+	MediaType   int64  `json:"media_type"`
+}
+
+type MarsRegionHash struct {
+	GroupID    int64  `json:"group_id"`
+	MediaType  int64  `json:"media_type"`
+	HashAlgo   int64  `json:"hash_algo"`
+	PicDhash   []byte `json:"pic_dhash"`
+	Region     int64  `json:"region"`
+	RegionHash []byte `json:"region_hash"`
 }
 
 type MarsStatMetum struct {
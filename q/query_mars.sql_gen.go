@@ -60,6 +60,81 @@ func (q *Queries) CountGroups(ctx context.Context) (int64, error) {
 	return count, err
 }
 
+const deleteGroupSettings = `-- name: DeleteGroupSettings :exec
+DELETE
+FROM group_settings
+WHERE group_id = ?
+`
+
+func (q *Queries) DeleteGroupSettings(ctx context.Context, groupID int64) error {
+	var logFields []zap.Field
+	var start time.Time
+	if q.logger != nil {
+		logFields = make([]zap.Field, 0, 8)
+		start = time.Now()
+		if q.LogArgument {
+			logFields = append(logFields,
+				zap.Dict("fields",
+					zap.Int64("group_id", groupID),
+				),
+			)
+		}
+	}
+	_, err := q.exec(ctx, q.deleteGroupSettingsStmt, deleteGroupSettings, groupID)
+	q.logQuery(deleteGroupSettings, "DeleteGroupSettings", logFields, err, start)
+	return err
+}
+
+const deleteMarsInfoByGroup = `-- name: DeleteMarsInfoByGroup :exec
+DELETE
+FROM mars_info
+WHERE group_id = ?
+`
+
+func (q *Queries) DeleteMarsInfoByGroup(ctx context.Context, groupID int64) error {
+	var logFields []zap.Field
+	var start time.Time
+	if q.logger != nil {
+		logFields = make([]zap.Field, 0, 8)
+		start = time.Now()
+		if q.LogArgument {
+			logFields = append(logFields,
+				zap.Dict("fields",
+					zap.Int64("group_id", groupID),
+				),
+			)
+		}
+	}
+	_, err := q.exec(ctx, q.deleteMarsInfoByGroupStmt, deleteMarsInfoByGroup, groupID)
+	q.logQuery(deleteMarsInfoByGroup, "DeleteMarsInfoByGroup", logFields, err, start)
+	return err
+}
+
+const deleteRegionHashesByGroup = `-- name: DeleteRegionHashesByGroup :exec
+DELETE
+FROM mars_region_hash
+WHERE group_id = ?
+`
+
+func (q *Queries) DeleteRegionHashesByGroup(ctx context.Context, groupID int64) error {
+	var logFields []zap.Field
+	var start time.Time
+	if q.logger != nil {
+		logFields = make([]zap.Field, 0, 8)
+		start = time.Now()
+		if q.LogArgument {
+			logFields = append(logFields,
+				zap.Dict("fields",
+					zap.Int64("group_id", groupID),
+				),
+			)
+		}
+	}
+	_, err := q.exec(ctx, q.deleteRegionHashesByGroupStmt, deleteRegionHashesByGroup, groupID)
+	q.logQuery(deleteRegionHashesByGroup, "DeleteRegionHashesByGroup", logFields, err, start)
+	return err
+}
+
 const deleteUserFromWhitelist = `-- name: DeleteUserFromWhitelist :exec
 DELETE
 FROM group_user_in_whitelist
@@ -88,12 +163,20 @@ func (q *Queries) DeleteUserFromWhitelist(ctx context.Context, groupID int64, us
 }
 
 const getDhashFromFileUid = `-- name: GetDhashFromFileUid :one
-SELECT dhash
+SELECT dhash, orientations, regions
 FROM fuid_to_dhash
 WHERE fuid = ?
+  AND hash_algo = ?
+  AND hash_size = ?
 `
 
-func (q *Queries) GetDhashFromFileUid(ctx context.Context, fuid string) ([]byte, error) {
+type GetDhashFromFileUidRow struct {
+	Dhash        []byte `json:"dhash"`
+	Orientations []byte `json:"orientations"`
+	Regions      []byte `json:"regions"`
+}
+
+func (q *Queries) GetDhashFromFileUid(ctx context.Context, fuid string, hashAlgo int64, hashSize int64) (GetDhashFromFileUidRow, error) {
 	var logFields []zap.Field
 	var start time.Time
 	if q.logger != nil {
@@ -103,15 +186,17 @@ func (q *Queries) GetDhashFromFileUid(ctx context.Context, fuid string) ([]byte,
 			logFields = append(logFields,
 				zap.Dict("fields",
 					zap.String("fuid", fuid),
+					zap.Int64("hash_algo", hashAlgo),
+					zap.Int64("hash_size", hashSize),
 				),
 			)
 		}
 	}
-	row := q.queryRow(ctx, q.getDhashFromFileUidStmt, getDhashFromFileUid, fuid)
-	var dhash []byte
-	err := row.Scan(&dhash)
+	row := q.queryRow(ctx, q.getDhashFromFileUidStmt, getDhashFromFileUid, fuid, hashAlgo, hashSize)
+	var i GetDhashFromFileUidRow
+	err := row.Scan(&i.Dhash, &i.Orientations, &i.Regions)
 	q.logQuery(getDhashFromFileUid, "GetDhashFromFileUid", logFields, err, start)
-	return dhash, err
+	return i, err
 }
 
 const getGroupMarsCount = `-- name: GetGroupMarsCount :one
@@ -142,13 +227,15 @@ func (q *Queries) GetGroupMarsCount(ctx context.Context, groupID int64) (int64,
 }
 
 const getMarsInfo = `-- name: GetMarsInfo :one
-SELECT group_id, pic_dhash, count, last_msg_id, in_whitelist
+SELECT group_id, pic_dhash, count, last_msg_id, in_whitelist, hash_algo, hash_size, media_type
 FROM mars_info
 WHERE group_id = ?
+  AND media_type = ?
+  AND hash_algo = ?
   AND pic_dhash = ?
 `
 
-func (q *Queries) GetMarsInfo(ctx context.Context, groupID int64, picDhash []byte) (MarsInfo, error) {
+func (q *Queries) GetMarsInfo(ctx context.Context, groupID int64, mediaType int64, hashAlgo int64, picDhash []byte) (MarsInfo, error) {
 	var logFields []zap.Field
 	var start time.Time
 	if q.logger != nil {
@@ -158,12 +245,14 @@ func (q *Queries) GetMarsInfo(ctx context.Context, groupID int64, picDhash []byt
 			logFields = append(logFields,
 				zap.Dict("fields",
 					zap.Int64("group_id", groupID),
+					zap.Int64("media_type", mediaType),
+					zap.Int64("hash_algo", hashAlgo),
 					zap.ByteString("pic_dhash", picDhash),
 				),
 			)
 		}
 	}
-	row := q.queryRow(ctx, q.getMarsInfoStmt, getMarsInfo, groupID, picDhash)
+	row := q.queryRow(ctx, q.getMarsInfoStmt, getMarsInfo, groupID, mediaType, hashAlgo, picDhash)
 	var i MarsInfo
 	err := row.Scan(
 		&i.GroupID,
@@ -171,6 +260,9 @@ func (q *Queries) GetMarsInfo(ctx context.Context, groupID int64, picDhash []byt
 		&i.Count,
 		&i.LastMsgID,
 		&i.InWhitelist,
+		&i.HashAlgo,
+		&i.HashSize,
+		&i.MediaType,
 	)
 	q.logQuery(getMarsInfo, "GetMarsInfo", logFields, err, start)
 	return i, err
@@ -202,18 +294,30 @@ func (q *Queries) IncrementGroupStat(ctx context.Context, groupID int64) error {
 }
 
 const incrementMarsInfo = `-- name: IncrementMarsInfo :one
-INSERT INTO mars_info (group_id, pic_dhash, count, last_msg_id, in_whitelist)
-VALUES (?, ?, 1, ?, 0)
-ON CONFLICT(group_id, pic_dhash) DO UPDATE SET count       = count + 1,
-                                               last_msg_id = excluded.last_msg_id
+INSERT INTO mars_info (group_id, media_type, hash_algo, hash_size, pic_dhash, count, last_msg_id, in_whitelist)
+VALUES (?, ?, ?, ?, ?, 1, ?, 0)
+ON CONFLICT(group_id, media_type, hash_algo, pic_dhash) DO UPDATE SET count       = count + 1,
+                                                                      last_msg_id = excluded.last_msg_id
 RETURNING group_id,
     pic_dhash,
     count,
     last_msg_id,
-    in_whitelist
+    in_whitelist,
+    hash_algo,
+    hash_size,
+    media_type
 `
 
-func (q *Queries) IncrementMarsInfo(ctx context.Context, groupID int64, picDhash []byte, lastMsgID int64) (MarsInfo, error) {
+type IncrementMarsInfoParams struct {
+	GroupID   int64  `json:"group_id"`
+	MediaType int64  `json:"media_type"`
+	HashAlgo  int64  `json:"hash_algo"`
+	HashSize  int64  `json:"hash_size"`
+	PicDhash  []byte `json:"pic_dhash"`
+	LastMsgID int64  `json:"last_msg_id"`
+}
+
+func (q *Queries) IncrementMarsInfo(ctx context.Context, arg IncrementMarsInfoParams) (MarsInfo, error) {
 	var logFields []zap.Field
 	var start time.Time
 	if q.logger != nil {
@@ -222,14 +326,24 @@ func (q *Queries) IncrementMarsInfo(ctx context.Context, groupID int64, picDhash
 		if q.LogArgument {
 			logFields = append(logFields,
 				zap.Dict("fields",
-					zap.Int64("group_id", groupID),
-					zap.ByteString("pic_dhash", picDhash),
-					zap.Int64("last_msg_id", lastMsgID),
+					zap.Int64("group_id", arg.GroupID),
+					zap.Int64("media_type", arg.MediaType),
+					zap.Int64("hash_algo", arg.HashAlgo),
+					zap.Int64("hash_size", arg.HashSize),
+					zap.ByteString("pic_dhash", arg.PicDhash),
+					zap.Int64("last_msg_id", arg.LastMsgID),
 				),
 			)
 		}
 	}
-	row := q.queryRow(ctx, q.incrementMarsInfoStmt, incrementMarsInfo, groupID, picDhash, lastMsgID)
+	row := q.queryRow(ctx, q.incrementMarsInfoStmt, incrementMarsInfo,
+		arg.GroupID,
+		arg.MediaType,
+		arg.HashAlgo,
+		arg.HashSize,
+		arg.PicDhash,
+		arg.LastMsgID,
+	)
 	var i MarsInfo
 	err := row.Scan(
 		&i.GroupID,
@@ -237,6 +351,9 @@ func (q *Queries) IncrementMarsInfo(ctx context.Context, groupID int64, picDhash
 		&i.Count,
 		&i.LastMsgID,
 		&i.InWhitelist,
+		&i.HashAlgo,
+		&i.HashSize,
+		&i.MediaType,
 	)
 	q.logQuery(incrementMarsInfo, "IncrementMarsInfo", logFields, err, start)
 	return i, err
@@ -268,8 +385,58 @@ func (q *Queries) IsUserInWhitelist(ctx context.Context, groupID int64, userID i
 	return column_1, err
 }
 
+const listGroupSettings = `-- name: ListGroupSettings :many
+SELECT key, value
+FROM group_settings
+WHERE group_id = ?
+`
+
+type ListGroupSettingsRow struct {
+	Key   string `json:"key"`
+	Value int64  `json:"value"`
+}
+
+func (q *Queries) ListGroupSettings(ctx context.Context, groupID int64) ([]ListGroupSettingsRow, error) {
+	var logFields []zap.Field
+	var start time.Time
+	if q.logger != nil {
+		logFields = make([]zap.Field, 0, 8)
+		start = time.Now()
+		if q.LogArgument {
+			logFields = append(logFields,
+				zap.Dict("fields",
+					zap.Int64("group_id", groupID),
+				),
+			)
+		}
+	}
+	rows, err := q.query(ctx, q.listGroupSettingsStmt, listGroupSettings, groupID)
+	defer func() {
+		q.logQuery(listGroupSettings, "ListGroupSettings", logFields, err, start)
+	}()
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var items []ListGroupSettingsRow
+	for rows.Next() {
+		var i ListGroupSettingsRow
+		if err = rows.Scan(&i.Key, &i.Value); err != nil {
+			return nil, err
+		}
+		items = append(items, i)
+	}
+	if err = rows.Close(); err != nil {
+		return nil, err
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
 const listMarsInfoByGroup = `-- name: ListMarsInfoByGroup :many
-SELECT group_id, pic_dhash, count, last_msg_id, in_whitelist
+SELECT group_id, pic_dhash, count, last_msg_id, in_whitelist, hash_algo, hash_size, media_type
 FROM mars_info
 WHERE group_id = ?
 `
@@ -305,6 +472,73 @@ func (q *Queries) ListMarsInfoByGroup(ctx context.Context, groupID int64) ([]Mar
 			&i.Count,
 			&i.LastMsgID,
 			&i.InWhitelist,
+			&i.HashAlgo,
+			&i.HashSize,
+			&i.MediaType,
+		); err != nil {
+			return nil, err
+		}
+		items = append(items, i)
+	}
+	if err = rows.Close(); err != nil {
+		return nil, err
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+const listRegionHashesByGroup = `-- name: ListRegionHashesByGroup :many
+SELECT r.media_type, r.hash_algo, m.hash_size, r.pic_dhash, r.region, r.region_hash
+FROM mars_region_hash r
+         JOIN mars_info m
+              ON m.group_id = r.group_id AND m.media_type = r.media_type AND m.hash_algo = r.hash_algo AND
+                 m.pic_dhash = r.pic_dhash
+WHERE r.group_id = ?
+`
+
+type ListRegionHashesByGroupRow struct {
+	MediaType  int64  `json:"media_type"`
+	HashAlgo   int64  `json:"hash_algo"`
+	HashSize   int64  `json:"hash_size"`
+	PicDhash   []byte `json:"pic_dhash"`
+	Region     int64  `json:"region"`
+	RegionHash []byte `json:"region_hash"`
+}
+
+func (q *Queries) ListRegionHashesByGroup(ctx context.Context, groupID int64) ([]ListRegionHashesByGroupRow, error) {
+	var logFields []zap.Field
+	var start time.Time
+	if q.logger != nil {
+		logFields = make([]zap.Field, 0, 8)
+		start = time.Now()
+		if q.LogArgument {
+			logFields = append(logFields,
+				zap.Dict("fields",
+					zap.Int64("group_id", groupID),
+				),
+			)
+		}
+	}
+	rows, err := q.query(ctx, q.listRegionHashesByGroupStmt, listRegionHashesByGroup, groupID)
+	defer func() {
+		q.logQuery(listRegionHashesByGroup, "ListRegionHashesByGroup", logFields, err, start)
+	}()
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var items []ListRegionHashesByGroupRow
+	for rows.Next() {
+		var i ListRegionHashesByGroupRow
+		if err = rows.Scan(
+			&i.MediaType,
+			&i.HashAlgo,
+			&i.HashSize,
+			&i.PicDhash,
+			&i.Region,
+			&i.RegionHash,
 		); err != nil {
 			return nil, err
 		}
@@ -320,10 +554,13 @@ func (q *Queries) ListMarsInfoByGroup(ctx context.Context, groupID int64) ([]Mar
 }
 
 const listSimilarPhotos = `-- name: ListSimilarPhotos :many
-SELECT mars_info.group_id, mars_info.pic_dhash, mars_info.count, mars_info.last_msg_id, mars_info.in_whitelist,
+SELECT mars_info.group_id, mars_info.pic_dhash, mars_info.count, mars_info.last_msg_id, mars_info.in_whitelist, mars_info.hash_algo, mars_info.hash_size, mars_info.media_type,
        CAST(hamming_distance(pic_dhash, CAST(? AS BLOB)) AS INTEGER) AS hd
 FROM mars_info
 WHERE group_id = ?
+  AND media_type = ?
+  AND hash_algo = ?
+  AND hash_size = ?
   AND hd < CAST(? AS INTEGER)
 ORDER BY hd
 LIMIT 10
@@ -334,7 +571,16 @@ type ListSimilarPhotosRow struct {
 	Hd       int64    `json:"hd"`
 }
 
-func (q *Queries) ListSimilarPhotos(ctx context.Context, srcDhash []byte, groupID int64, minDistance int64) ([]ListSimilarPhotosRow, error) {
+type ListSimilarPhotosParams struct {
+	SrcDhash    []byte `json:"src_dhash"`
+	GroupID     int64  `json:"group_id"`
+	MediaType   int64  `json:"media_type"`
+	HashAlgo    int64  `json:"hash_algo"`
+	HashSize    int64  `json:"hash_size"`
+	MinDistance int64  `json:"min_distance"`
+}
+
+func (q *Queries) ListSimilarPhotos(ctx context.Context, arg ListSimilarPhotosParams) ([]ListSimilarPhotosRow, error) {
 	var logFields []zap.Field
 	var start time.Time
 	if q.logger != nil {
@@ -343,14 +589,24 @@ func (q *Queries) ListSimilarPhotos(ctx context.Context, srcDhash []byte, groupI
 		if q.LogArgument {
 			logFields = append(logFields,
 				zap.Dict("fields",
-					zap.ByteString("src_dhash", srcDhash),
-					zap.Int64("group_id", groupID),
-					zap.Int64("min_distance", minDistance),
+					zap.ByteString("src_dhash", arg.SrcDhash),
+					zap.Int64("group_id", arg.GroupID),
+					zap.Int64("media_type", arg.MediaType),
+					zap.Int64("hash_algo", arg.HashAlgo),
+					zap.Int64("hash_size", arg.HashSize),
+					zap.Int64("min_distance", arg.MinDistance),
 				),
 			)
 		}
 	}
-	rows, err := q.query(ctx, q.listSimilarPhotosStmt, listSimilarPhotos, srcDhash, groupID, minDistance)
+	rows, err := q.query(ctx, q.listSimilarPhotosStmt, listSimilarPhotos,
+		arg.SrcDhash,
+		arg.GroupID,
+		arg.MediaType,
+		arg.HashAlgo,
+		arg.HashSize,
+		arg.MinDistance,
+	)
 	defer func() {
 		q.logQuery(listSimilarPhotos, "ListSimilarPhotos", logFields, err, start)
 	}()
@@ -367,6 +623,9 @@ func (q *Queries) ListSimilarPhotos(ctx context.Context, srcDhash []byte, groupI
 			&i.MarsInfo.Count,
 			&i.MarsInfo.LastMsgID,
 			&i.MarsInfo.InWhitelist,
+			&i.MarsInfo.HashAlgo,
+			&i.MarsInfo.HashSize,
+			&i.MarsInfo.MediaType,
 			&i.Hd,
 		); err != nil {
 			return nil, err
@@ -382,13 +641,13 @@ func (q *Queries) ListSimilarPhotos(ctx context.Context, srcDhash []byte, groupI
 	return items, nil
 }
 
-const setMarsWhitelist = `-- name: SetMarsWhitelist :exec
-INSERT INTO mars_info (group_id, pic_dhash, count, last_msg_id, in_whitelist)
-VALUES (?, ?, 0, 0, ?)
-ON CONFLICT(group_id, pic_dhash) DO UPDATE SET in_whitelist = excluded.in_whitelist
+const listWhitelistUsersByGroup = `-- name: ListWhitelistUsersByGroup :many
+SELECT user_id
+FROM group_user_in_whitelist
+WHERE group_id = ?
 `
 
-func (q *Queries) SetMarsWhitelist(ctx context.Context, groupID int64, picDhash []byte, inWhitelist int64) error {
+func (q *Queries) ListWhitelistUsersByGroup(ctx context.Context, groupID int64) ([]int64, error) {
 	var logFields []zap.Field
 	var start time.Time
 	if q.logger != nil {
@@ -398,24 +657,124 @@ func (q *Queries) SetMarsWhitelist(ctx context.Context, groupID int64, picDhash
 			logFields = append(logFields,
 				zap.Dict("fields",
 					zap.Int64("group_id", groupID),
-					zap.ByteString("pic_dhash", picDhash),
-					zap.Int64("in_whitelist", inWhitelist),
 				),
 			)
 		}
 	}
-	_, err := q.exec(ctx, q.setMarsWhitelistStmt, setMarsWhitelist, groupID, picDhash, inWhitelist)
+	rows, err := q.query(ctx, q.listWhitelistUsersByGroupStmt, listWhitelistUsersByGroup, groupID)
+	defer func() {
+		q.logQuery(listWhitelistUsersByGroup, "ListWhitelistUsersByGroup", logFields, err, start)
+	}()
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var items []int64
+	for rows.Next() {
+		var user_id int64
+		if err = rows.Scan(&user_id); err != nil {
+			return nil, err
+		}
+		items = append(items, user_id)
+	}
+	if err = rows.Close(); err != nil {
+		return nil, err
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+const refreshGroupStat = `-- name: RefreshGroupStat :exec
+INSERT INTO mars_group_stat (group_id, image_count)
+VALUES (?1, (SELECT COUNT(*) FROM mars_info WHERE group_id = ?1))
+ON CONFLICT(group_id) DO UPDATE SET image_count = excluded.image_count
+`
+
+func (q *Queries) RefreshGroupStat(ctx context.Context, groupID int64) error {
+	var logFields []zap.Field
+	var start time.Time
+	if q.logger != nil {
+		logFields = make([]zap.Field, 0, 8)
+		start = time.Now()
+		if q.LogArgument {
+			logFields = append(logFields,
+				zap.Dict("fields",
+					zap.Int64("group_id", groupID),
+				),
+			)
+		}
+	}
+	_, err := q.exec(ctx, q.refreshGroupStatStmt, refreshGroupStat, groupID)
+	q.logQuery(refreshGroupStat, "RefreshGroupStat", logFields, err, start)
+	return err
+}
+
+const setMarsWhitelist = `-- name: SetMarsWhitelist :exec
+INSERT INTO mars_info (group_id, media_type, hash_algo, hash_size, pic_dhash, count, last_msg_id, in_whitelist)
+VALUES (?, ?, ?, ?, ?, 0, 0, ?)
+ON CONFLICT(group_id, media_type, hash_algo, pic_dhash) DO UPDATE SET in_whitelist = excluded.in_whitelist
+`
+
+type SetMarsWhitelistParams struct {
+	GroupID     int64  `json:"group_id"`
+	MediaType   int64  `json:"media_type"`
+	HashAlgo    int64  `json:"hash_algo"`
+	HashSize    int64  `json:"hash_size"`
+	PicDhash    []byte `json:"pic_dhash"`
+	InWhitelist int64  `json:"in_whitelist"`
+}
+
+func (q *Queries) SetMarsWhitelist(ctx context.Context, arg SetMarsWhitelistParams) error {
+	var logFields []zap.Field
+	var start time.Time
+	if q.logger != nil {
+		logFields = make([]zap.Field, 0, 8)
+		start = time.Now()
+		if q.LogArgument {
+			logFields = append(logFields,
+				zap.Dict("fields",
+					zap.Int64("group_id", arg.GroupID),
+					zap.Int64("media_type", arg.MediaType),
+					zap.Int64("hash_algo", arg.HashAlgo),
+					zap.Int64("hash_size", arg.HashSize),
+					zap.ByteString("pic_dhash", arg.PicDhash),
+					zap.Int64("in_whitelist", arg.InWhitelist),
+				),
+			)
+		}
+	}
+	_, err := q.exec(ctx, q.setMarsWhitelistStmt, setMarsWhitelist,
+		arg.GroupID,
+		arg.MediaType,
+		arg.HashAlgo,
+		arg.HashSize,
+		arg.PicDhash,
+		arg.InWhitelist,
+	)
 	q.logQuery(setMarsWhitelist, "SetMarsWhitelist", logFields, err, start)
 	return err
 }
 
 const upsertDhash = `-- name: UpsertDhash :exec
-INSERT INTO fuid_to_dhash (fuid, dhash)
-VALUES (?, ?)
-ON CONFLICT DO UPDATE SET dhash=excluded.dhash
+INSERT INTO fuid_to_dhash (fuid, hash_algo, hash_size, dhash, orientations, regions)
+VALUES (?, ?, ?, ?, ?, ?)
+ON CONFLICT DO UPDATE SET dhash=excluded.dhash,
+                          orientations=excluded.orientations,
+                          regions=excluded.regions
 `
 
-func (q *Queries) UpsertDhash(ctx context.Context, fuid string, dhash []byte) error {
+type UpsertDhashParams struct {
+	Fuid         string `json:"fuid"`
+	HashAlgo     int64  `json:"hash_algo"`
+	HashSize     int64  `json:"hash_size"`
+	Dhash        []byte `json:"dhash"`
+	Orientations []byte `json:"orientations"`
+	Regions      []byte `json:"regions"`
+}
+
+func (q *Queries) UpsertDhash(ctx context.Context, arg UpsertDhashParams) error {
 	var logFields []zap.Field
 	var start time.Time
 	if q.logger != nil {
@@ -424,27 +783,68 @@ func (q *Queries) UpsertDhash(ctx context.Context, fuid string, dhash []byte) er
 		if q.LogArgument {
 			logFields = append(logFields,
 				zap.Dict("fields",
-					zap.String("fuid", fuid),
-					zap.ByteString("dhash", dhash),
+					zap.String("fuid", arg.Fuid),
+					zap.Int64("hash_algo", arg.HashAlgo),
+					zap.Int64("hash_size", arg.HashSize),
+					zap.ByteString("dhash", arg.Dhash),
+					zap.ByteString("orientations", arg.Orientations),
+					zap.ByteString("regions", arg.Regions),
 				),
 			)
 		}
 	}
-	_, err := q.exec(ctx, q.upsertDhashStmt, upsertDhash, fuid, dhash)
+	_, err := q.exec(ctx, q.upsertDhashStmt, upsertDhash,
+		arg.Fuid,
+		arg.HashAlgo,
+		arg.HashSize,
+		arg.Dhash,
+		arg.Orientations,
+		arg.Regions,
+	)
 	q.logQuery(upsertDhash, "UpsertDhash", logFields, err, start)
 	return err
 }
 
+const upsertGroupSetting = `-- name: UpsertGroupSetting :exec
+INSERT INTO group_settings (group_id, key, value)
+VALUES (?, ?, ?)
+ON CONFLICT(group_id, key) DO UPDATE SET value = excluded.value
+`
+
+func (q *Queries) UpsertGroupSetting(ctx context.Context, groupID int64, key string, value int64) error {
+	var logFields []zap.Field
+	var start time.Time
+	if q.logger != nil {
+		logFields = make([]zap.Field, 0, 8)
+		start = time.Now()
+		if q.LogArgument {
+			logFields = append(logFields,
+				zap.Dict("fields",
+					zap.Int64("group_id", groupID),
+					zap.String("key", key),
+					zap.Int64("value", value),
+				),
+			)
+		}
+	}
+	_, err := q.exec(ctx, q.upsertGroupSettingStmt, upsertGroupSetting, groupID, key, value)
+	q.logQuery(upsertGroupSetting, "UpsertGroupSetting", logFields, err, start)
+	return err
+}
+
 const upsertMarsInfo = `-- name: UpsertMarsInfo :exec
-INSERT INTO mars_info (group_id, pic_dhash, count, last_msg_id, in_whitelist)
-VALUES (?, ?, ?, ?, ?)
-ON CONFLICT(group_id, pic_dhash) DO UPDATE SET count=excluded.count,
-                                               last_msg_id=excluded.last_msg_id,
-                                               in_whitelist=excluded.in_whitelist
+INSERT INTO mars_info (group_id, media_type, hash_algo, hash_size, pic_dhash, count, last_msg_id, in_whitelist)
+VALUES (?, ?, ?, ?, ?, ?, ?, ?)
+ON CONFLICT(group_id, media_type, hash_algo, pic_dhash) DO UPDATE SET count=excluded.count,
+                                                                      last_msg_id=excluded.last_msg_id,
+                                                                      in_whitelist=excluded.in_whitelist
 `
 
 type UpsertMarsInfoParams struct {
 	GroupID     int64  `json:"group_id"`
+	MediaType   int64  `json:"media_type"`
+	HashAlgo    int64  `json:"hash_algo"`
+	HashSize    int64  `json:"hash_size"`
 	PicDhash    []byte `json:"pic_dhash"`
 	Count       int64  `json:"count"`
 	LastMsgID   int64  `json:"last_msg_id"`
@@ -461,6 +861,9 @@ func (q *Queries) UpsertMarsInfo(ctx context.Context, arg UpsertMarsInfoParams)
 			logFields = append(logFields,
 				zap.Dict("fields",
 					zap.Int64("group_id", arg.GroupID),
+					zap.Int64("media_type", arg.MediaType),
+					zap.Int64("hash_algo", arg.HashAlgo),
+					zap.Int64("hash_size", arg.HashSize),
 					zap.ByteString("pic_dhash", arg.PicDhash),
 					zap.Int64("count", arg.Count),
 					zap.Int64("last_msg_id", arg.LastMsgID),
@@ -471,6 +874,9 @@ func (q *Queries) UpsertMarsInfo(ctx context.Context, arg UpsertMarsInfoParams)
 	}
 	_, err := q.exec(ctx, q.upsertMarsInfoStmt, upsertMarsInfo,
 		arg.GroupID,
+		arg.MediaType,
+		arg.HashAlgo,
+		arg.HashSize,
 		arg.PicDhash,
 		arg.Count,
 		arg.LastMsgID,
@@ -479,3 +885,49 @@ func (q *Queries) UpsertMarsInfo(ctx context.Context, arg UpsertMarsInfoParams)
 	q.logQuery(upsertMarsInfo, "UpsertMarsInfo", logFields, err, start)
 	return err
 }
+
+const upsertRegionHash = `-- name: UpsertRegionHash :exec
+INSERT INTO mars_region_hash (group_id, media_type, hash_algo, pic_dhash, region, region_hash)
+VALUES (?, ?, ?, ?, ?, ?)
+ON CONFLICT DO UPDATE SET region_hash=excluded.region_hash
+`
+
+type UpsertRegionHashParams struct {
+	GroupID    int64  `json:"group_id"`
+	MediaType  int64  `json:"media_type"`
+	HashAlgo   int64  `json:"hash_algo"`
+	PicDhash   []byte `json:"pic_dhash"`
+	Region     int64  `json:"region"`
+	RegionHash []byte `json:"region_hash"`
+}
+
+func (q *Queries) UpsertRegionHash(ctx context.Context, arg UpsertRegionHashParams) error {
+	var logFields []zap.Field
+	var start time.Time
+	if q.logger != nil {
+		logFields = make([]zap.Field, 0, 8)
+		start = time.Now()
+		if q.LogArgument {
+			logFields = append(logFields,
+				zap.Dict("fields",
+					zap.Int64("group_id", arg.GroupID),
+					zap.Int64("media_type", arg.MediaType),
+					zap.Int64("hash_algo", arg.HashAlgo),
+					zap.ByteString("pic_dhash", arg.PicDhash),
+					zap.Int64("region", arg.Region),
+					zap.ByteString("region_hash", arg.RegionHash),
+				),
+			)
+		}
+	}
+	_, err := q.exec(ctx, q.upsertRegionHashStmt, upsertRegionHash,
+		arg.GroupID,
+		arg.MediaType,
+		arg.HashAlgo,
+		arg.PicDhash,
+		arg.Region,
+		arg.RegionHash,
+	)
+	q.logQuery(upsertRegionHash, "UpsertRegionHash", logFields, err, start)
+	return err
+}
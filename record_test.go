@@ -0,0 +1,209 @@
+package marsbot
+
+import (
+	"context"
+	"testing"
+
+	"go.uber.org/zap"
+
+	"marsbot/minicv"
+	"marsbot/q"
+)
+
+// useTestDB points the package globals used by the handlers at a freshly migrated database.
+func useTestDB(t *testing.T) {
+	t.Helper()
+	testDB := openTestDB(t)
+	ctx := context.Background()
+	if err := migrateDB(ctx, testDB); err != nil {
+		t.Fatalf("migrate: %v", err)
+	}
+	testQueries, err := q.Prepare(ctx, testDB)
+	if err != nil {
+		t.Fatalf("prepare queries: %v", err)
+	}
+	t.Cleanup(func() { _ = testQueries.Close() })
+
+	prevDB, prevQueries, prevLogger, prevConfig := db, queries, logger, config
+	db, queries, logger = testDB, testQueries, zap.NewNop()
+	similarMu.Lock()
+	similarIndexes = make(map[int64]*groupIndex)
+	similarMu.Unlock()
+	settingsMu.Lock()
+	settingsCache = make(map[int64]groupSettings)
+	settingsMu.Unlock()
+	t.Cleanup(func() {
+		db, queries, logger, config = prevDB, prevQueries, prevLogger, prevConfig
+	})
+}
+
+func flipBits(hash []byte, n int) []byte {
+	out := append([]byte(nil), hash...)
+	for i := 0; i < n; i++ {
+		out[i/8] ^= 1 << (i % 8)
+	}
+	return out
+}
+
+func TestRecordMarsFuzzyMatch(t *testing.T) {
+	useTestDB(t)
+	config.FuzzyMatchDistance = 3
+	config.SimilarNoticeDistance = 8
+	ctx := context.Background()
+	const groupID = -1001
+	base := picHash{Algo: minicv.AlgoDHash, Size: 8, Hash: []byte{0x12, 0x34, 0x56, 0x78, 0x9a, 0xbc, 0xde, 0xf0}}
+
+	if res, err := recordMars(ctx, groupID, 1, base); err != nil || res.PrevCount != 0 {
+		t.Fatalf("first sighting: %+v, %v", res, err)
+	}
+
+	near := picHash{Algo: base.Algo, Size: base.Size, Hash: flipBits(base.Hash, 2)}
+	res, err := recordMars(ctx, groupID, 2, near)
+	if err != nil {
+		t.Fatalf("near sighting: %v", err)
+	}
+	if res.PrevCount != 1 || res.Distance != 2 || string(res.Hash.Hash) != string(base.Hash) {
+		t.Fatalf("near sighting should credit the stored hash: %+v", res)
+	}
+
+	far := picHash{Algo: base.Algo, Size: base.Size, Hash: flipBits(base.Hash, 6)}
+	res, err = recordMars(ctx, groupID, 3, far)
+	if err != nil {
+		t.Fatalf("similar sighting: %v", err)
+	}
+	if res.PrevCount != 0 || !res.Similar || res.SimilarInfo.LastMsgID != 2 {
+		t.Fatalf("similar sighting should be new and flagged: %+v", res)
+	}
+
+	unrelated := picHash{Algo: base.Algo, Size: base.Size, Hash: flipBits(base.Hash, 40)}
+	res, err = recordMars(ctx, groupID, 4, unrelated)
+	if err != nil {
+		t.Fatalf("unrelated sighting: %v", err)
+	}
+	if res.PrevCount != 0 || res.Similar {
+		t.Fatalf("unrelated sighting matched: %+v", res)
+	}
+}
+
+func TestRecordMarsSeparatesMediaTypes(t *testing.T) {
+	useTestDB(t)
+	config.FuzzyMatchDistance = 3
+	ctx := context.Background()
+	const groupID = -1002
+	photo := picHash{Media: mediaPhoto, Algo: minicv.AlgoDHash, Size: 8, Hash: []byte{1, 2, 3, 4, 5, 6, 7, 8}}
+	video := photo
+	video.Media = mediaVideo
+
+	if _, err := recordMars(ctx, groupID, 1, photo); err != nil {
+		t.Fatalf("record photo: %v", err)
+	}
+	res, err := recordMars(ctx, groupID, 2, video)
+	if err != nil {
+		t.Fatalf("record video: %v", err)
+	}
+	if res.PrevCount != 0 {
+		t.Fatalf("video thumbnail matched a photo: %+v", res)
+	}
+	res, err = recordMars(ctx, groupID, 3, video)
+	if err != nil {
+		t.Fatalf("record video again: %v", err)
+	}
+	if res.PrevCount != 1 || res.PrevLastMsgID != 2 {
+		t.Fatalf("repeated video not detected: %+v", res)
+	}
+}
+
+func TestParseCallbackMedia(t *testing.T) {
+	hash := picHash{Media: mediaAnimation, Algo: minicv.AlgoPHash, Size: 8, Hash: []byte{1, 2, 3, 4, 5, 6, 7, 8}}
+	got, err := parseCallback(hashCallbackData("find", hash))
+	if err != nil {
+		t.Fatalf("parse: %v", err)
+	}
+	if got.Media != hash.Media || got.Algo != hash.Algo || got.Size != hash.Size || string(got.Hash) != string(hash.Hash) {
+		t.Fatalf("round trip = %+v, want %+v", got, hash)
+	}
+	// buttons sent before media types existed are photos
+	legacy, err := parseCallback("find:1:AQIDBAUGBwg")
+	if err != nil || legacy.Media != mediaPhoto || legacy.Algo != minicv.AlgoPHash {
+		t.Fatalf("legacy callback = %+v, %v", legacy, err)
+	}
+}
+
+func TestRecordMarsMatchesOrientations(t *testing.T) {
+	useTestDB(t)
+	config.MatchOrientations = true
+	ctx := context.Background()
+	const groupID = -1003
+	stored := picHash{Algo: minicv.AlgoDHash, Size: 8, Hash: []byte{0x12, 0x34, 0x56, 0x78, 0x9a, 0xbc, 0xde, 0xf0}}
+	if _, err := recordMars(ctx, groupID, 1, stored); err != nil {
+		t.Fatalf("record original: %v", err)
+	}
+
+	orientations := make([][]byte, minicv.OrientationCount)
+	for i := range orientations {
+		orientations[i] = flipBits(stored.Hash, 20+i)
+	}
+	orientations[minicv.OrientFlipH] = stored.Hash
+	mirrored := picHash{Algo: stored.Algo, Size: stored.Size, Hash: orientations[minicv.OrientIdentity], Orientations: orientations}
+	res, err := recordMars(ctx, groupID, 2, mirrored)
+	if err != nil {
+		t.Fatalf("record mirrored: %v", err)
+	}
+	if res.PrevCount != 1 || res.Orientation != minicv.OrientFlipH || string(res.Hash.Hash) != string(stored.Hash) {
+		t.Fatalf("mirrored copy should credit the original: %+v", res)
+	}
+	if matchNote(res) == "" {
+		t.Fatalf("mirrored match has no note")
+	}
+
+	def, _ := findSettingDef("orient")
+	if _, err := setGroupSetting(ctx, groupID, def, 0); err != nil {
+		t.Fatalf("disable orientations: %v", err)
+	}
+	res, err = recordMars(ctx, groupID, 3, mirrored)
+	if err != nil {
+		t.Fatalf("record with orientations off: %v", err)
+	}
+	if res.Orientation != minicv.OrientIdentity || string(res.Hash.Hash) == string(stored.Hash) {
+		t.Fatalf("orientation matched although disabled: %+v", res)
+	}
+}
+
+func TestRecordMarsMatchesCrops(t *testing.T) {
+	useTestDB(t)
+	config.CropMatchRegions = 4
+	ctx := context.Background()
+	const groupID = -1004
+	regions := func(seed byte, flipped int) [][]byte {
+		out := make([][]byte, minicv.RegionCount)
+		for i := range out {
+			out[i] = flipBits([]byte{seed, byte(i), 3, 4, 5, 6, 7, 8}, flipped)
+		}
+		return out
+	}
+	stored := picHash{Algo: minicv.AlgoDHash, Size: 8, Hash: []byte{0xff, 0, 0xff, 0, 0xff, 0, 0xff, 0}, Regions: regions(1, 0)}
+	if _, err := recordMars(ctx, groupID, 1, stored); err != nil {
+		t.Fatalf("record original: %v", err)
+	}
+	// reload the index from the database so the stored region hashes are used
+	invalidateSimilarIndex(groupID)
+
+	crop := picHash{Algo: stored.Algo, Size: stored.Size, Hash: []byte{0, 0xff, 0, 0xff, 0, 0xff, 0, 0xff}, Regions: regions(1, 3)}
+	crop.Regions[0] = []byte{0xaa, 0xaa, 0xaa, 0xaa, 0xaa, 0xaa, 0xaa, 0xaa}
+	res, err := recordMars(ctx, groupID, 2, crop)
+	if err != nil {
+		t.Fatalf("record crop: %v", err)
+	}
+	if res.PrevCount != 1 || res.Regions != minicv.RegionCount-1 || string(res.Hash.Hash) != string(stored.Hash) {
+		t.Fatalf("crop should credit the original: %+v", res)
+	}
+
+	unrelated := picHash{Algo: stored.Algo, Size: stored.Size, Hash: []byte{1, 1, 1, 1, 1, 1, 1, 1}, Regions: regions(1, 40)}
+	res, err = recordMars(ctx, groupID, 3, unrelated)
+	if err != nil {
+		t.Fatalf("record unrelated: %v", err)
+	}
+	if res.PrevCount != 0 || res.Regions != 0 {
+		t.Fatalf("unrelated image matched as a crop: %+v", res)
+	}
+}
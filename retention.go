@@ -0,0 +1,140 @@
+package marsbot
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+const backupKeyTimeLayout = "2006-01-02-15_04_05"
+
+// retentionPolicy decides which uploaded backups are kept, see the BACKUP_KEEP_* settings in BackupConfig.
+type retentionPolicy struct {
+	Daily   int
+	Weekly  int
+	Monthly int
+	MaxAge  time.Duration
+	// MaxCount keeps at most this many backups, newest first.
+	MaxCount int
+}
+
+func retentionFromConfig(c BackupConfig) retentionPolicy {
+	return retentionPolicy{
+		Daily:    c.BackupKeepDaily,
+		Weekly:   c.BackupKeepWeekly,
+		Monthly:  c.BackupKeepMonthly,
+		MaxAge:   c.BackupMaxAge,
+		MaxCount: c.BackupMaxCount,
+	}
+}
+
+func (p retentionPolicy) gfs() bool {
+	return p.Daily > 0 || p.Weekly > 0 || p.Monthly > 0
+}
+
+func (p retentionPolicy) enabled() bool {
+	return p.gfs() || p.MaxAge > 0 || p.MaxCount > 0
+}
+
+// backupTime is when a backup was taken, read from its key and falling back to the upload time.
+func backupTime(b backupObject) time.Time {
+	stamp := strings.TrimSuffix(strings.TrimPrefix(b.Key, backupKeyPrefix), backupKeySuffix)
+	if t, err := time.ParseInLocation(backupKeyTimeLayout, stamp, time.Local); err == nil {
+		return t
+	}
+	return b.LastModified
+}
+
+// expiredBackups returns the backups that policy does not keep, oldest first.
+func expiredBackups(backups []backupObject, policy retentionPolicy, now time.Time) []backupObject {
+	if !policy.enabled() || len(backups) == 0 {
+		return nil
+	}
+	sorted := append([]backupObject(nil), backups...)
+	sort.SliceStable(sorted, func(i, j int) bool { return backupTime(sorted[i]).After(backupTime(sorted[j])) })
+
+	keep := make([]bool, len(sorted))
+	if policy.gfs() {
+		// the newest backup of each of the newest n periods
+		buckets := []struct {
+			n      int
+			period func(time.Time) string
+		}{
+			{policy.Daily, func(t time.Time) string { return t.Format(time.DateOnly) }},
+			{policy.Weekly, func(t time.Time) string { y, w := t.ISOWeek(); return fmt.Sprintf("%d-W%02d", y, w) }},
+			{policy.Monthly, func(t time.Time) string { return t.Format("2006-01") }},
+		}
+		for _, bucket := range buckets {
+			seen := make(map[string]bool)
+			for i, b := range sorted {
+				if len(seen) >= bucket.n {
+					break
+				}
+				period := bucket.period(backupTime(b))
+				if !seen[period] {
+					seen[period] = true
+					keep[i] = true
+				}
+			}
+		}
+	} else {
+		for i := range keep {
+			keep[i] = true
+		}
+	}
+	kept := 0
+	for i, b := range sorted {
+		if !keep[i] {
+			continue
+		}
+		if (policy.MaxAge > 0 && now.Sub(backupTime(b)) > policy.MaxAge) || (policy.MaxCount > 0 && kept >= policy.MaxCount) {
+			keep[i] = false
+			continue
+		}
+		kept++
+	}
+	keep[0] = true
+
+	var expired []backupObject
+	for i := len(sorted) - 1; i >= 0; i-- {
+		if !keep[i] {
+			expired = append(expired, sorted[i])
+		}
+	}
+	return expired
+}
+
+// pruneBackups deletes the backups of target that the configured retention policy no longer keeps.
+func pruneBackups(ctx context.Context, target BackupTarget) error {
+	policy := retentionFromConfig(config.BackupConfig)
+	if !policy.enabled() {
+		return nil
+	}
+	backups, err := listBackups(ctx, target)
+	if err != nil {
+		return err
+	}
+	var errs []error
+	for _, b := range expiredBackups(backups, policy, time.Now()) {
+		// deltas go first, they are useless without their full backup
+		for _, d := range b.Deltas {
+			if err := target.Delete(ctx, d.Key); err != nil {
+				errs = append(errs, fmt.Errorf("delete %s: %w", d.Key, err))
+			}
+		}
+		if err := target.Delete(ctx, b.Key); err != nil {
+			errs = append(errs, fmt.Errorf("delete %s: %w", b.Key, err))
+			continue
+		}
+		if logger != nil {
+			logger.Info("pruned backup", zap.String("target", target.Name()), zap.String("key", b.Key),
+				zap.Time("taken_at", backupTime(b)), zap.Int("deltas", len(b.Deltas)))
+		}
+	}
+	return errors.Join(errs...)
+}
@@ -0,0 +1,83 @@
+package marsbot
+
+import (
+	"testing"
+	"time"
+)
+
+func backupsEvery(start time.Time, step time.Duration, n int) []backupObject {
+	backups := make([]backupObject, n)
+	for i := range backups {
+		at := start.Add(time.Duration(i) * step)
+		backups[i] = backupObject{Key: backupKeyPrefix + at.Format(backupKeyTimeLayout) + backupKeySuffix}
+	}
+	return backups
+}
+
+func keptKeys(backups, expired []backupObject) map[string]bool {
+	kept := make(map[string]bool)
+	for _, b := range backups {
+		kept[b.Key] = true
+	}
+	for _, b := range expired {
+		delete(kept, b.Key)
+	}
+	return kept
+}
+
+func TestExpiredBackupsGFS(t *testing.T) {
+	start := time.Date(2024, 1, 1, 3, 0, 0, 0, time.Local)
+	// two backups a day for 90 days
+	backups := backupsEvery(start, 12*time.Hour, 180)
+	now := backupTime(backups[len(backups)-1]).Add(time.Hour)
+	expired := expiredBackups(backups, retentionPolicy{Daily: 7, Weekly: 4, Monthly: 3}, now)
+	kept := keptKeys(backups, expired)
+
+	// 7 daily, weekly and monthly picks overlap with them and each other
+	days := make(map[string]bool)
+	for key := range kept {
+		days[backupTime(backupObject{Key: key}).Format(time.DateOnly)] = true
+	}
+	if len(days) != len(kept) {
+		t.Fatalf("kept two backups of one day: %v", kept)
+	}
+	if !kept[backups[len(backups)-1].Key] {
+		t.Fatalf("newest backup pruned")
+	}
+	if kept[backups[0].Key] {
+		t.Fatalf("oldest backup kept")
+	}
+	if len(kept) < 7 || len(kept) > 7+4+3 {
+		t.Fatalf("kept %d backups: %v", len(kept), kept)
+	}
+	for i := 1; i < len(expired); i++ {
+		if backupTime(expired[i]).Before(backupTime(expired[i-1])) {
+			t.Fatalf("expired not oldest first")
+		}
+	}
+}
+
+func TestExpiredBackupsAgeAndCount(t *testing.T) {
+	start := time.Date(2024, 3, 1, 0, 0, 0, 0, time.Local)
+	backups := backupsEvery(start, 24*time.Hour, 10)
+	now := backupTime(backups[9])
+
+	if got := expiredBackups(backups, retentionPolicy{}, now); len(got) != 0 {
+		t.Fatalf("disabled policy expired %d", len(got))
+	}
+	if got := expiredBackups(backups, retentionPolicy{MaxCount: 3}, now); len(got) != 7 {
+		t.Fatalf("max count expired %d", len(got))
+	}
+	if got := expiredBackups(backups, retentionPolicy{MaxAge: 48 * time.Hour}, now); len(got) != 7 {
+		t.Fatalf("max age expired %d", len(got))
+	}
+	// the newest backup survives even when it is too old
+	if got := expiredBackups(backups, retentionPolicy{MaxAge: time.Hour}, now.Add(240*time.Hour)); len(got) != 9 {
+		t.Fatalf("expired the newest backup: %d", len(got))
+	}
+	// keys that do not carry a time fall back to the upload time
+	odd := backupObject{Key: backupKeyPrefix + "manual" + backupKeySuffix, LastModified: now.Add(-time.Hour)}
+	if !backupTime(odd).Equal(odd.LastModified) {
+		t.Fatalf("backupTime(%q) = %v", odd.Key, backupTime(odd))
+	}
+}
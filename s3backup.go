@@ -17,16 +17,22 @@ import (
 
 	"github.com/DataDog/zstd"
 	"github.com/mattn/go-sqlite3"
-	"github.com/minio/minio-go/v7"
-	"github.com/minio/minio-go/v7/pkg/credentials"
 	"go.uber.org/zap"
 )
 
 var (
 	backupStopCh chan struct{}
+	// backupDone is closed when the backup goroutine has returned.
+	backupDone chan struct{}
 )
 
-// StartBackupThread launches a background ticker that performs a SQLite backup and uploads it to S3.
+// Backups are uploaded as backup_mars_at_<time>.db.zst, the time format sorts chronologically.
+const (
+	backupKeyPrefix = "backup_mars_at_"
+	backupKeySuffix = ".db.zst"
+)
+
+// StartBackupThread launches a background ticker that performs a SQLite backup and uploads it to the backup targets.
 // Safe to call multiple times; only the first call starts the goroutine.
 func StartBackupThread() {
 	if config.NoBackup {
@@ -37,6 +43,7 @@ func StartBackupThread() {
 		return
 	}
 	backupStopCh = make(chan struct{})
+	backupDone = make(chan struct{})
 
 	interval := time.Duration(config.S3BackupMinutes) * time.Minute
 	if interval <= 0 {
@@ -44,54 +51,115 @@ func StartBackupThread() {
 	}
 	logger.Info("Starting backup thread", zap.Duration("interval", interval))
 	go func() {
-		if err := BackupAndUpload(context.Background()); err != nil && logger != nil {
+		defer close(backupDone)
+		if err := BackupAndUpload(rootCtx); err != nil && logger != nil {
 			logger.Warn("backup failed", zap.Error(err))
 		}
 		timer := time.NewTicker(interval)
+		// a nil channel never fires, so deltas stay off unless configured
+		var deltaC <-chan time.Time
+		if config.BackupDeltaMinutes > 0 {
+			deltaTicker := time.NewTicker(time.Duration(config.BackupDeltaMinutes) * time.Minute)
+			defer deltaTicker.Stop()
+			deltaC = deltaTicker.C
+		}
+		var verifyC <-chan time.Time
+		if config.BackupVerifyMinutes > 0 {
+			verifyTicker := time.NewTicker(time.Duration(config.BackupVerifyMinutes) * time.Minute)
+			defer verifyTicker.Stop()
+			verifyC = verifyTicker.C
+		}
 		for {
 			select {
 			case <-backupStopCh:
 				timer.Stop()
 				return
+			case <-rootCtx.Done():
+				timer.Stop()
+				return
 			case <-timer.C:
-				if err := BackupAndUpload(context.Background()); err != nil && logger != nil {
+				if err := BackupAndUpload(rootCtx); err != nil && logger != nil {
 					logger.Warn("backup failed", zap.Error(err))
 				}
+			case <-deltaC:
+				if err := shipDeltaOrBackup(rootCtx); err != nil && logger != nil {
+					logger.Warn("ship backup delta failed", zap.Error(err))
+				}
+			case <-verifyC:
+				// failures are alerted by VerifyLatestBackup itself
+				_ = VerifyLatestBackup(rootCtx)
 			}
 		}
 	}()
 }
 
-// BackupAndUpload performs a single backup and uploads it to S3 after validating configuration.
-func BackupAndUpload(ctx context.Context) error {
+// StopBackupThread stops the backup ticker and waits for a backup that is running to finish or to notice that
+// rootCtx was cancelled.
+func StopBackupThread() {
+	if backupStopCh == nil {
+		return
+	}
+	close(backupStopCh)
+	<-backupDone
+}
+
+// BackupAndUpload performs a single backup, checks it and uploads it with its manifest to every configured target,
+// then prunes each target according to the retention policy.
+// It fails only when no target got the backup, the errors of the others are logged.
+func BackupAndUpload(ctx context.Context) (err error) {
+	start := time.Now()
+	defer func() { observeBackup("full", start, err) }()
 	if db == nil {
 		return fmt.Errorf("db not initialized")
 	}
-	if err := ensureS3Configured(); err != nil {
+	targets, err := configuredBackupTargets()
+	if err != nil {
 		return err
 	}
+	deltaMu.Lock()
+	defer deltaMu.Unlock()
 	defer C.malloc_trim(0)
-	ts := time.Now().Format("2006-01-02-15_04_05")
-	backupName := fmt.Sprintf("backup_mars_at_%s.db", ts)
+	ts := time.Now().Format(backupKeyTimeLayout)
+	backupName := fmt.Sprintf("%s%s.db", backupKeyPrefix, ts)
 	backupPath := filepath.Join(os.TempDir(), backupName)
 
 	if err := backupWithSQLiteAPI(ctx, backupPath); err != nil {
 		return err
 	}
+	manifest, err := inspectBackup(ctx, backupPath)
+	if err != nil {
+		_ = os.Remove(backupPath)
+		backupAlert("snapshot failed its check and was not uploaded: " + err.Error())
+		return err
+	}
 
 	compressedPath, err := zstdFile(backupPath)
-	_ = os.Remove(backupPath)
 	if err != nil {
+		_ = os.Remove(backupPath)
 		return err
 	}
 
-	if err := uploadToS3(ctx, compressedPath); err != nil {
+	uploaded, err := uploadBackup(ctx, targets, compressedPath, manifest.metadata())
+	_ = os.Remove(compressedPath)
+	if uploaded == 0 {
+		_ = os.Remove(backupPath)
 		return err
 	}
-	_ = os.Remove(compressedPath)
+	if err != nil && logger != nil {
+		logger.Warn("backup upload failed on some targets", zap.Error(err))
+	}
+	startDeltaChain(filepath.Base(compressedPath), backupPath)
+	_ = os.Remove(backupPath)
+	for _, t := range targets {
+		if err := pruneBackups(ctx, t); err != nil && logger != nil {
+			logger.Warn("prune backups failed", zap.String("target", t.Name()), zap.Error(err))
+		}
+	}
+	lastBackup.Store(time.Now().UnixNano())
 	return nil
 }
 
+// ensureS3Configured reports the first missing S3 setting once S3 is in use.
 func ensureS3Configured() error {
 	switch {
 	case config.S3ApiEndpoint == "":
@@ -102,6 +170,8 @@ func ensureS3Configured() error {
 		return fmt.Errorf("S3_API_KEY_ID is required for backup")
 	case config.S3ApiKeySecret == "":
 		return fmt.Errorf("S3_API_KEY_SECRET is required for backup")
+	case config.S3CAFile != "" && !config.S3UseTLS:
+		return fmt.Errorf("S3_CA_FILE is set but S3_USE_TLS is false")
 	default:
 		return nil
 	}
@@ -156,7 +226,12 @@ func backupWithSQLiteAPI(ctx context.Context, destPath string) error {
 				if done {
 					break
 				}
-				time.Sleep(10 * time.Millisecond)
+				select {
+				case <-ctx.Done():
+					_ = backup.Finish()
+					return fmt.Errorf("backup step: %w", ctx.Err())
+				case <-time.After(10 * time.Millisecond):
+				}
 			}
 			if err := backup.Finish(); err != nil {
 				return fmt.Errorf("finish backup: %w", err)
@@ -193,35 +268,3 @@ func zstdFile(path string) (string, error) {
 	}
 	return outPath, nil
 }
-
-func uploadToS3(ctx context.Context, path string) error {
-	client, err := minio.New(config.S3ApiEndpoint, &minio.Options{
-		Creds:  credentials.NewStaticV4(config.S3ApiKeyID, config.S3ApiKeySecret, ""),
-		Secure: true,
-	})
-	if err != nil {
-		return fmt.Errorf("create s3 client: %w", err)
-	}
-
-	file, err := os.Open(path)
-	if err != nil {
-		return err
-	}
-	defer file.Close()
-
-	stat, err := file.Stat()
-	if err != nil {
-		return err
-	}
-
-	_, err = client.PutObject(ctx, config.S3Bucket, filepath.Base(path), file, stat.Size(), minio.PutObjectOptions{
-		ContentType: "application/zstd",
-	})
-	if err != nil {
-		return fmt.Errorf("upload to s3: %w", err)
-	}
-	if logger != nil {
-		logger.Info("backup uploaded to S3", zap.String("bucket", config.S3Bucket), zap.String("key", filepath.Base(path)))
-	}
-	return nil
-}
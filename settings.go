@@ -0,0 +1,266 @@
+package marsbot
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/PaulSonOfLars/gotgbot/v2"
+	"github.com/PaulSonOfLars/gotgbot/v2/ext"
+	"go.uber.org/zap"
+
+	"marsbot/minicv"
+)
+
+const (
+	replyStyleMars = iota
+	replyStyleTerse
+	replyStyleSilent
+	replyStyleCount
+)
+
+var replyStyleNames = [replyStyleCount]string{
+	replyStyleMars:   "火星",
+	replyStyleTerse:  "简洁",
+	replyStyleSilent: "静默",
+}
+
+// groupSettings is the effective configuration of one group: stored overrides applied over the defaults.
+// Distances are in bits of a 64-bit hash and scale with the hash size.
+type groupSettings struct {
+	SimilarDistance    int64
+	FuzzyDistance      int64
+	NoticeDistance     int64
+	ReplyStyle         int64
+	WhitelistButtonMin int64
+	MediaGroupWaitMs   int64
+	MatchOrientations  int64
+	CropMatchRegions   int64
+}
+
+func (s groupSettings) MediaGroupWait() time.Duration {
+	return time.Duration(s.MediaGroupWaitMs) * time.Millisecond
+}
+
+type settingDef struct {
+	key   string
+	title string
+	min   int64
+	max   int64
+	step  int64
+	field func(*groupSettings) *int64
+}
+
+// settingDefs lists the editable settings in the order /settings shows them.
+// The keys are persisted in group_settings and used in callback data, keep them short and stable.
+var settingDefs = []settingDef{
+	{key: "sim", title: "相似搜索距离", min: 1, max: 16, step: 1,
+		field: func(s *groupSettings) *int64 { return &s.SimilarDistance }},
+	{key: "fuzzy", title: "模糊匹配距离", min: 0, max: 10, step: 1,
+		field: func(s *groupSettings) *int64 { return &s.FuzzyDistance }},
+	{key: "notice", title: "相似提醒距离", min: 0, max: 16, step: 1,
+		field: func(s *groupSettings) *int64 { return &s.NoticeDistance }},
+	{key: "style", title: "回复风格", min: 0, max: replyStyleCount - 1, step: 1,
+		field: func(s *groupSettings) *int64 { return &s.ReplyStyle }},
+	{key: "wlbtn", title: "白名单按钮阈值", min: 0, max: 100, step: 1,
+		field: func(s *groupSettings) *int64 { return &s.WhitelistButtonMin }},
+	{key: "mgwait", title: "相册等待(ms)", min: 200, max: 10000, step: 200,
+		field: func(s *groupSettings) *int64 { return &s.MediaGroupWaitMs }},
+	{key: "orient", title: "旋转翻转检测", min: 0, max: 1, step: 1,
+		field: func(s *groupSettings) *int64 { return &s.MatchOrientations }},
+	{key: "crop", title: "裁剪检测区域数", min: 0, max: int64(minicv.RegionCount), step: 1,
+		field: func(s *groupSettings) *int64 { return &s.CropMatchRegions }},
+}
+
+func findSettingDef(key string) (settingDef, bool) {
+	for _, def := range settingDefs {
+		if def.key == key {
+			return def, true
+		}
+	}
+	return settingDef{}, false
+}
+
+func defaultGroupSettings() groupSettings {
+	matchOrientations := int64(0)
+	if config.MatchOrientations {
+		matchOrientations = 1
+	}
+	return groupSettings{
+		SimilarDistance:    similarHDThreshold,
+		FuzzyDistance:      config.FuzzyMatchDistance,
+		NoticeDistance:     config.SimilarNoticeDistance,
+		ReplyStyle:         replyStyleMars,
+		WhitelistButtonMin: 3,
+		MediaGroupWaitMs:   groupedMediaWait.Milliseconds(),
+		MatchOrientations:  matchOrientations,
+		CropMatchRegions:   config.CropMatchRegions,
+	}
+}
+
+var (
+	settingsMu    sync.Mutex
+	settingsCache = make(map[int64]groupSettings)
+)
+
+// getGroupSettings returns the settings of groupID, loading them on first use.
+// Errors fall back to the defaults so that detection keeps working.
+func getGroupSettings(ctx context.Context, groupID int64) groupSettings {
+	settingsMu.Lock()
+	s, ok := settingsCache[groupID]
+	settingsMu.Unlock()
+	if ok {
+		return s
+	}
+	s = defaultGroupSettings()
+	rows, err := queries.ListGroupSettings(ctx, groupID)
+	if err != nil {
+		logger.Warn("load group settings", zap.Error(err), zap.Int64("group_id", groupID))
+		return s
+	}
+	for _, row := range rows {
+		if def, ok := findSettingDef(row.Key); ok {
+			*def.field(&s) = clampSetting(def, row.Value)
+		}
+	}
+	settingsMu.Lock()
+	settingsCache[groupID] = s
+	settingsMu.Unlock()
+	return s
+}
+
+func setGroupSetting(ctx context.Context, groupID int64, def settingDef, value int64) (groupSettings, error) {
+	value = clampSetting(def, value)
+	if err := queries.UpsertGroupSetting(ctx, groupID, def.key, value); err != nil {
+		return groupSettings{}, err
+	}
+	s := getGroupSettings(ctx, groupID)
+	*def.field(&s) = value
+	settingsMu.Lock()
+	settingsCache[groupID] = s
+	settingsMu.Unlock()
+	return s, nil
+}
+
+func resetGroupSettings(ctx context.Context, groupID int64) (groupSettings, error) {
+	if err := queries.DeleteGroupSettings(ctx, groupID); err != nil {
+		return groupSettings{}, err
+	}
+	settingsMu.Lock()
+	delete(settingsCache, groupID)
+	settingsMu.Unlock()
+	return getGroupSettings(ctx, groupID), nil
+}
+
+func clampSetting(def settingDef, v int64) int64 {
+	return min(max(v, def.min), def.max)
+}
+
+func formatSettingValue(def settingDef, v int64) string {
+	if def.key == "style" && v >= 0 && v < replyStyleCount {
+		return replyStyleNames[v]
+	}
+	if (def.key == "fuzzy" || def.key == "notice" || def.key == "orient" || def.key == "crop") && v == 0 {
+		return "关闭"
+	}
+	if def.key == "orient" {
+		return "开启"
+	}
+	return strconv.FormatInt(v, 10)
+}
+
+func buildSettingsText(s groupSettings) string {
+	lines := []string{"本群的火星车设置，管理员可以点击按钮修改："}
+	for _, def := range settingDefs {
+		lines = append(lines, fmt.Sprintf("%s: %s", def.title, formatSettingValue(def, *def.field(&s))))
+	}
+	return strings.Join(lines, "\n")
+}
+
+func buildSettingsMarkup(s groupSettings) gotgbot.InlineKeyboardMarkup {
+	rows := make([][]gotgbot.InlineKeyboardButton, 0, len(settingDefs)+1)
+	for _, def := range settingDefs {
+		value := formatSettingValue(def, *def.field(&s))
+		rows = append(rows, []gotgbot.InlineKeyboardButton{
+			{Text: "➖", CallbackData: "set:" + def.key + ":dec"},
+			{Text: def.title + ": " + value, CallbackData: "set:" + def.key + ":show"},
+			{Text: "➕", CallbackData: "set:" + def.key + ":inc"},
+		})
+	}
+	rows = append(rows, []gotgbot.InlineKeyboardButton{{Text: "恢复默认设置", CallbackData: "set:all:reset"}})
+	return gotgbot.InlineKeyboardMarkup{InlineKeyboard: rows}
+}
+
+func handleSettings(b *gotgbot.Bot, ctx *ext.Context) error {
+	msg := ctx.EffectiveMessage
+	if msg == nil || ctx.EffectiveChat == nil {
+		return nil
+	}
+	if ctx.EffectiveChat.Type == "private" {
+		_, err := b.SendMessage(ctx.EffectiveChat.Id, "请在群组中使用该命令。",
+			&gotgbot.SendMessageOpts{ReplyParameters: replyTo(msg.MessageId)})
+		return err
+	}
+	s := getGroupSettings(rootCtx, ctx.EffectiveChat.Id)
+	markup := buildSettingsMarkup(s)
+	_, err := b.SendMessage(ctx.EffectiveChat.Id, buildSettingsText(s), &gotgbot.SendMessageOpts{
+		ReplyParameters: replyTo(msg.MessageId),
+		ReplyMarkup:     &markup,
+	})
+	return err
+}
+
+func handleSettingsCallback(b *gotgbot.Bot, ctx *ext.Context) error {
+	cb := ctx.CallbackQuery
+	if cb == nil || ctx.EffectiveChat == nil || ctx.EffectiveMessage == nil {
+		return nil
+	}
+	parts := strings.Split(cb.Data, ":")
+	if len(parts) != 3 {
+		_, err := cb.Answer(b, &gotgbot.AnswerCallbackQueryOpts{Text: "not valid callback"})
+		return err
+	}
+	key, op := parts[1], parts[2]
+	if op == "show" {
+		_, err := cb.Answer(b, nil)
+		return err
+	}
+
+	groupID := ctx.EffectiveChat.Id
+	var s groupSettings
+	var err error
+	if op == "reset" {
+		s, err = resetGroupSettings(rootCtx, groupID)
+	} else {
+		def, ok := findSettingDef(key)
+		if !ok || (op != "inc" && op != "dec") {
+			_, err := cb.Answer(b, &gotgbot.AnswerCallbackQueryOpts{Text: "not valid callback"})
+			return err
+		}
+		s = getGroupSettings(rootCtx, groupID)
+		value := *def.field(&s)
+		if op == "inc" {
+			value += def.step
+		} else {
+			value -= def.step
+		}
+		s, err = setGroupSetting(rootCtx, groupID, def, value)
+	}
+	if err != nil {
+		return err
+	}
+	markup := buildSettingsMarkup(s)
+	_, _, err = b.EditMessageText(buildSettingsText(s), &gotgbot.EditMessageTextOpts{
+		ChatId:      groupID,
+		MessageId:   ctx.EffectiveMessage.MessageId,
+		ReplyMarkup: markup,
+	})
+	if err != nil && !strings.Contains(err.Error(), "message is not modified") {
+		return err
+	}
+	_, err = cb.Answer(b, nil)
+	return err
+}
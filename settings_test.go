@@ -0,0 +1,48 @@
+package marsbot
+
+import (
+	"context"
+	"testing"
+)
+
+func TestGroupSettingsOverrideDefaults(t *testing.T) {
+	useTestDB(t)
+	ctx := context.Background()
+	const groupID, otherID = -1001, -1002
+
+	def, ok := findSettingDef("wlbtn")
+	if !ok {
+		t.Fatal("wlbtn setting missing")
+	}
+	if _, err := setGroupSetting(ctx, groupID, def, 7); err != nil {
+		t.Fatalf("set setting: %v", err)
+	}
+	style, _ := findSettingDef("style")
+	if _, err := setGroupSetting(ctx, groupID, style, 99); err != nil {
+		t.Fatalf("set setting: %v", err)
+	}
+
+	// drop the cache so the values have to come back from the database
+	settingsMu.Lock()
+	settingsCache = make(map[int64]groupSettings)
+	settingsMu.Unlock()
+
+	s := getGroupSettings(ctx, groupID)
+	if s.WhitelistButtonMin != 7 {
+		t.Fatalf("WhitelistButtonMin = %d, want 7", s.WhitelistButtonMin)
+	}
+	if s.ReplyStyle != replyStyleCount-1 {
+		t.Fatalf("ReplyStyle = %d, want it clamped to %d", s.ReplyStyle, replyStyleCount-1)
+	}
+	if other := getGroupSettings(ctx, otherID); other != defaultGroupSettings() {
+		t.Fatalf("other group got %+v, want defaults", other)
+	}
+
+	s, err := resetGroupSettings(ctx, groupID)
+	if err != nil {
+		t.Fatalf("reset: %v", err)
+	}
+	if s != defaultGroupSettings() {
+		t.Fatalf("after reset got %+v, want defaults", s)
+	}
+}
@@ -0,0 +1,83 @@
+package marsbot
+
+import (
+	"context"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/PaulSonOfLars/gotgbot/v2/ext"
+	"go.uber.org/zap"
+)
+
+// shutdownGrace is how long work that outlived the shutdown deadline gets to notice rootCtx was cancelled.
+const shutdownGrace = 5 * time.Second
+
+var (
+	// rootCtx is the parent of all work started by updates and the backup thread. Shutdown cancels it once
+	// draining has run out of time, so whatever is left aborts instead of holding the database open.
+	rootCtx, cancelRoot = context.WithCancel(context.Background())
+
+	// mediaFlush is closed when shutdown begins, pending albums are then handled without waiting for the rest.
+	mediaFlush     = make(chan struct{})
+	mediaFlushOnce sync.Once
+	mediaWG        sync.WaitGroup
+)
+
+func waitForSignal() {
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, syscall.SIGINT, syscall.SIGTERM)
+	sig := <-sigCh
+	signal.Stop(sigCh)
+	logger.Info("shutting down", zap.String("signal", sig.String()), zap.Duration("timeout", config.ShutdownTimeout))
+}
+
+// shutdown stops taking updates, handles the albums still being collected, waits for running handlers and
+// backups, and closes the database. Whatever has not finished within timeout is cancelled through rootCtx.
+func shutdown(updater *ext.Updater, timeout time.Duration) {
+	drained := make(chan struct{})
+	go func() {
+		defer close(drained)
+		// stops polling or the webhook server, then waits for the handlers that are running
+		if err := updater.Stop(); err != nil {
+			logger.Warn("stop updater", zap.Error(err))
+		}
+		flushMediaGroups()
+		StopBackupThread()
+		stopEvents()
+	}()
+
+	deadline := time.NewTimer(timeout)
+	defer deadline.Stop()
+	select {
+	case <-drained:
+	case <-deadline.C:
+		logger.Warn("shutdown timed out, cancelling in-flight work")
+		cancelRoot()
+		select {
+		case <-drained:
+		case <-time.After(shutdownGrace):
+			logger.Warn("in-flight work did not stop, closing the database anyway")
+		}
+	}
+	cancelRoot()
+	closeDB()
+	logger.Info("marsbot stopped")
+}
+
+// flushMediaGroups makes every pending album handle what it has collected and waits for them.
+func flushMediaGroups() {
+	mediaFlushOnce.Do(func() { close(mediaFlush) })
+	mediaWG.Wait()
+}
+
+func closeDB() {
+	if db == nil {
+		return
+	}
+	if err := db.Close(); err != nil {
+		logger.Warn("close database", zap.Error(err))
+	}
+}
@@ -0,0 +1,40 @@
+package marsbot
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/PaulSonOfLars/gotgbot/v2"
+)
+
+func TestFlushMediaGroupsOnShutdown(t *testing.T) {
+	useTestDB(t)
+	prevFlush, prevGroups := mediaFlush, mediaGroups
+	mediaFlush, mediaFlushOnce, mediaGroups = make(chan struct{}), sync.Once{}, make(map[string]chan *gotgbot.Message)
+	t.Cleanup(func() {
+		mediaFlush, mediaFlushOnce, mediaGroups = prevFlush, sync.Once{}, prevGroups
+	})
+
+	c := make(chan *gotgbot.Message, mediaGroupLimit)
+	mediaGroups["album"] = c
+	c <- &gotgbot.Message{MessageId: 1, MediaGroupId: "album"}
+	mediaWG.Add(1)
+	go flushMediaGroup(nil, "album", c, time.Hour)
+
+	done := make(chan struct{})
+	go func() {
+		flushMediaGroups()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("album was not flushed on shutdown")
+	}
+	mediaMu.Lock()
+	defer mediaMu.Unlock()
+	if _, ok := mediaGroups["album"]; ok {
+		t.Fatalf("flushed album is still pending")
+	}
+}
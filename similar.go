@@ -0,0 +1,221 @@
+package marsbot
+
+import (
+	"context"
+	"sync"
+
+	"go.uber.org/zap"
+
+	"marsbot/bktree"
+	"marsbot/minicv"
+)
+
+type hashKind struct {
+	Media mediaType
+	Algo  minicv.Algo
+	Size  int
+}
+
+type regionKey struct {
+	kind   hashKind
+	region int
+}
+
+// regionTree indexes the hashes of one sub-region, owners maps each of them back to the
+// pic_dhash of the mars_info entries it was taken from.
+type regionTree struct {
+	tree   *bktree.Tree
+	owners map[string][][]byte
+}
+
+// groupIndex holds one BK-tree per hash kind, and one per kind and sub-region, for a single group.
+// It is loaded from mars_info on first use and kept current by recordMars and the whitelist paths.
+type groupIndex struct {
+	mu      sync.Mutex
+	loaded  bool
+	trees   map[hashKind]*bktree.Tree
+	regions map[regionKey]*regionTree
+}
+
+var (
+	similarMu      sync.Mutex
+	similarIndexes = make(map[int64]*groupIndex)
+)
+
+func getGroupIndex(groupID int64) *groupIndex {
+	similarMu.Lock()
+	defer similarMu.Unlock()
+	idx, ok := similarIndexes[groupID]
+	if !ok {
+		idx = &groupIndex{trees: make(map[hashKind]*bktree.Tree), regions: make(map[regionKey]*regionTree)}
+		similarIndexes[groupID] = idx
+	}
+	return idx
+}
+
+// invalidateSimilarIndex drops the cached index so the next search reloads it from the database.
+func invalidateSimilarIndex(groupID int64) {
+	similarMu.Lock()
+	delete(similarIndexes, groupID)
+	similarMu.Unlock()
+}
+
+// indexHash records hash in the group's index if the index has already been loaded.
+// An unloaded index picks the row up from the database when it is first searched.
+func indexHash(groupID int64, hash picHash) {
+	idx := getGroupIndex(groupID)
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	if !idx.loaded {
+		return
+	}
+	kind := hashKind{Media: hash.Media, Algo: hash.Algo, Size: hash.Size}
+	idx.add(kind, hash.Hash)
+	for region, regionHash := range hash.Regions {
+		idx.addRegion(regionKey{kind: kind, region: region}, regionHash, hash.Hash)
+	}
+}
+
+func (idx *groupIndex) add(kind hashKind, hash []byte) {
+	tree, ok := idx.trees[kind]
+	if !ok {
+		tree = bktree.New()
+		idx.trees[kind] = tree
+	}
+	tree.Add(hash)
+}
+
+func (idx *groupIndex) addRegion(key regionKey, regionHash, owner []byte) {
+	rt, ok := idx.regions[key]
+	if !ok {
+		rt = &regionTree{tree: bktree.New(), owners: make(map[string][][]byte)}
+		idx.regions[key] = rt
+	}
+	rt.tree.Add(regionHash)
+	rt.owners[string(regionHash)] = append(rt.owners[string(regionHash)], owner)
+}
+
+func (idx *groupIndex) load(ctx context.Context, groupID int64) error {
+	if idx.loaded {
+		return nil
+	}
+	rows, err := queries.ListMarsInfoByGroup(ctx, groupID)
+	if err != nil {
+		return err
+	}
+	for _, row := range rows {
+		kind := hashKind{Media: mediaType(row.MediaType), Algo: minicv.Algo(row.HashAlgo), Size: int(row.HashSize)}
+		idx.add(kind, row.PicDhash)
+	}
+	regionRows, err := queries.ListRegionHashesByGroup(ctx, groupID)
+	if err != nil {
+		return err
+	}
+	for _, row := range regionRows {
+		kind := hashKind{Media: mediaType(row.MediaType), Algo: minicv.Algo(row.HashAlgo), Size: int(row.HashSize)}
+		idx.addRegion(regionKey{kind: kind, region: int(row.Region)}, row.RegionHash, row.PicDhash)
+	}
+	idx.loaded = true
+	logger.Debug("loaded similar index", zap.Int64("group_id", groupID),
+		zap.Int("rows", len(rows)), zap.Int("region_rows", len(regionRows)))
+	return nil
+}
+
+// searchSimilar returns the stored hashes of the same kind as target whose distance is below maxDistance, nearest first.
+func searchSimilar(ctx context.Context, groupID int64, target picHash, maxDistance int, limit int) ([]bktree.Match, error) {
+	idx := getGroupIndex(groupID)
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	if err := idx.load(ctx, groupID); err != nil {
+		return nil, err
+	}
+	tree, ok := idx.trees[hashKind{Media: target.Media, Algo: target.Algo, Size: target.Size}]
+	if !ok || maxDistance <= 0 {
+		return nil, nil
+	}
+	matches := tree.Search(target.Hash, maxDistance-1)
+	if limit > 0 && len(matches) > limit {
+		matches = matches[:limit]
+	}
+	return matches, nil
+}
+
+// nearestSimilar returns the closest stored hash of the same kind within maxDistance bits, ignoring hash itself.
+func nearestSimilar(ctx context.Context, groupID int64, hash picHash, maxDistance int) (bktree.Match, bool, error) {
+	matches, err := searchSimilar(ctx, groupID, hash, maxDistance+1, 2)
+	if err != nil {
+		return bktree.Match{}, false, err
+	}
+	for _, m := range matches {
+		if m.Distance > 0 {
+			return bktree.Match{Hash: append([]byte(nil), m.Hash...), Distance: m.Distance}, true, nil
+		}
+	}
+	return bktree.Match{}, false, nil
+}
+
+// nearestOriented returns the closest stored hash within maxDistance bits of a rotated or mirrored copy of hash,
+// and the orientation that produced it. The plain hash is left to nearestSimilar, so OrientIdentity is skipped.
+func nearestOriented(ctx context.Context, groupID int64, hash picHash, maxDistance int) (bktree.Match, minicv.Orientation, bool, error) {
+	var best bktree.Match
+	bestOrient := minicv.OrientIdentity
+	found := false
+	for o := minicv.OrientIdentity + 1; o < minicv.OrientationCount; o++ {
+		turned := hash
+		turned.Hash = hash.Orientations[o]
+		matches, err := searchSimilar(ctx, groupID, turned, maxDistance+1, 1)
+		if err != nil {
+			return bktree.Match{}, minicv.OrientIdentity, false, err
+		}
+		if len(matches) > 0 && (!found || matches[0].Distance < best.Distance) {
+			best = bktree.Match{Hash: append([]byte(nil), matches[0].Hash...), Distance: matches[0].Distance}
+			bestOrient = o
+			found = true
+		}
+	}
+	return best, bestOrient, found, nil
+}
+
+type cropMatch struct {
+	Hash    []byte
+	Regions int
+}
+
+// bestCropMatch returns the stored entry of the same kind as hash with the most sub-regions within maxDistance bits
+// of the matching sub-region of hash, provided at least minRegions agree. hash itself never matches.
+func bestCropMatch(ctx context.Context, groupID int64, hash picHash, maxDistance int, minRegions int) (cropMatch, bool, error) {
+	idx := getGroupIndex(groupID)
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	if err := idx.load(ctx, groupID); err != nil {
+		return cropMatch{}, false, err
+	}
+	kind := hashKind{Media: hash.Media, Algo: hash.Algo, Size: hash.Size}
+	votes := make(map[string]int)
+	for region, regionHash := range hash.Regions {
+		rt, ok := idx.regions[regionKey{kind: kind, region: region}]
+		if !ok {
+			continue
+		}
+		// an entry can own several close hashes of one region, it still only gets one vote for it
+		voted := make(map[string]bool)
+		for _, m := range rt.tree.Search(regionHash, maxDistance) {
+			for _, owner := range rt.owners[string(m.Hash)] {
+				if key := string(owner); !voted[key] {
+					voted[key] = true
+					votes[key]++
+				}
+			}
+		}
+	}
+	var best cropMatch
+	for owner, n := range votes {
+		if owner == string(hash.Hash) || n < minRegions {
+			continue
+		}
+		if n > best.Regions || (n == best.Regions && owner < string(best.Hash)) {
+			best = cropMatch{Hash: []byte(owner), Regions: n}
+		}
+	}
+	return best, best.Regions > 0, nil
+}
@@ -1,4 +1,4 @@
-CREATE TABLE group_user_in_whitelist
+CREATE TABLE IF NOT EXISTS group_user_in_whitelist
 (
     group_id INTEGER NOT NULL,
     user_id  INTEGER NOT NULL,
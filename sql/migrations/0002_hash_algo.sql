@@ -0,0 +1,36 @@
+-- Record which perceptual hash algorithm produced each stored hash (0 = dhash).
+CREATE TABLE mars_info_new
+(
+    group_id     INTEGER           not null,
+    pic_dhash    BLOB              not null,
+    count        INTEGER default 0 not null,
+    last_msg_id  INTEGER default 0 not null,
+    in_whitelist INTEGER default 0 not null,
+    hash_algo    INTEGER default 0 not null,
+    primary key (group_id, hash_algo, pic_dhash),
+    check (count >= 0),
+    check (in_whitelist IN (0, 1)),
+    check (last_msg_id >= 0)
+) without rowid;
+
+INSERT INTO mars_info_new (group_id, pic_dhash, count, last_msg_id, in_whitelist, hash_algo)
+SELECT group_id, pic_dhash, count, last_msg_id, in_whitelist, 0
+FROM mars_info;
+
+DROP TABLE mars_info;
+ALTER TABLE mars_info_new RENAME TO mars_info;
+
+CREATE TABLE fuid_to_dhash_new
+(
+    fuid      TEXT              not null,
+    dhash     BLOB              not null,
+    hash_algo INTEGER default 0 not null,
+    primary key (fuid, hash_algo)
+) without rowid;
+
+INSERT INTO fuid_to_dhash_new (fuid, dhash, hash_algo)
+SELECT fuid, dhash, 0
+FROM fuid_to_dhash;
+
+DROP TABLE fuid_to_dhash;
+ALTER TABLE fuid_to_dhash_new RENAME TO fuid_to_dhash;
@@ -0,0 +1,20 @@
+-- Record the side of the bit grid of each stored hash (8 = 64-bit, 16 = 256-bit).
+-- pic_dhash blobs of different sizes never compare equal, so the mars_info key stays as is.
+ALTER TABLE mars_info
+    ADD COLUMN hash_size INTEGER default 8 not null;
+
+CREATE TABLE fuid_to_dhash_new
+(
+    fuid      TEXT              not null,
+    dhash     BLOB              not null,
+    hash_algo INTEGER default 0 not null,
+    hash_size INTEGER default 8 not null,
+    primary key (fuid, hash_algo, hash_size)
+) without rowid;
+
+INSERT INTO fuid_to_dhash_new (fuid, dhash, hash_algo, hash_size)
+SELECT fuid, dhash, hash_algo, 8
+FROM fuid_to_dhash;
+
+DROP TABLE fuid_to_dhash;
+ALTER TABLE fuid_to_dhash_new RENAME TO fuid_to_dhash;
@@ -0,0 +1,8 @@
+-- Per-group overrides of the global defaults, one row per changed setting.
+CREATE TABLE IF NOT EXISTS group_settings
+(
+    group_id INTEGER not null,
+    key      TEXT    not null,
+    value    INTEGER not null,
+    primary key (group_id, key)
+) without rowid;
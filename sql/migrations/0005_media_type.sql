@@ -0,0 +1,24 @@
+-- Separate namespaces for photos (0), videos (1), animations (2) and video notes (3),
+-- the latter three hashed from their Telegram thumbnail.
+CREATE TABLE mars_info_new
+(
+    group_id     INTEGER           not null,
+    pic_dhash    BLOB              not null,
+    count        INTEGER default 0 not null,
+    last_msg_id  INTEGER default 0 not null,
+    in_whitelist INTEGER default 0 not null,
+    hash_algo    INTEGER default 0 not null,
+    hash_size    INTEGER default 8 not null,
+    media_type   INTEGER default 0 not null,
+    primary key (group_id, media_type, hash_algo, pic_dhash),
+    check (count >= 0),
+    check (in_whitelist IN (0, 1)),
+    check (last_msg_id >= 0)
+) without rowid;
+
+INSERT INTO mars_info_new (group_id, pic_dhash, count, last_msg_id, in_whitelist, hash_algo, hash_size, media_type)
+SELECT group_id, pic_dhash, count, last_msg_id, in_whitelist, hash_algo, hash_size, 0
+FROM mars_info;
+
+DROP TABLE mars_info;
+ALTER TABLE mars_info_new RENAME TO mars_info;
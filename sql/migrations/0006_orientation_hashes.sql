@@ -0,0 +1,4 @@
+-- Cache the dhash of all 8 rotations and mirrors next to the plain hash, concatenated in
+-- minicv.Orientation order. NULL for other algorithms and for rows cached before this column.
+ALTER TABLE fuid_to_dhash
+    ADD COLUMN orientations BLOB;
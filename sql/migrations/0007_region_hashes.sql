@@ -0,0 +1,16 @@
+-- Hashes of the sub-regions in minicv.Regions of each mars_info entry, used to match cropped copies.
+-- Rows follow their mars_info entry and must be deleted together with it.
+CREATE TABLE IF NOT EXISTS mars_region_hash
+(
+    group_id    INTEGER not null,
+    media_type  INTEGER not null,
+    hash_algo   INTEGER not null,
+    pic_dhash   BLOB    not null,
+    region      INTEGER not null,
+    region_hash BLOB    not null,
+    primary key (group_id, media_type, hash_algo, pic_dhash, region)
+) without rowid;
+
+-- Region hashes cached next to the plain hash, concatenated in minicv.Regions order.
+ALTER TABLE fuid_to_dhash
+    ADD COLUMN regions BLOB;
@@ -2,43 +2,57 @@
 SELECT *
 FROM mars_info
 WHERE group_id = ?
+  AND media_type = ?
+  AND hash_algo = ?
   AND pic_dhash = ?;
 
 -- name: UpsertMarsInfo :exec
-INSERT INTO mars_info (group_id, pic_dhash, count, last_msg_id, in_whitelist)
-VALUES (?, ?, ?, ?, ?)
-ON CONFLICT(group_id, pic_dhash) DO UPDATE SET count=excluded.count,
-                                               last_msg_id=excluded.last_msg_id,
-                                               in_whitelist=excluded.in_whitelist;
+INSERT INTO mars_info (group_id, media_type, hash_algo, hash_size, pic_dhash, count, last_msg_id, in_whitelist)
+VALUES (?, ?, ?, ?, ?, ?, ?, ?)
+ON CONFLICT(group_id, media_type, hash_algo, pic_dhash) DO UPDATE SET count=excluded.count,
+                                                                      last_msg_id=excluded.last_msg_id,
+                                                                      in_whitelist=excluded.in_whitelist;
 
 -- name: IncrementMarsInfo :one
-INSERT INTO mars_info (group_id, pic_dhash, count, last_msg_id, in_whitelist)
-VALUES (?, ?, 1, ?, 0)
-ON CONFLICT(group_id, pic_dhash) DO UPDATE SET count       = count + 1,
-                                               last_msg_id = excluded.last_msg_id
+INSERT INTO mars_info (group_id, media_type, hash_algo, hash_size, pic_dhash, count, last_msg_id, in_whitelist)
+VALUES (?, ?, ?, ?, ?, 1, ?, 0)
+ON CONFLICT(group_id, media_type, hash_algo, pic_dhash) DO UPDATE SET count       = count + 1,
+                                                                      last_msg_id = excluded.last_msg_id
 RETURNING group_id,
     pic_dhash,
     count,
     last_msg_id,
-    in_whitelist;
+    in_whitelist,
+    hash_algo,
+    hash_size,
+    media_type;
 
 -- name: GetDhashFromFileUid :one
-SELECT dhash
+SELECT dhash, orientations, regions
 FROM fuid_to_dhash
-WHERE fuid = ?;
+WHERE fuid = ?
+  AND hash_algo = ?
+  AND hash_size = ?;
 
 -- name: IsUserInWhitelist :one
 SELECT EXISTS (SELECT 1 FROM group_user_in_whitelist WHERE group_id = ? AND user_id = ?);
 
 -- name: UpsertDhash :exec
-INSERT INTO fuid_to_dhash (fuid, dhash)
-VALUES (?, ?)
-ON CONFLICT DO UPDATE SET dhash=excluded.dhash;
+INSERT INTO fuid_to_dhash (fuid, hash_algo, hash_size, dhash, orientations, regions)
+VALUES (?, ?, ?, ?, ?, ?)
+ON CONFLICT DO UPDATE SET dhash=excluded.dhash,
+                          orientations=excluded.orientations,
+                          regions=excluded.regions;
 
 -- name: AddUserToWhitelist :exec
 INSERT INTO group_user_in_whitelist(group_id, user_id)
 VALUES (?, ?);
 
+-- name: ListWhitelistUsersByGroup :many
+SELECT user_id
+FROM group_user_in_whitelist
+WHERE group_id = ?;
+
 -- name: DeleteUserFromWhitelist :exec
 DELETE
 FROM group_user_in_whitelist
@@ -46,9 +60,9 @@ WHERE group_id = ?
   AND user_id = ?;
 
 -- name: SetMarsWhitelist :exec
-INSERT INTO mars_info (group_id, pic_dhash, count, last_msg_id, in_whitelist)
-VALUES (?, ?, 0, 0, ?)
-ON CONFLICT(group_id, pic_dhash) DO UPDATE SET in_whitelist = excluded.in_whitelist;
+INSERT INTO mars_info (group_id, media_type, hash_algo, hash_size, pic_dhash, count, last_msg_id, in_whitelist)
+VALUES (?, ?, ?, ?, ?, 0, 0, ?)
+ON CONFLICT(group_id, media_type, hash_algo, pic_dhash) DO UPDATE SET in_whitelist = excluded.in_whitelist;
 
 -- name: IncrementGroupStat :exec
 INSERT INTO mars_group_stat (group_id, image_count)
@@ -66,7 +80,7 @@ FROM mars_group_stat
 WHERE group_id = ?;
 
 -- name: ListMarsInfoByGroup :many
-SELECT group_id, pic_dhash, count, last_msg_id, in_whitelist
+SELECT group_id, pic_dhash, count, last_msg_id, in_whitelist, hash_algo, hash_size, media_type
 FROM mars_info
 WHERE group_id = ?;
 
@@ -75,6 +89,52 @@ SELECT sqlc.embed(mars_info),
        CAST(hamming_distance(pic_dhash, CAST(@src_dhash AS BLOB)) AS INTEGER) AS hd
 FROM mars_info
 WHERE group_id = ?
+  AND media_type = ?
+  AND hash_algo = ?
+  AND hash_size = ?
   AND hd < CAST(@min_distance AS INTEGER)
 ORDER BY hd
-LIMIT 10;
\ No newline at end of file
+LIMIT 10;
+
+-- name: ListGroupSettings :many
+SELECT key, value
+FROM group_settings
+WHERE group_id = ?;
+
+-- name: UpsertGroupSetting :exec
+INSERT INTO group_settings (group_id, key, value)
+VALUES (?, ?, ?)
+ON CONFLICT(group_id, key) DO UPDATE SET value = excluded.value;
+
+-- name: DeleteGroupSettings :exec
+DELETE
+FROM group_settings
+WHERE group_id = ?;
+
+-- name: UpsertRegionHash :exec
+INSERT INTO mars_region_hash (group_id, media_type, hash_algo, pic_dhash, region, region_hash)
+VALUES (?, ?, ?, ?, ?, ?)
+ON CONFLICT DO UPDATE SET region_hash=excluded.region_hash;
+
+-- name: ListRegionHashesByGroup :many
+SELECT r.media_type, r.hash_algo, m.hash_size, r.pic_dhash, r.region, r.region_hash
+FROM mars_region_hash r
+         JOIN mars_info m
+              ON m.group_id = r.group_id AND m.media_type = r.media_type AND m.hash_algo = r.hash_algo AND
+                 m.pic_dhash = r.pic_dhash
+WHERE r.group_id = ?;
+
+-- name: DeleteMarsInfoByGroup :exec
+DELETE
+FROM mars_info
+WHERE group_id = ?;
+
+-- name: DeleteRegionHashesByGroup :exec
+DELETE
+FROM mars_region_hash
+WHERE group_id = ?;
+
+-- name: RefreshGroupStat :exec
+INSERT INTO mars_group_stat (group_id, image_count)
+VALUES (?1, (SELECT COUNT(*) FROM mars_info WHERE group_id = ?1))
+ON CONFLICT(group_id) DO UPDATE SET image_count = excluded.image_count;
@@ -0,0 +1,354 @@
+package marsbot
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+	"go.uber.org/zap"
+)
+
+// BackupTarget is a place backups and deltas are uploaded to. Keys are flat file names.
+type BackupTarget interface {
+	// Name identifies the target in logs and in the -target flag of the backup subcommands.
+	Name() string
+	Put(ctx context.Context, key string, r io.Reader, size int64, info objectInfo) error
+	// List returns the objects whose key starts with prefix, in no particular order and without Deltas.
+	List(ctx context.Context, prefix string) ([]backupObject, error)
+	Get(ctx context.Context, key string) (io.ReadCloser, error)
+	// Stat returns the metadata stored with key by Put, ContentType may be empty.
+	Stat(ctx context.Context, key string) (objectInfo, error)
+	Delete(ctx context.Context, key string) error
+}
+
+// objectInfo is stored next to an object, as user metadata on S3 and as a key.meta.json file on disk.
+type objectInfo struct {
+	ContentType string
+	Metadata    map[string]string
+}
+
+// configuredBackupTargets returns every target set up in the environment, S3 first.
+func configuredBackupTargets() ([]BackupTarget, error) {
+	var targets []BackupTarget
+	if config.S3ApiEndpoint != "" || config.S3Bucket != "" {
+		if err := ensureS3Configured(); err != nil {
+			return nil, err
+		}
+		t, err := newS3Target()
+		if err != nil {
+			return nil, err
+		}
+		targets = append(targets, t)
+	}
+	if config.BackupLocalDir != "" {
+		if err := os.MkdirAll(config.BackupLocalDir, 0o700); err != nil {
+			return nil, fmt.Errorf("create backup dir: %w", err)
+		}
+		targets = append(targets, localTarget{dir: config.BackupLocalDir})
+	}
+	if len(targets) == 0 {
+		return nil, errors.New("no backup target configured, set S3_API_ENDPOINT or BACKUP_LOCAL_DIR")
+	}
+	return targets, nil
+}
+
+func findBackupTarget(targets []BackupTarget, name string) (BackupTarget, error) {
+	if name == "" {
+		return targets[0], nil
+	}
+	var names []string
+	for _, t := range targets {
+		if t.Name() == name {
+			return t, nil
+		}
+		names = append(names, t.Name())
+	}
+	return nil, fmt.Errorf("backup target %q is not configured, have %s", name, strings.Join(names, ", "))
+}
+
+// uploadBackup puts the file at path, encrypted if BACKUP_KEY_FILE is set, to every target under its base name,
+// with meta stored alongside. A failing target does not stop the others, the failures are returned joined with
+// the number of successes.
+func uploadBackup(ctx context.Context, targets []BackupTarget, path string, meta map[string]string) (int, error) {
+	key, err := configuredBackupKey()
+	if err != nil {
+		return 0, err
+	}
+	name := filepath.Base(path)
+	uploaded := 0
+	var errs []error
+	for _, t := range targets {
+		fingerprint, err := uploadBackupTo(ctx, t, path, key, meta)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("upload %s to %s: %w", name, t.Name(), err))
+			continue
+		}
+		uploaded++
+		if logger != nil {
+			logger.Info("backup uploaded", zap.String("target", t.Name()), zap.String("key", name),
+				zap.String("key_fingerprint", fingerprint))
+		}
+	}
+	return uploaded, errors.Join(errs...)
+}
+
+func uploadBackupTo(ctx context.Context, t BackupTarget, path string, key []byte, meta map[string]string) (string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+	stat, err := file.Stat()
+	if err != nil {
+		return "", err
+	}
+	var body io.Reader = file
+	size := stat.Size()
+	info := objectInfo{ContentType: "application/zstd", Metadata: make(map[string]string)}
+	for k, v := range meta {
+		info.Metadata[k] = v
+	}
+	var fingerprint string
+	if key != nil {
+		if body, err = newEncryptReader(file, key); err != nil {
+			return "", fmt.Errorf("encrypt backup: %w", err)
+		}
+		size = encryptedSize(size)
+		fp := keyFingerprint(key)
+		fingerprint = hex.EncodeToString(fp[:])
+		info.ContentType = "application/octet-stream"
+		info.Metadata["Encryption"] = "aes-256-gcm"
+		info.Metadata["Key-Fingerprint"] = fingerprint
+	}
+	return fingerprint, t.Put(ctx, filepath.Base(path), body, size, info)
+}
+
+type s3Target struct {
+	client *minio.Client
+	bucket string
+}
+
+func newS3Target() (*s3Target, error) {
+	client, err := newS3Client()
+	if err != nil {
+		return nil, err
+	}
+	return &s3Target{client: client, bucket: config.S3Bucket}, nil
+}
+
+func newS3Client() (*minio.Client, error) {
+	opts := &minio.Options{
+		Creds:  credentials.NewStaticV4(config.S3ApiKeyID, config.S3ApiKeySecret, ""),
+		Secure: config.S3UseTLS,
+		Region: config.S3Region,
+	}
+	if config.S3PathStyle {
+		opts.BucketLookup = minio.BucketLookupPath
+	}
+	if config.S3CAFile != "" {
+		pem, err := os.ReadFile(config.S3CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("read S3_CA_FILE: %w", err)
+		}
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %s", config.S3CAFile)
+		}
+		transport, err := minio.DefaultTransport(config.S3UseTLS)
+		if err != nil {
+			return nil, err
+		}
+		// minio only sets up TLS for secure transports
+		if transport.TLSClientConfig == nil {
+			transport.TLSClientConfig = &tls.Config{MinVersion: tls.VersionTLS12}
+		}
+		transport.TLSClientConfig.RootCAs = pool
+		opts.Transport = transport
+	}
+	client, err := minio.New(config.S3ApiEndpoint, opts)
+	if err != nil {
+		return nil, fmt.Errorf("create s3 client: %w", err)
+	}
+	return client, nil
+}
+
+func (t *s3Target) Name() string { return "s3" }
+
+func (t *s3Target) Put(ctx context.Context, key string, r io.Reader, size int64, info objectInfo) error {
+	_, err := t.client.PutObject(ctx, t.bucket, key, r, size, minio.PutObjectOptions{
+		ContentType:  info.ContentType,
+		UserMetadata: info.Metadata,
+	})
+	return err
+}
+
+func (t *s3Target) List(ctx context.Context, prefix string) ([]backupObject, error) {
+	var objects []backupObject
+	for obj := range t.client.ListObjects(ctx, t.bucket, minio.ListObjectsOptions{Prefix: prefix}) {
+		if obj.Err != nil {
+			return nil, obj.Err
+		}
+		objects = append(objects, backupObject{Key: obj.Key, Size: obj.Size, LastModified: obj.LastModified})
+	}
+	return objects, nil
+}
+
+func (t *s3Target) Get(ctx context.Context, key string) (io.ReadCloser, error) {
+	return t.client.GetObject(ctx, t.bucket, key, minio.GetObjectOptions{})
+}
+
+func (t *s3Target) Stat(ctx context.Context, key string) (objectInfo, error) {
+	obj, err := t.client.StatObject(ctx, t.bucket, key, minio.StatObjectOptions{})
+	if err != nil {
+		return objectInfo{}, err
+	}
+	return objectInfo{ContentType: obj.ContentType, Metadata: obj.UserMetadata}, nil
+}
+
+func (t *s3Target) Delete(ctx context.Context, key string) error {
+	return t.client.RemoveObject(ctx, t.bucket, key, minio.RemoveObjectOptions{})
+}
+
+// localTarget keeps backups as files in dir, for a local copy or a mounted volume.
+type localTarget struct {
+	dir string
+}
+
+const localMetaSuffix = ".meta.json"
+
+func (t localTarget) Name() string { return "local" }
+
+func (t localTarget) path(key string) (string, error) {
+	if key == "" || key != filepath.Base(key) || strings.HasPrefix(key, ".") {
+		return "", fmt.Errorf("invalid backup key %q", key)
+	}
+	return filepath.Join(t.dir, key), nil
+}
+
+// Put writes to temporary files first and stores the metadata only after the data is in place,
+// so a backup is either complete or absent and no metadata is left without its backup.
+func (t localTarget) Put(_ context.Context, key string, r io.Reader, size int64, info objectInfo) error {
+	path, err := t.path(key)
+	if err != nil {
+		return err
+	}
+	var meta []byte
+	if len(info.Metadata) > 0 {
+		if meta, err = json.Marshal(info.Metadata); err != nil {
+			return err
+		}
+	}
+	if err := t.writeFile(path, r, size); err != nil {
+		return err
+	}
+	if meta == nil {
+		err = os.Remove(path + localMetaSuffix)
+		if os.IsNotExist(err) {
+			err = nil
+		}
+	} else {
+		err = t.writeFile(path+localMetaSuffix, bytes.NewReader(meta), int64(len(meta)))
+	}
+	if err != nil {
+		_ = os.Remove(path)
+		return fmt.Errorf("write metadata: %w", err)
+	}
+	return nil
+}
+
+// writeFile replaces path with the size bytes of r through a temporary file in the same directory.
+func (t localTarget) writeFile(path string, r io.Reader, size int64) error {
+	tmp, err := os.CreateTemp(t.dir, "."+filepath.Base(path)+".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	n, err := io.Copy(tmp, r)
+	if err == nil && size >= 0 && n != size {
+		err = fmt.Errorf("wrote %d bytes, expected %d", n, size)
+	}
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+func (t localTarget) List(_ context.Context, prefix string) ([]backupObject, error) {
+	entries, err := os.ReadDir(t.dir)
+	if err != nil {
+		return nil, err
+	}
+	var objects []backupObject
+	for _, e := range entries {
+		name := e.Name()
+		if e.IsDir() || !strings.HasPrefix(name, prefix) || strings.HasSuffix(name, localMetaSuffix) {
+			continue
+		}
+		fi, err := e.Info()
+		if err != nil {
+			return nil, err
+		}
+		objects = append(objects, backupObject{Key: name, Size: fi.Size(), LastModified: fi.ModTime()})
+	}
+	return objects, nil
+}
+
+func (t localTarget) Get(_ context.Context, key string) (io.ReadCloser, error) {
+	path, err := t.path(key)
+	if err != nil {
+		return nil, err
+	}
+	return os.Open(path)
+}
+
+func (t localTarget) Stat(_ context.Context, key string) (objectInfo, error) {
+	path, err := t.path(key)
+	if err != nil {
+		return objectInfo{}, err
+	}
+	if _, err := os.Stat(path); err != nil {
+		return objectInfo{}, err
+	}
+	var info objectInfo
+	data, err := os.ReadFile(path + localMetaSuffix)
+	if os.IsNotExist(err) {
+		return info, nil
+	} else if err != nil {
+		return objectInfo{}, err
+	}
+	if err := json.Unmarshal(data, &info.Metadata); err != nil {
+		return objectInfo{}, fmt.Errorf("read metadata of %s: %w", key, err)
+	}
+	return info, nil
+}
+
+func (t localTarget) Delete(_ context.Context, key string) error {
+	path, err := t.path(key)
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(path + localMetaSuffix); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return os.Remove(path)
+}
@@ -0,0 +1,137 @@
+package marsbot
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"go.uber.org/zap"
+)
+
+type failingTarget struct{ BackupTarget }
+
+func (failingTarget) Name() string { return "broken" }
+
+func (failingTarget) Put(context.Context, string, io.Reader, int64, objectInfo) error {
+	return errors.New("endpoint unreachable")
+}
+
+func TestLocalTargetRoundTrip(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	target := localTarget{dir: dir}
+	key := "backup_mars_at_2024-01-01-00_00_00.db.zst"
+	info := objectInfo{Metadata: map[string]string{"Encryption": "aes-256-gcm"}}
+	if err := target.Put(ctx, key, strings.NewReader("data"), 4, info); err != nil {
+		t.Fatalf("put: %v", err)
+	}
+	// a failed write must not leave metadata behind, the check after Delete below finds it otherwise
+	if err := target.Put(ctx, "backup_mars_at_short.db.zst", strings.NewReader("data"), 5, info); err == nil {
+		t.Fatalf("expected a short write to fail")
+	}
+	if err := target.Put(ctx, "../escape", strings.NewReader("data"), 4, objectInfo{}); err == nil {
+		t.Fatalf("expected a key outside the directory to be rejected")
+	}
+
+	objects, err := target.List(ctx, backupKeyPrefix)
+	if err != nil {
+		t.Fatalf("list: %v", err)
+	}
+	if len(objects) != 1 || objects[0].Key != key || objects[0].Size != 4 {
+		t.Fatalf("list = %+v", objects)
+	}
+	r, err := target.Get(ctx, key)
+	if err != nil {
+		t.Fatalf("get: %v", err)
+	}
+	data, _ := io.ReadAll(r)
+	r.Close()
+	if string(data) != "data" {
+		t.Fatalf("get = %q", data)
+	}
+
+	if err := target.Delete(ctx, key); err != nil {
+		t.Fatalf("delete: %v", err)
+	}
+	entries, _ := os.ReadDir(dir)
+	if len(entries) != 0 {
+		t.Fatalf("files left after delete: %v", entries)
+	}
+}
+
+func TestUploadBackupFanOut(t *testing.T) {
+	saved := config
+	t.Cleanup(func() { config = saved })
+	config.BackupKeyFile = ""
+
+	ctx := context.Background()
+	src := filepath.Join(t.TempDir(), "backup_mars_at_2024-01-01-00_00_00.db.zst")
+	if err := os.WriteFile(src, []byte("backup"), 0o600); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	local := localTarget{dir: t.TempDir()}
+	uploaded, err := uploadBackup(ctx, []BackupTarget{failingTarget{}, local}, src, nil)
+	if uploaded != 1 {
+		t.Fatalf("uploaded = %d, want 1", uploaded)
+	}
+	if err == nil || !strings.Contains(err.Error(), "broken") {
+		t.Fatalf("expected the failing target in the error, got %v", err)
+	}
+	backups, err := listBackups(ctx, local)
+	if err != nil || len(backups) != 1 || backups[0].Key != filepath.Base(src) {
+		t.Fatalf("local backups = %+v, %v", backups, err)
+	}
+}
+
+func TestConfiguredBackupTargets(t *testing.T) {
+	saved := config
+	t.Cleanup(func() { config = saved })
+	config.BackupConfig = BackupConfig{}
+	if _, err := configuredBackupTargets(); err == nil {
+		t.Fatalf("expected an error without any target")
+	}
+	config.S3ApiEndpoint = "localhost:9000"
+	if _, err := configuredBackupTargets(); err == nil {
+		t.Fatalf("expected an error for incomplete S3 settings")
+	}
+	config.BackupConfig = BackupConfig{BackupLocalDir: filepath.Join(t.TempDir(), "backups")}
+	targets, err := configuredBackupTargets()
+	if err != nil || len(targets) != 1 || targets[0].Name() != "local" {
+		t.Fatalf("targets = %v, %v", targets, err)
+	}
+	if _, err := findBackupTarget(targets, "s3"); err == nil {
+		t.Fatalf("expected an unconfigured target to be rejected")
+	}
+}
+
+func TestS3CAFileWithoutTLS(t *testing.T) {
+	saved, savedLogger := config, logger
+	t.Cleanup(func() { config, logger = saved, savedLogger })
+	logger = zap.NewNop()
+	caFile, _, err := ensureSelfSignedCert(t.TempDir(), "s3.example.com")
+	if err != nil {
+		t.Fatalf("certificate: %v", err)
+	}
+	config.BackupConfig = BackupConfig{
+		S3ApiEndpoint:  "s3.example.com",
+		S3Bucket:       "backups",
+		S3ApiKeyID:     "id",
+		S3ApiKeySecret: "secret",
+		S3CAFile:       caFile,
+	}
+	if _, err := configuredBackupTargets(); err == nil {
+		t.Fatalf("expected S3_CA_FILE without S3_USE_TLS to be rejected")
+	}
+	// the client itself must not fall over a plain http transport either
+	if _, err := newS3Client(); err != nil {
+		t.Fatalf("client without tls: %v", err)
+	}
+	config.S3UseTLS = true
+	if _, err := configuredBackupTargets(); err != nil {
+		t.Fatalf("client with tls and a CA file: %v", err)
+	}
+}
@@ -0,0 +1,267 @@
+package marsbot
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/PaulSonOfLars/gotgbot/v2"
+	"go.uber.org/zap"
+)
+
+// Every full backup carries a manifest of the snapshot it was made from in its metadata,
+// so a test restore can tell a broken backup from a database that has simply moved on.
+const (
+	metaDbSHA256  = "Db-Sha256"
+	metaRowCounts = "Row-Counts"
+)
+
+// growOnlyTables never lose rows outside an /import replace, so a live count below the backup's means
+// the backup holds rows the database has lost, or the backup is not of this database.
+var growOnlyTables = []string{"mars_info", "fuid_to_dhash"}
+
+// alertBot delivers backup alerts to BACKUP_ALERT_CHAT_ID, it is nil until the bot is built.
+var alertBot atomic.Pointer[gotgbot.Bot]
+
+type backupManifest struct {
+	// SHA256 is the hex digest of the uncompressed database file.
+	SHA256 string
+	Rows   map[string]int64
+}
+
+func (m backupManifest) metadata() map[string]string {
+	tables := make([]string, 0, len(m.Rows))
+	for table := range m.Rows {
+		tables = append(tables, table)
+	}
+	sort.Strings(tables)
+	counts := make([]string, len(tables))
+	for i, table := range tables {
+		counts[i] = table + "=" + strconv.FormatInt(m.Rows[table], 10)
+	}
+	return map[string]string{metaDbSHA256: m.SHA256, metaRowCounts: strings.Join(counts, ",")}
+}
+
+// parseBackupManifest reads the manifest back from object metadata, ok is false for backups made without one.
+func parseBackupManifest(meta map[string]string) (m backupManifest, ok bool, err error) {
+	sum, rows := meta[metaDbSHA256], meta[metaRowCounts]
+	if sum == "" && rows == "" {
+		return backupManifest{}, false, nil
+	}
+	m = backupManifest{SHA256: sum, Rows: make(map[string]int64)}
+	if rows == "" {
+		return m, true, nil
+	}
+	for _, pair := range strings.Split(rows, ",") {
+		table, n, found := strings.Cut(pair, "=")
+		count, err := strconv.ParseInt(n, 10, 64)
+		if !found || err != nil {
+			return backupManifest{}, false, fmt.Errorf("invalid row count %q", pair)
+		}
+		m.Rows[table] = count
+	}
+	return m, true, nil
+}
+
+// tableRowCounts counts the rows of every table of conn.
+func tableRowCounts(ctx context.Context, conn *sql.DB) (map[string]int64, error) {
+	rows, err := conn.QueryContext(ctx, "SELECT name FROM sqlite_master WHERE type = 'table' AND name NOT LIKE 'sqlite_%'")
+	if err != nil {
+		return nil, err
+	}
+	var tables []string
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		tables = append(tables, name)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	counts := make(map[string]int64, len(tables))
+	for _, table := range tables {
+		var n int64
+		query := `SELECT count(*) FROM "` + strings.ReplaceAll(table, `"`, `""`) + `"`
+		if err := conn.QueryRowContext(ctx, query).Scan(&n); err != nil {
+			return nil, fmt.Errorf("count %s: %w", table, err)
+		}
+		counts[table] = n
+	}
+	return counts, nil
+}
+
+func fileSHA256(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// inspectBackup runs PRAGMA integrity_check on the database file at path and builds its manifest.
+func inspectBackup(ctx context.Context, path string) (backupManifest, error) {
+	if err := checkDatabaseIntegrity(ctx, path); err != nil {
+		return backupManifest{}, err
+	}
+	conn, err := sql.Open(sqliteDriverName, path)
+	if err != nil {
+		return backupManifest{}, err
+	}
+	rows, err := tableRowCounts(ctx, conn)
+	conn.Close()
+	if err != nil {
+		return backupManifest{}, fmt.Errorf("count rows: %w", err)
+	}
+	sum, err := fileSHA256(path)
+	if err != nil {
+		return backupManifest{}, err
+	}
+	return backupManifest{SHA256: sum, Rows: rows}, nil
+}
+
+// verifyBackup restores backup from target into a temporary file, without its deltas, and checks it against
+// the manifest it was uploaded with. The live database keeps changing after the backup, so against it a table
+// the backup lacks and a grow-only table that shrank are failures, any other count that moved is not.
+func verifyBackup(ctx context.Context, target BackupTarget, backup backupObject, live *sql.DB) error {
+	info, err := target.Stat(ctx, backup.Key)
+	if err != nil {
+		return fmt.Errorf("stat %s: %w", backup.Key, err)
+	}
+	manifest, hasManifest, err := parseBackupManifest(info.Metadata)
+	if err != nil {
+		return fmt.Errorf("manifest of %s: %w", backup.Key, err)
+	}
+
+	dir, err := os.MkdirTemp("", "verify_mars_")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "mars.db")
+	obj, err := target.Get(ctx, backup.Key)
+	if err != nil {
+		return fmt.Errorf("download %s: %w", backup.Key, err)
+	}
+	err = restoreBackup(ctx, obj, nil, path, true)
+	obj.Close()
+	if err != nil {
+		return fmt.Errorf("restore %s: %w", backup.Key, err)
+	}
+	restored, err := inspectBackup(ctx, path)
+	if err != nil {
+		return err
+	}
+
+	var problems []string
+	if hasManifest {
+		if manifest.SHA256 != "" && manifest.SHA256 != restored.SHA256 {
+			problems = append(problems, fmt.Sprintf("sha256 %s, expected %s", restored.SHA256, manifest.SHA256))
+		}
+		for table, want := range manifest.Rows {
+			if got, ok := restored.Rows[table]; !ok || got != want {
+				problems = append(problems, fmt.Sprintf("%s has %d rows, expected %d", table, got, want))
+			}
+		}
+	} else if logger != nil {
+		logger.Warn("backup has no manifest, only checking it against the live database", zap.String("key", backup.Key))
+	}
+	if live != nil {
+		liveRows, err := tableRowCounts(ctx, live)
+		if err != nil {
+			return fmt.Errorf("count live rows: %w", err)
+		}
+		drift := make(map[string]int64)
+		for table, n := range liveRows {
+			got, ok := restored.Rows[table]
+			if !ok {
+				problems = append(problems, fmt.Sprintf("table %s is missing", table))
+				continue
+			}
+			if n < got && slices.Contains(growOnlyTables, table) {
+				problems = append(problems, fmt.Sprintf("live %s has %d rows, fewer than the %d of the backup", table, n, got))
+				continue
+			}
+			if n != got {
+				drift[table] = n - got
+			}
+		}
+		if len(drift) > 0 && logger != nil {
+			logger.Info("live database moved on since the backup", zap.String("key", backup.Key), zap.Any("rows", drift))
+		}
+	}
+	if len(problems) > 0 {
+		sort.Strings(problems)
+		return fmt.Errorf("backup %s does not match: %s", backup.Key, strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+// VerifyLatestBackup test restores the newest backup of every target and alerts on each that fails.
+func VerifyLatestBackup(ctx context.Context) error {
+	targets, err := configuredBackupTargets()
+	if err != nil {
+		return err
+	}
+	var errs []error
+	for _, t := range targets {
+		if err := verifyLatestOn(ctx, t); err != nil {
+			err = fmt.Errorf("verify backup on %s: %w", t.Name(), err)
+			backupAlert(err.Error())
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func verifyLatestOn(ctx context.Context, target BackupTarget) error {
+	backups, err := listBackups(ctx, target)
+	if err != nil {
+		return err
+	}
+	latest, err := pickBackup(backups, "latest", time.Time{})
+	if err != nil {
+		return err
+	}
+	if err := verifyBackup(ctx, target, latest, db); err != nil {
+		return err
+	}
+	if logger != nil {
+		logger.Info("backup verified", zap.String("target", target.Name()), zap.String("key", latest.Key))
+	}
+	return nil
+}
+
+// backupAlert logs a backup problem as an error and sends it to BACKUP_ALERT_CHAT_ID if set.
+func backupAlert(text string) {
+	if logger != nil {
+		logger.Error("backup alert", zap.String("alert", text))
+	}
+	bot := alertBot.Load()
+	if bot == nil || config.BackupAlertChatID == 0 {
+		return
+	}
+	if _, err := bot.SendMessage(config.BackupAlertChatID, "⚠️ 备份告警\n"+text, nil); err != nil && logger != nil {
+		logger.Warn("send backup alert", zap.Error(err))
+	}
+}
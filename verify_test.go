@@ -0,0 +1,90 @@
+package marsbot
+
+import (
+	"context"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"marsbot/minicv"
+)
+
+func TestBackupManifestMetadata(t *testing.T) {
+	m := backupManifest{SHA256: "abc", Rows: map[string]int64{"mars_info": 12, "group_settings": 0}}
+	meta := m.metadata()
+	if meta[metaRowCounts] != "group_settings=0,mars_info=12" {
+		t.Fatalf("row counts = %q", meta[metaRowCounts])
+	}
+	got, ok, err := parseBackupManifest(meta)
+	if err != nil || !ok || got.SHA256 != "abc" || got.Rows["mars_info"] != 12 || len(got.Rows) != 2 {
+		t.Fatalf("parse = %+v, %v, %v", got, ok, err)
+	}
+	if _, ok, err := parseBackupManifest(map[string]string{"Encryption": "aes-256-gcm"}); ok || err != nil {
+		t.Fatalf("backup without manifest = %v, %v", ok, err)
+	}
+	if _, _, err := parseBackupManifest(map[string]string{metaRowCounts: "mars_info"}); err == nil {
+		t.Fatalf("expected malformed row counts to fail")
+	}
+}
+
+func TestVerifyBackup(t *testing.T) {
+	useTestDB(t)
+	config.BackupKeyFile = ""
+	ctx := context.Background()
+	hash := picHash{Algo: minicv.AlgoDHash, Size: 8, Hash: []byte{1, 2, 3, 4, 5, 6, 7, 8}}
+	if _, err := recordMars(ctx, -1, 1, hash); err != nil {
+		t.Fatalf("record: %v", err)
+	}
+	dir := t.TempDir()
+	backupPath := filepath.Join(dir, "backup_mars_at_2024-01-01-00_00_00.db")
+	if err := backupWithSQLiteAPI(ctx, backupPath); err != nil {
+		t.Fatalf("backup: %v", err)
+	}
+	manifest, err := inspectBackup(ctx, backupPath)
+	if err != nil {
+		t.Fatalf("inspect: %v", err)
+	}
+	if manifest.Rows["mars_info"] != 1 {
+		t.Fatalf("mars_info rows = %d", manifest.Rows["mars_info"])
+	}
+	compressed, err := zstdFile(backupPath)
+	if err != nil {
+		t.Fatalf("compress: %v", err)
+	}
+	target := localTarget{dir: t.TempDir()}
+	if _, err := uploadBackup(ctx, []BackupTarget{target}, compressed, manifest.metadata()); err != nil {
+		t.Fatalf("upload: %v", err)
+	}
+	backups, err := listBackups(ctx, target)
+	if err != nil || len(backups) != 1 {
+		t.Fatalf("list = %v, %v", backups, err)
+	}
+
+	// the live database moving on is not a failure
+	other := picHash{Algo: minicv.AlgoDHash, Size: 8, Hash: []byte{8, 7, 6, 5, 4, 3, 2, 1}}
+	if _, err := recordMars(ctx, -1, 2, other); err != nil {
+		t.Fatalf("record: %v", err)
+	}
+	if err := verifyBackup(ctx, target, backups[0], db); err != nil {
+		t.Fatalf("verify: %v", err)
+	}
+
+	// a grow-only table that lost rows is
+	if _, err := db.ExecContext(ctx, "DELETE FROM mars_info"); err != nil {
+		t.Fatalf("delete: %v", err)
+	}
+	err = verifyBackup(ctx, target, backups[0], db)
+	if err == nil || !strings.Contains(err.Error(), "live mars_info has 0 rows") {
+		t.Fatalf("verify against a shrunk database = %v", err)
+	}
+
+	wrong := manifest
+	wrong.Rows = map[string]int64{"mars_info": 5}
+	if _, err := uploadBackup(ctx, []BackupTarget{target}, compressed, wrong.metadata()); err != nil {
+		t.Fatalf("upload: %v", err)
+	}
+	err = verifyBackup(ctx, target, backups[0], db)
+	if err == nil || !strings.Contains(err.Error(), "mars_info has 1 rows, expected 5") {
+		t.Fatalf("verify with a wrong manifest = %v", err)
+	}
+}
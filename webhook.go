@@ -0,0 +1,178 @@
+package marsbot
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/PaulSonOfLars/gotgbot/v2"
+	"github.com/PaulSonOfLars/gotgbot/v2/ext"
+	"go.uber.org/zap"
+)
+
+const (
+	webhookCertFile     = "marsbot-webhook.crt"
+	webhookKeyFile      = "marsbot-webhook.key"
+	webhookCertValidFor = 10 * 365 * 24 * time.Hour
+)
+
+// startWebhook serves updates on WEBHOOK_LISTEN_ADDR and registers WEBHOOK_URL with Telegram.
+// The updater keeps using the dispatcher built by buildDispatcher, so handlers behave the same as in polling mode.
+func startWebhook(updater *ext.Updater, bot *gotgbot.Bot) error {
+	if config.WebhookUrl == "" {
+		return errors.New("WEBHOOK_URL is required in webhook mode")
+	}
+	base, err := url.Parse(config.WebhookUrl)
+	if err != nil {
+		return fmt.Errorf("parse webhook url: %w", err)
+	}
+	if base.Scheme != "https" {
+		return fmt.Errorf("webhook url must use https, got %q", base.Scheme)
+	}
+	urlPath := strings.Trim(config.WebhookPath, "/")
+	hookURL := strings.TrimSuffix(base.String(), "/") + "/" + urlPath
+
+	secret := config.WebhookSecret
+	if secret == "" {
+		secret, err = randomWebhookSecret()
+		if err != nil {
+			return err
+		}
+	}
+
+	opts := ext.WebhookOpts{
+		ListenAddr:        config.WebhookListenAddr,
+		ReadHeaderTimeout: 5 * time.Second,
+		SecretToken:       secret,
+	}
+	setOpts := &gotgbot.SetWebhookOpts{
+		AllowedUpdates: allowedUpdates,
+		SecretToken:    secret,
+	}
+	if config.WebhookSelfSigned {
+		certFile, keyFile, err := ensureSelfSignedCert(config.WebhookCertDir, base.Hostname())
+		if err != nil {
+			return fmt.Errorf("prepare self-signed certificate: %w", err)
+		}
+		opts.CertFile = certFile
+		opts.KeyFile = keyFile
+
+		cert, err := os.Open(certFile)
+		if err != nil {
+			return err
+		}
+		defer cert.Close()
+		setOpts.Certificate = gotgbot.InputFileByReader(filepath.Base(certFile), cert)
+	}
+
+	if err := updater.StartWebhook(bot, urlPath, opts); err != nil {
+		return fmt.Errorf("start webhook server: %w", err)
+	}
+	if _, err := bot.SetWebhook(hookURL, setOpts); err != nil {
+		return fmt.Errorf("set webhook: %w", err)
+	}
+	logger.Info("webhook registered",
+		zap.String("listen", config.WebhookListenAddr),
+		zap.String("path", "/"+urlPath),
+		zap.Bool("self_signed", config.WebhookSelfSigned))
+	return nil
+}
+
+func randomWebhookSecret() (string, error) {
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		return "", fmt.Errorf("generate webhook secret: %w", err)
+	}
+	return hex.EncodeToString(buf), nil
+}
+
+// ensureSelfSignedCert returns a certificate/key pair for host inside dir, generating it when missing.
+// Telegram only accepts the certificate if its subject matches the host in the webhook url.
+func ensureSelfSignedCert(dir, host string) (string, string, error) {
+	if dir == "" {
+		dir = os.TempDir()
+	}
+	certPath := filepath.Join(dir, webhookCertFile)
+	keyPath := filepath.Join(dir, webhookKeyFile)
+	if certMatchesHost(certPath, host) {
+		if _, err := os.Stat(keyPath); err == nil {
+			return certPath, keyPath, nil
+		}
+	}
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return "", "", err
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return "", "", fmt.Errorf("generate key: %w", err)
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return "", "", fmt.Errorf("generate serial: %w", err)
+	}
+	now := time.Now()
+	tmpl := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: host},
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.Add(webhookCertValidFor),
+		KeyUsage:              x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		tmpl.IPAddresses = []net.IP{ip}
+	} else {
+		tmpl.DNSNames = []string{host}
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		return "", "", fmt.Errorf("create certificate: %w", err)
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return "", "", fmt.Errorf("marshal key: %w", err)
+	}
+
+	if err := os.WriteFile(keyPath, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0o600); err != nil {
+		return "", "", err
+	}
+	if err := os.WriteFile(certPath, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o644); err != nil {
+		return "", "", err
+	}
+	logger.Info("generated self-signed webhook certificate", zap.String("host", host), zap.String("path", certPath))
+	return certPath, keyPath, nil
+}
+
+func certMatchesHost(path, host string) bool {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return false
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return false
+	}
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return false
+	}
+	if time.Now().Add(24 * time.Hour).After(cert.NotAfter) {
+		return false
+	}
+	return cert.VerifyHostname(host) == nil
+}
@@ -0,0 +1,67 @@
+package marsbot
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"go.uber.org/zap"
+)
+
+func TestStartWebhookRejectsBadConfig(t *testing.T) {
+	prev := config
+	t.Cleanup(func() { config = prev })
+	for _, hookURL := range []string{"", "http://bot.example.com", "://bad"} {
+		config.WebhookUrl = hookURL
+		// the url is checked before the updater or bot are touched
+		if err := startWebhook(nil, nil); err == nil {
+			t.Errorf("WEBHOOK_URL %q accepted", hookURL)
+		}
+	}
+}
+
+func TestRandomWebhookSecret(t *testing.T) {
+	a, err := randomWebhookSecret()
+	if err != nil {
+		t.Fatalf("secret: %v", err)
+	}
+	b, _ := randomWebhookSecret()
+	// Telegram allows 1-256 characters of A-Z, a-z, 0-9, _ and -
+	if len(a) != 64 || a == b {
+		t.Fatalf("secrets %q and %q", a, b)
+	}
+}
+
+func TestEnsureSelfSignedCert(t *testing.T) {
+	prevLogger := logger
+	logger = zap.NewNop()
+	t.Cleanup(func() { logger = prevLogger })
+	dir := filepath.Join(t.TempDir(), "certs")
+
+	certPath, keyPath, err := ensureSelfSignedCert(dir, "bot.example.com")
+	if err != nil {
+		t.Fatalf("generate: %v", err)
+	}
+	if certPath != filepath.Join(dir, webhookCertFile) || keyPath != filepath.Join(dir, webhookKeyFile) {
+		t.Fatalf("paths = %s, %s", certPath, keyPath)
+	}
+	if !certMatchesHost(certPath, "bot.example.com") || certMatchesHost(certPath, "other.example.com") {
+		t.Fatalf("certificate does not match only its host")
+	}
+	first, _ := os.ReadFile(certPath)
+
+	if _, _, err := ensureSelfSignedCert(dir, "bot.example.com"); err != nil {
+		t.Fatalf("reuse: %v", err)
+	}
+	if again, _ := os.ReadFile(certPath); !bytes.Equal(first, again) {
+		t.Fatalf("valid certificate was regenerated")
+	}
+
+	if _, _, err := ensureSelfSignedCert(dir, "203.0.113.7"); err != nil {
+		t.Fatalf("regenerate for ip: %v", err)
+	}
+	if !certMatchesHost(certPath, "203.0.113.7") {
+		t.Fatalf("certificate was not regenerated for the new host")
+	}
+}